@@ -0,0 +1,138 @@
+// Package cache holds the cache interface used by the db package to read documents through a cache, and an
+// in-process LRU implementation with per entry expiry.
+//
+// Values are the raw BSON of documents as they are stored in MongoDB. The db package never modifies a value
+// after passing it to Set or receiving it from Get.
+//
+// Example:
+//
+//	mongoDB := db.New(
+//		db.WithCache(cache.NewLRU(10000), 5*time.Minute),
+//	)
+package cache
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCapacity is the number of entries an LRU holds when it is created with a capacity of zero or less.
+const DefaultCapacity = 10000
+
+// ICache stores values by key. Implementations backed by a remote store, such as Redis, should treat a
+// failure as a miss in Get and ignore it in the other methods, so that the datastore falls back to MongoDB.
+type ICache interface {
+	// Get returns the value stored under key, or false when there is none or it has expired.
+	Get(ctx context.Context, key string) ([]byte, bool)
+	// Set stores value under key. A ttl of zero or less keeps the value until it is evicted or deleted.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	// Delete removes the keys.
+	Delete(ctx context.Context, keys ...string)
+	// DeletePrefix removes every key that starts with prefix.
+	DeletePrefix(ctx context.Context, prefix string)
+}
+
+// LRU is an in-process ICache that holds a fixed number of entries and evicts the least recently used one
+// when it is full. Expired entries are removed when they are read or evicted. It is safe for concurrent use.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int
+	entries  *list.List
+	index    map[string]*list.Element
+	now      func() time.Time
+}
+
+// entry is an element of LRU.entries.
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an empty LRU that holds up to capacity entries, or DefaultCapacity when capacity is zero or less.
+func NewLRU(capacity int) *LRU {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &LRU{
+		capacity: capacity,
+		entries:  list.New(),
+		index:    map[string]*list.Element{},
+		now:      time.Now,
+	}
+}
+
+// Get implements ICache.
+func (c *LRU) Get(_ context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.entries.MoveToFront(element)
+	return e.value, true
+}
+
+// Set implements ICache.
+func (c *LRU) Set(_ context.Context, key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.index[key]; ok {
+		e := element.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.entries.MoveToFront(element)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.entries.Len() > c.capacity {
+		c.remove(c.entries.Back())
+	}
+}
+
+// Delete implements ICache.
+func (c *LRU) Delete(_ context.Context, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := c.index[key]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// DeletePrefix implements ICache. It walks every entry, so it is meant for invalidation rather than hot paths.
+func (c *LRU) DeletePrefix(_ context.Context, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, element := range c.index {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+		}
+	}
+}
+
+// Len returns the number of entries, including expired entries that have not been removed yet.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// remove deletes an element; the caller holds the lock.
+func (c *LRU) remove(element *list.Element) {
+	c.entries.Remove(element)
+	delete(c.index, element.Value.(*entry).key)
+}
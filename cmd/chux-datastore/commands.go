@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// ping checks that the server is reachable and prints the round trip time.
+func ping(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("ping takes no arguments")
+	}
+	start := time.Now()
+	if err := a.mongoDB.Ping(a.ctx); err != nil {
+		return err
+	}
+	return a.out.value(bson.D{{Key: "ok", Value: true}, {Key: "latency", Value: time.Since(start).Round(time.Microsecond).String()}})
+}
+
+// listCollections prints the names of the collections of the database.
+func listCollections(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("list-collections takes no arguments")
+	}
+	databaseName, err := a.databaseName()
+	if err != nil {
+		return err
+	}
+	client, err := a.mongoDB.Client()
+	if err != nil {
+		return err
+	}
+	names, err := client.Database(databaseName).ListCollectionNames(a.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, []string{name})
+	}
+	return a.out.table([]string{"COLLECTION"}, rows)
+}
+
+// get prints the document with the given ObjectID.
+func get(a *app, args []string) error {
+	if len(args) != 1 {
+		return usageError("get takes the id of the document")
+	}
+	doc, err := a.document()
+	if err != nil {
+		return err
+	}
+	if _, err := a.mongoDB.GetByID(doc, args[0]); err != nil {
+		return err
+	}
+	raw, err := documentRaw(doc)
+	if err != nil {
+		return err
+	}
+	return a.out.document(raw)
+}
+
+// query prints the documents whose fields equal the values of the field=value arguments. A value that is
+// Extended JSON, such as 42, true or {"$gt": 10}, is used as that value, any other value as a string.
+// Without arguments every document of the collection is printed.
+func query(a *app, args []string) error {
+	doc, err := a.document()
+	if err != nil {
+		return err
+	}
+	queries := make([]interface{}, 0, 2*len(args))
+	for _, arg := range args {
+		field, value, ok := strings.Cut(arg, "=")
+		if !ok || len(field) == 0 {
+			return usageError(fmt.Sprintf("invalid query %q, use field=value", arg))
+		}
+		queries = append(queries, field, parseValue(value))
+	}
+	var docs []db.IMongoDocument
+	if len(queries) == 0 {
+		docs, err = a.mongoDB.GetAll(doc)
+	} else {
+		docs, err = a.mongoDB.Query(doc, queries...)
+	}
+	if err != nil {
+		return err
+	}
+	raws := make([]bson.Raw, 0, len(docs))
+	for _, doc := range docs {
+		raw, err := documentRaw(doc.(*db.Document))
+		if err != nil {
+			return err
+		}
+		raws = append(raws, raw)
+	}
+	return a.out.documents(raws)
+}
+
+// parseValue returns the value of a query argument: the Extended JSON value it holds, or the string itself.
+func parseValue(s string) interface{} {
+	var holder struct {
+		Value interface{} `bson:"v"`
+	}
+	if err := bson.UnmarshalExtJSON([]byte(`{"v":`+s+`}`), false, &holder); err != nil {
+		return s
+	}
+	return holder.Value
+}
+
+// export writes the documents of the collection that match a filter to a file, or to stdout.
+func export(a *app, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", string(db.FormatNDJSON), "file `format`: json, json-canonical, ndjson or bson")
+	file := flags.String("file", "", "output `path`, stdout when it is not set")
+	filterJSON := flags.String("filter", "{}", "Extended JSON `filter` of the documents to export")
+	batch := flags.Int("batch", db.DefaultTransferBatchSize, "number of documents read per batch")
+	if _, err := a.parseFlags(flags, args); err != nil {
+		return err
+	}
+	doc, err := a.document()
+	if err != nil {
+		return err
+	}
+	f, err := db.ParseFormat(*format)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	var filter bson.D
+	if err := bson.UnmarshalExtJSON([]byte(*filterJSON), false, &filter); err != nil {
+		return usageError(fmt.Sprintf("invalid filter: %s", err))
+	}
+
+	var w io.Writer = a.out.w
+	if len(*file) > 0 {
+		out, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	result, err := a.mongoDB.Export(doc, filter, w, f, db.TransferBatchSize(*batch))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stderr, "exported %d documents\n", result.Documents)
+	return nil
+}
+
+// importDocuments loads the documents of a file, or of stdin, into the collection.
+func importDocuments(a *app, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", string(db.FormatNDJSON), "file `format`: json, json-canonical, ndjson or bson")
+	mode := flags.String("mode", string(db.ImportInsert), "import `mode`: insert, upsert or replace")
+	keys := flags.String("keys", "", "comma separated key `fields` that match existing documents in upsert mode, _id by default")
+	batch := flags.Int("batch", db.DefaultTransferBatchSize, "number of documents written per batch")
+	file := flags.String("file", "", "input `path`, stdin when it is not set")
+	if _, err := a.parseFlags(flags, args); err != nil {
+		return err
+	}
+	doc, err := a.document()
+	if err != nil {
+		return err
+	}
+	f, err := db.ParseFormat(*format)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	importMode, err := db.ParseImportMode(*mode)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	options := []db.TransferOption{db.TransferBatchSize(*batch)}
+	if len(*keys) > 0 {
+		options = append(options, db.TransferKeyFields(strings.Split(*keys, ",")...))
+	}
+
+	r := a.stdin
+	if len(*file) > 0 {
+		in, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		r = in
+	}
+	result, err := a.mongoDB.Import(doc, r, f, importMode, options...)
+	if result != nil {
+		if printErr := a.out.value(result); printErr != nil && err == nil {
+			err = printErr
+		}
+	}
+	return err
+}
+
+// ensureIndexes creates a unique index on each field and prints the indexes of the collection.
+func ensureIndexes(a *app, args []string) error {
+	if len(args) == 0 {
+		return usageError("ensure-indexes takes the fields to index")
+	}
+	doc, err := a.document()
+	if err != nil {
+		return err
+	}
+	if _, err := a.mongoDB.CreateIndices(doc, args...); err != nil {
+		return err
+	}
+
+	databaseName, err := a.databaseName()
+	if err != nil {
+		return err
+	}
+	client, err := a.mongoDB.Client()
+	if err != nil {
+		return err
+	}
+	cursor, err := client.Database(databaseName).Collection(a.mongoDB.CollectionName).Indexes().List(a.ctx)
+	if err != nil {
+		return err
+	}
+	var indexes []struct {
+		Name   string   `bson:"name"`
+		Key    bson.Raw `bson:"key"`
+		Unique bool     `bson:"unique"`
+	}
+	if err := cursor.All(a.ctx, &indexes); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(indexes))
+	for _, index := range indexes {
+		rows = append(rows, []string{index.Name, formatValue(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: index.Key}), fmt.Sprint(index.Unique)})
+	}
+	return a.out.table([]string{"NAME", "KEY", "UNIQUE"}, rows)
+}
+
+// stats prints the collStats of the configured collection, or the dbStats of the database when no
+// collection is configured.
+func stats(a *app, args []string) error {
+	if len(args) > 0 {
+		return usageError("stats takes no arguments")
+	}
+	databaseName, err := a.databaseName()
+	if err != nil {
+		return err
+	}
+	client, err := a.mongoDB.Client()
+	if err != nil {
+		return err
+	}
+	command := bson.D{{Key: "dbStats", Value: 1}}
+	if len(a.mongoDB.CollectionName) > 0 {
+		command = bson.D{{Key: "collStats", Value: a.mongoDB.CollectionName}}
+	}
+	result, err := client.Database(databaseName).RunCommand(a.ctx, command).DecodeBytes()
+	if err != nil {
+		return err
+	}
+	if !a.out.json {
+		result = withoutDetails(result)
+	}
+	return a.out.document(result)
+}
+
+// withoutDetails removes the storage engine and per index details from a stats result, they are too large
+// to read in a table.
+func withoutDetails(result bson.Raw) bson.Raw {
+	elements, err := result.Elements()
+	if err != nil {
+		return result
+	}
+	kept := bson.D{}
+	for _, element := range elements {
+		switch element.Key() {
+		case "wiredTiger", "indexDetails", "$clusterTime", "operationTime":
+			continue
+		}
+		kept = append(kept, bson.E{Key: element.Key(), Value: element.Value()})
+	}
+	raw, err := bson.Marshal(kept)
+	if err != nil {
+		return result
+	}
+	return raw
+}
@@ -0,0 +1,221 @@
+// Command chux-datastore runs common datastore tasks against MongoDB with the db package: checking the
+// connection, reading, exporting and importing documents, creating indexes, running migrations and
+// reporting statistics.
+//
+// Usage:
+//
+//	chux-datastore [flags] <command> [arguments]
+//
+// The connection is configured the same way as an application. With -config the settings are read from a
+// YAML, JSON or TOML file by db.LoadConfig, otherwise from the CHUX_DATASTORE_* environment variables.
+// -uri, -database and -collection override the configured values.
+//
+// The commands are:
+//
+//	ping                            check that the server is reachable
+//	list-collections                list the collections of the database
+//	get <id>                        print the document with the given ObjectID
+//	query [field=value ...]         print the documents whose fields equal the values
+//	export [flags]                  write the documents of the collection to a file
+//	import [flags]                  load documents from a file into the collection
+//	ensure-indexes <field> ...      create a unique index on each field
+//	migrate [-dir dir] up [n]       apply the pending migrations, or the next n
+//	migrate [-dir dir] down [n]     revert the last n applied migrations, 1 by default
+//	migrate [-dir dir] status       list the migrations and whether they are applied
+//	stats                           print the statistics of the collection, or of the database
+//
+// Results are printed as tables, or as JSON with -output json. Documents are printed as relaxed
+// Extended JSON.
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/logging"
+)
+
+// command is a subcommand of the tool.
+type command struct {
+	usage string
+	run   func(a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"ping":             {"ping", ping},
+	"list-collections": {"list-collections", listCollections},
+	"get":              {"get <id>", get},
+	"query":            {"query [field=value ...]", query},
+	"export":           {"export [-format json|json-canonical|ndjson|bson] [-file path] [-filter json]", export},
+	"import":           {"import [-format json|ndjson|bson] [-mode insert|upsert|replace] [-keys fields] [-batch n] [-file path]", importDocuments},
+	"ensure-indexes":   {"ensure-indexes <field> ...", ensureIndexes},
+	"migrate":          {"migrate [-dir dir] up [n] | down [n] | status", migrate},
+	"stats":            {"stats", stats},
+}
+
+// app is the state shared by the commands.
+type app struct {
+	ctx     context.Context
+	mongoDB *db.MongoDB
+	out     *printer
+	stdin   io.Reader
+	stderr  io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the tool with args and returns the exit status: 0 on success, 1 when the command failed and 2
+// when it was used incorrectly.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("chux-datastore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "YAML, JSON or TOML config `file`; the CHUX_DATASTORE_* environment variables are used when it is not set")
+	uri := flags.String("uri", "", "MongoDB connection string, overrides the configured uri")
+	database := flags.String("database", "", "database `name`, overrides the configured database")
+	collection := flags.String("collection", "", "collection `name`, overrides the configured collection")
+	output := flags.String("output", "table", "output `format`: table or json")
+	verbose := flags.Bool("v", false, "write debug logs to stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: chux-datastore [flags] <command> [arguments]\n\nCommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(stderr, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "chux-datastore: unknown command %q\n", name)
+		flags.Usage()
+		return 2
+	}
+	out, err := newPrinter(stdout, *output)
+	if err != nil {
+		fmt.Fprintf(stderr, "chux-datastore: %s\n", err)
+		return 2
+	}
+
+	var config *db.Config
+	if len(*configPath) > 0 {
+		config, err = db.LoadConfig(*configPath)
+	} else {
+		config, err = db.ConfigFromEnv()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "chux-datastore: %s\n", errorMessage(err))
+		return 1
+	}
+	options := []func(*db.MongoDB){config.Option()}
+	if len(*uri) > 0 {
+		options = append(options, db.WithURI(*uri))
+	}
+	if len(*database) > 0 {
+		options = append(options, db.WithDatabaseName(*database))
+	}
+	if len(*collection) > 0 {
+		options = append(options, db.WithCollectionName(*collection))
+	}
+	// the errors are printed by the tool, the logs of the db package are only written with -v
+	logger := logging.NewTextLogger(io.Discard, logging.LogLevelError)
+	if *verbose {
+		logger = logging.NewTextLogger(stderr, logging.LogLevelDebug)
+	}
+	options = append(options, db.WithLogger(*logger))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	mongoDB := db.New(options...)
+	a := &app{ctx: ctx, mongoDB: mongoDB.WithContext(ctx), out: out, stdin: stdin, stderr: stderr}
+	defer a.disconnect()
+
+	if err := cmd.run(a, flags.Args()[1:]); err != nil {
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(stderr, "chux-datastore: %s\nUsage: chux-datastore [flags] %s\n", err, cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(stderr, "chux-datastore %s: %s\n", name, errorMessage(err))
+		return 1
+	}
+	return 0
+}
+
+// usageError is returned by a command that was given invalid arguments.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// errorMessage returns the message of err followed by the messages of the errors it wraps, which the
+// errors of the db package leave out.
+func errorMessage(err error) string {
+	message := err.Error()
+	for inner := stderrors.Unwrap(err); inner != nil; inner = stderrors.Unwrap(inner) {
+		if innerMessage := inner.Error(); !strings.Contains(message, innerMessage) {
+			message = strings.TrimRight(message, ". ") + ": " + innerMessage
+		}
+	}
+	return message
+}
+
+// disconnect closes the client of the app if a command opened one.
+func (a *app) disconnect() {
+	if client, err := a.mongoDB.Connect(); err == nil {
+		client.Disconnect(context.Background())
+	}
+}
+
+// document returns an empty document of the configured collection. It fails when no database or collection
+// is configured.
+func (a *app) document() (*db.Document, error) {
+	if _, err := a.databaseName(); err != nil {
+		return nil, err
+	}
+	if len(a.mongoDB.CollectionName) == 0 {
+		return nil, usageError("no collection is configured, use -collection or " + db.EnvPrefix + "COLLECTION")
+	}
+	return db.NewDocument("", ""), nil
+}
+
+// databaseName returns the configured database. It fails when no database is configured.
+func (a *app) databaseName() (string, error) {
+	if len(a.mongoDB.DatabaseName) == 0 {
+		return "", usageError("no database is configured, use -database or " + db.EnvPrefix + "DATABASE")
+	}
+	return a.mongoDB.DatabaseName, nil
+}
+
+// parseFlags parses the flags of a command and returns its remaining arguments.
+func (a *app) parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(a.stderr)
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError(strings.TrimSpace(err.Error()))
+	}
+	return flags.Args(), nil
+}
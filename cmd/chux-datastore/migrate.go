@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// migrationsCollection records the migrations applied to a database.
+const migrationsCollection = "schema_migrations"
+
+// migrationFileName matches the name of a migration file: a version number, an underscore and a name,
+// such as 0003_add_status_index.json.
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.json$`)
+
+// migration is a file of the migrations directory. Up and Down are database commands written in Extended
+// JSON and run in order with RunCommand, for example:
+//
+//	{
+//	  "up": [{"createIndexes": "orders", "indexes": [{"key": {"status": 1}, "name": "status_1"}]}],
+//	  "down": [{"dropIndexes": "orders", "index": "status_1"}]
+//	}
+type migration struct {
+	Version int64
+	Name    string
+	Up      []bson.D `bson:"up"`
+	Down    []bson.D `bson:"down"`
+}
+
+// appliedMigration is the record of an applied migration.
+type appliedMigration struct {
+	Version   int64     `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// migrate applies, reverts or lists the migrations of a directory.
+func migrate(a *app, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dir := flags.String("dir", "migrations", "`directory` of the migration files")
+	args, err := a.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return usageError("migrate takes up, down or status")
+	}
+	steps := 0
+	if len(args) == 2 {
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			return usageError(fmt.Sprintf("invalid number of migrations %q", args[1]))
+		}
+	}
+
+	migrations, err := readMigrations(*dir)
+	if err != nil {
+		return err
+	}
+	databaseName, err := a.databaseName()
+	if err != nil {
+		return err
+	}
+	client, err := a.mongoDB.Client()
+	if err != nil {
+		return err
+	}
+	database := client.Database(databaseName)
+	applied, err := appliedMigrations(a, database)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(a, database, migrations, applied, steps)
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		return migrateDown(a, database, migrations, applied, steps)
+	case "status":
+		if len(args) > 1 {
+			return usageError("migrate status takes no number")
+		}
+		return migrationStatus(a, migrations, applied)
+	default:
+		return usageError(fmt.Sprintf("unknown migrate command %q, use up, down or status", args[0]))
+	}
+}
+
+// readMigrations reads the migration files of dir in version order.
+func readMigrations(dir string) ([]*migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []*migration
+	versions := map[int64]string{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid version: %w", entry.Name(), err)
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("%s and %s have the same version", other, entry.Name())
+		}
+		versions[version] = entry.Name()
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := &migration{Version: version, Name: match[2]}
+		if err := bson.UnmarshalExtJSON(data, false, m); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// appliedMigrations returns the applied migrations by version.
+func appliedMigrations(a *app, database db.IMongoDatabase) (map[int64]appliedMigration, error) {
+	cursor, err := database.Collection(migrationsCollection).Find(a.ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var records []appliedMigration
+	if err := cursor.All(a.ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]appliedMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// migrateUp applies the pending migrations in version order, at most steps of them when steps is not 0.
+// It stops at the first command that fails.
+func migrateUp(a *app, database db.IMongoDatabase, migrations []*migration, applied map[int64]appliedMigration, steps int) error {
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if steps > 0 && count == steps {
+			break
+		}
+		if err := runCommands(a, database, m.Up); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		record := appliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}
+		if _, err := database.Collection(migrationsCollection).InsertOne(a.ctx, record); err != nil {
+			return fmt.Errorf("migration %d_%s was applied but could not be recorded: %w", m.Version, m.Name, err)
+		}
+		fmt.Fprintf(a.stderr, "applied %d_%s\n", m.Version, m.Name)
+		count++
+	}
+	if count == 0 {
+		fmt.Fprintln(a.stderr, "no pending migrations")
+	}
+	return nil
+}
+
+// migrateDown reverts the last steps applied migrations, newest first. A migration whose file is missing
+// cannot be reverted.
+func migrateDown(a *app, database db.IMongoDatabase, migrations []*migration, applied map[int64]appliedMigration, steps int) error {
+	byVersion := make(map[int64]*migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+	versions := make([]int64, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	if len(versions) > steps {
+		versions = versions[:steps]
+	}
+	for _, version := range versions {
+		m, ok := byVersion[version]
+		if !ok {
+			return fmt.Errorf("migration %d_%s cannot be reverted, its file is missing", version, applied[version].Name)
+		}
+		if err := runCommands(a, database, m.Down); err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := database.Collection(migrationsCollection).DeleteOne(a.ctx, bson.D{{Key: "_id", Value: version}}); err != nil {
+			return fmt.Errorf("migration %d_%s was reverted but its record could not be deleted: %w", m.Version, m.Name, err)
+		}
+		fmt.Fprintf(a.stderr, "reverted %d_%s\n", m.Version, m.Name)
+	}
+	if len(versions) == 0 {
+		fmt.Fprintln(a.stderr, "no applied migrations")
+	}
+	return nil
+}
+
+// migrationStatus prints every migration, of the directory or of the database, and whether it is applied.
+func migrationStatus(a *app, migrations []*migration, applied map[int64]appliedMigration) error {
+	var rows [][]string
+	seen := map[int64]bool{}
+	for _, m := range migrations {
+		seen[m.Version] = true
+		status, appliedAt := "pending", ""
+		if record, ok := applied[m.Version]; ok {
+			status, appliedAt = "applied", record.AppliedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{strconv.FormatInt(m.Version, 10), m.Name, status, appliedAt})
+	}
+	for version, record := range applied {
+		if !seen[version] {
+			rows = append(rows, []string{strconv.FormatInt(version, 10), record.Name, "missing file", record.AppliedAt.Format(time.RFC3339)})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		vi, _ := strconv.ParseInt(rows[i][0], 10, 64)
+		vj, _ := strconv.ParseInt(rows[j][0], 10, 64)
+		return vi < vj
+	})
+	return a.out.table([]string{"VERSION", "NAME", "STATUS", "APPLIED_AT"}, rows)
+}
+
+// runCommands runs database commands in order and stops at the first that fails.
+func runCommands(a *app, database db.IMongoDatabase, commands []bson.D) error {
+	for _, command := range commands {
+		if err := database.RunCommand(a.ctx, command).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
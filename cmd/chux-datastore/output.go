@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// printer writes the results of the commands as tables or as JSON.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+// newPrinter returns a printer writing to w in the given output format, "table" or "json".
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch strings.ToLower(format) {
+	case "table":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q, use table or json", format)
+	}
+}
+
+// table writes rows under header, or in JSON an array with an object per row keyed by the lower case header.
+func (p *printer) table(header []string, rows [][]string) error {
+	if p.json {
+		objects := make([]map[string]string, 0, len(rows))
+		for _, row := range rows {
+			object := map[string]string{}
+			for i, cell := range row {
+				object[strings.ToLower(header[i])] = cell
+			}
+			objects = append(objects, object)
+		}
+		return p.writeJSON(objects)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// document writes a document as a two column table of its fields, or as an Extended JSON object.
+func (p *printer) document(doc bson.Raw) error {
+	if p.json {
+		return p.writeExtJSON(doc)
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(elements))
+	for _, element := range elements {
+		rows = append(rows, []string{element.Key(), formatValue(element.Value())})
+	}
+	return p.table([]string{"FIELD", "VALUE"}, rows)
+}
+
+// documents writes documents as a table with a column per top level field, or as an Extended JSON array.
+func (p *printer) documents(docs []bson.Raw) error {
+	if p.json {
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, doc := range docs {
+			data, err := bson.MarshalExtJSON(doc, false, false)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(data)
+		}
+		buf.WriteByte(']')
+		return p.writeIndented(buf.Bytes())
+	}
+
+	// the columns are the fields in the order they are first seen
+	var header []string
+	columns := map[string]int{}
+	for _, doc := range docs {
+		elements, err := doc.Elements()
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			if _, ok := columns[element.Key()]; !ok {
+				columns[element.Key()] = len(header)
+				header = append(header, element.Key())
+			}
+		}
+	}
+	rows := make([][]string, 0, len(docs))
+	for _, doc := range docs {
+		row := make([]string, len(header))
+		elements, _ := doc.Elements()
+		for _, element := range elements {
+			row[columns[element.Key()]] = formatValue(element.Value())
+		}
+		rows = append(rows, row)
+	}
+	if len(header) == 0 {
+		header = []string{"_id"}
+	}
+	return p.table(header, rows)
+}
+
+// value writes v as JSON, or with its fields as a table when it is a document.
+func (p *printer) value(v interface{}) error {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.document(raw)
+}
+
+func (p *printer) writeExtJSON(doc bson.Raw) error {
+	data, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return err
+	}
+	return p.writeIndented(data)
+}
+
+func (p *printer) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.writeIndented(data)
+}
+
+func (p *printer) writeIndented(data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+// documentRaw returns the BSON of a document with _id first and the other fields sorted by name, so the
+// fields of a Document are always printed in the same order.
+func documentRaw(doc *db.Document) (bson.Raw, error) {
+	names := make([]string, 0, len(doc.Fields))
+	for name := range doc.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := make(bson.D, 0, len(names)+1)
+	if !doc.ID.IsZero() {
+		sorted = append(sorted, bson.E{Key: "_id", Value: doc.ID})
+	}
+	for _, name := range names {
+		sorted = append(sorted, bson.E{Key: name, Value: doc.Fields[name]})
+	}
+	return bson.Marshal(sorted)
+}
+
+// formatValue returns a table cell for a BSON value: strings, numbers and booleans as they are, ObjectIDs in
+// hex, dates in RFC 3339 and other values as relaxed Extended JSON.
+func formatValue(value bson.RawValue) string {
+	switch value.Type {
+	case bsontype.String:
+		return value.StringValue()
+	case bsontype.ObjectID:
+		return value.ObjectID().Hex()
+	case bsontype.DateTime:
+		return value.Time().UTC().Format(time.RFC3339Nano)
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(value.Int64(), 10)
+	case bsontype.Double:
+		return strconv.FormatFloat(value.Double(), 'g', -1, 64)
+	case bsontype.Boolean:
+		return strconv.FormatBool(value.Boolean())
+	case bsontype.Null, bsontype.Undefined:
+		return ""
+	}
+	// the value is written in a document because Extended JSON is only written for documents
+	data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+	if err != nil {
+		return value.String()
+	}
+	return string(data[len(`{"v":`) : len(data)-1])
+}
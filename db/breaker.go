@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every operation through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects every operation with errors.ErrCircuitOpen until the open timeout has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of trial operations through to find out whether the server is back.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreakerSettings configures a CircuitBreaker. Zero values are replaced by the defaults noted on each field.
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before trial operations are let through. Defaults to 30s.
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the number of concurrent trial operations allowed while half-open. Defaults to 1.
+	HalfOpenMaxRequests int
+	// SuccessThreshold is the number of consecutive successful trial operations that closes the circuit. Defaults to 1.
+	SuccessThreshold int
+	// IsFailure decides whether an operation error counts against the circuit. Errors that show the server
+	// answered, such as a missing document or a duplicate key, should not. Defaults to IsCircuitFailure.
+	IsFailure func(err error) bool
+	// OnStateChange is called after every state change, for example to feed alerting. It must not block.
+	OnStateChange func(from, to CircuitState)
+}
+
+// CircuitBreaker stops sending operations to MongoDB after repeated failures, so callers fail fast instead
+// of waiting for the full timeout while the server is unreachable. It is safe for concurrent use.
+type CircuitBreaker struct {
+	settings CircuitBreakerSettings
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	trials    int
+	now       func() time.Time
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker with the given settings.
+func NewCircuitBreaker(settings CircuitBreakerSettings) *CircuitBreaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = 5
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = 30 * time.Second
+	}
+	if settings.HalfOpenMaxRequests <= 0 {
+		settings.HalfOpenMaxRequests = 1
+	}
+	if settings.SuccessThreshold <= 0 {
+		settings.SuccessThreshold = 1
+	}
+	if settings.IsFailure == nil {
+		settings.IsFailure = IsCircuitFailure
+	}
+	return &CircuitBreaker{settings: settings, now: time.Now}
+}
+
+// WithCircuitBreaker is a functional option that guards every operation with a CircuitBreaker.
+// While the circuit is open, operations fail immediately with a ChuxDataStoreError wrapping
+// errors.ErrCircuitOpen. State changes are logged as warnings and passed to settings.OnStateChange.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithCircuitBreaker(CircuitBreakerSettings{
+//			FailureThreshold: 5,
+//			OpenTimeout:      10 * time.Second,
+//			OnStateChange: func(from, to CircuitState) {
+//				alerts.Notify("datastore circuit " + to.String())
+//			},
+//		}),
+//	)
+func WithCircuitBreaker(settings CircuitBreakerSettings) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		onStateChange := settings.OnStateChange
+		settings.OnStateChange = func(from, to CircuitState) {
+			s.Logger.WarningContext(s.context(), "MongoDB circuit breaker changed state", "from", from.String(), "to", to.String())
+			if onStateChange != nil {
+				onStateChange(from, to)
+			}
+		}
+		s.breaker = NewCircuitBreaker(settings)
+	}
+}
+
+// guard runs fn through the circuit breaker, if one is configured.
+func (m *MongoDB) guard(ctx context.Context, op, collection string, fn func(ctx context.Context) error) error {
+	if m.breaker == nil {
+		return fn(ctx)
+	}
+	done, err := m.breaker.allow()
+	if err != nil {
+		msg := fmt.Sprintf("MongoDB operation %s on %s rejected, the circuit breaker is open", op, collection)
+		m.Logger.WarningContext(ctx, msg, "operation", op, "collection", collection)
+		return errors.NewChuxDataStoreError(msg, 1100, err)
+	}
+	err = fn(ctx)
+	done(err)
+	return err
+}
+
+// CircuitBreaker returns the circuit breaker configured with WithCircuitBreaker, or nil.
+func (m *MongoDB) CircuitBreaker() *CircuitBreaker {
+	return m.breaker
+}
+
+// IsCircuitFailure reports whether err shows that MongoDB is unavailable: a retryable error or a timeout.
+// Operations canceled by the caller do not count.
+func IsCircuitFailure(err error) bool {
+	if err == nil || stderrors.Is(err, context.Canceled) {
+		return false
+	}
+	return IsRetryable(err) || mongo.IsTimeout(err)
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	changes := b.advance()
+	state := b.state
+	b.mu.Unlock()
+	b.notify(changes)
+	return state
+}
+
+// transition is a state change that has to be reported to OnStateChange.
+type transition struct {
+	from, to CircuitState
+}
+
+// advance moves an open circuit to half-open once the open timeout has passed. It must be called with b.mu held.
+func (b *CircuitBreaker) advance() []transition {
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		return []transition{b.setState(CircuitHalfOpen)}
+	}
+	return nil
+}
+
+// allow reports whether an operation may run. When it may, the returned function must be called with the
+// operation's error; otherwise errors.ErrCircuitOpen is returned.
+func (b *CircuitBreaker) allow() (func(error), error) {
+	b.mu.Lock()
+	changes := b.advance()
+	state := b.state
+	allowed := true
+	switch state {
+	case CircuitOpen:
+		allowed = false
+	case CircuitHalfOpen:
+		if b.trials >= b.settings.HalfOpenMaxRequests {
+			allowed = false
+		} else {
+			b.trials++
+		}
+	}
+	b.mu.Unlock()
+	b.notify(changes)
+
+	if !allowed {
+		return nil, errors.ErrCircuitOpen
+	}
+	return func(err error) { b.record(state, err) }, nil
+}
+
+// record updates the circuit with the result of an operation that was allowed in the given state.
+// Results of operations that started before the last state change are ignored.
+func (b *CircuitBreaker) record(allowedIn CircuitState, err error) {
+	b.mu.Lock()
+	var changes []transition
+	if allowedIn == b.state {
+		failed := b.settings.IsFailure(err)
+		switch b.state {
+		case CircuitClosed:
+			if !failed {
+				b.failures = 0
+				break
+			}
+			b.failures++
+			if b.failures >= b.settings.FailureThreshold {
+				changes = append(changes, b.setState(CircuitOpen))
+			}
+		case CircuitHalfOpen:
+			b.trials--
+			if failed {
+				changes = append(changes, b.setState(CircuitOpen))
+				break
+			}
+			b.successes++
+			if b.successes >= b.settings.SuccessThreshold {
+				changes = append(changes, b.setState(CircuitClosed))
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.notify(changes)
+}
+
+// setState changes the state and resets the counters. It must be called with b.mu held.
+func (b *CircuitBreaker) setState(state CircuitState) transition {
+	change := transition{from: b.state, to: state}
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.trials = 0
+	if state == CircuitOpen {
+		b.openedAt = b.now()
+	}
+	return change
+}
+
+// notify reports state changes to OnStateChange. It is called without b.mu held so that the callback
+// can read the breaker's state.
+func (b *CircuitBreaker) notify(changes []transition) {
+	if b.settings.OnStateChange == nil {
+		return
+	}
+	for _, change := range changes {
+		b.settings.OnStateChange(change.from, change.to)
+	}
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errUnavailable = mongo.CommandError{Code: 6, Name: "HostUnreachable", Labels: []string{"NetworkError"}}
+
+// newTestBreaker returns a CircuitBreaker on a clock moved by the returned function, recording its state changes.
+func newTestBreaker(settings CircuitBreakerSettings) (*CircuitBreaker, func(time.Duration), *[]CircuitState) {
+	var changes []CircuitState
+	settings.OnStateChange = func(from, to CircuitState) { changes = append(changes, to) }
+	b := NewCircuitBreaker(settings)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }, &changes
+}
+
+// run lets an operation with the result err through b, or returns errors.ErrCircuitOpen.
+func run(b *CircuitBreaker, err error) error {
+	done, rejected := b.allow()
+	if rejected != nil {
+		return rejected
+	}
+	done(err)
+	return nil
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	b, sleep, changes := newTestBreaker(CircuitBreakerSettings{FailureThreshold: 3, OpenTimeout: 10 * time.Second, SuccessThreshold: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := run(b, errUnavailable); err != nil {
+			t.Fatalf("operation %d rejected while closed: %v", i+1, err)
+		}
+	}
+	if err := run(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(b, mongo.ErrNoDocuments); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state = %v after a success reset the failures, want closed", b.State())
+	}
+
+	for i := 0; i < 3; i++ {
+		_ = run(b, errUnavailable)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state = %v after 3 consecutive failures, want open", b.State())
+	}
+	if err := run(b, nil); !stderrors.Is(err, errors.ErrCircuitOpen) {
+		t.Errorf("operation while open = %v, want ErrCircuitOpen", err)
+	}
+
+	sleep(9 * time.Second)
+	if b.State() != CircuitOpen {
+		t.Fatalf("state = %v before the open timeout, want open", b.State())
+	}
+	sleep(time.Second)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state = %v after the open timeout, want half-open", b.State())
+	}
+
+	if err := run(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state = %v after 1 of 2 successful trials, want half-open", b.State())
+	}
+	if err := run(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state = %v after 2 successful trials, want closed", b.State())
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(*changes) != len(want) {
+		t.Fatalf("state changes = %v, want %v", *changes, want)
+	}
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Errorf("state changes = %v, want %v", *changes, want)
+		}
+	}
+}
+
+func TestCircuitBreakerFailedTrialReopens(t *testing.T) {
+	b, sleep, _ := newTestBreaker(CircuitBreakerSettings{FailureThreshold: 1, OpenTimeout: 10 * time.Second})
+
+	_ = run(b, errUnavailable)
+	sleep(10 * time.Second)
+	if err := run(b, errUnavailable); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state = %v after a failed trial, want open", b.State())
+	}
+
+	sleep(5 * time.Second)
+	if err := run(b, nil); !stderrors.Is(err, errors.ErrCircuitOpen) {
+		t.Errorf("operation 5s after reopening = %v, want ErrCircuitOpen until a new open timeout has passed", err)
+	}
+	sleep(5 * time.Second)
+	if b.State() != CircuitHalfOpen {
+		t.Errorf("state = %v a full open timeout after reopening, want half-open", b.State())
+	}
+}
+
+func TestCircuitBreakerTrialLimit(t *testing.T) {
+	b, sleep, _ := newTestBreaker(CircuitBreakerSettings{FailureThreshold: 1, OpenTimeout: time.Second, HalfOpenMaxRequests: 2})
+
+	_ = run(b, errUnavailable)
+	sleep(time.Second)
+
+	first, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.allow(); !stderrors.Is(err, errors.ErrCircuitOpen) {
+		t.Errorf("third concurrent trial = %v, want ErrCircuitOpen", err)
+	}
+
+	first(nil)
+	if b.State() != CircuitClosed {
+		t.Fatalf("state = %v after a successful trial, want closed", b.State())
+	}
+	// the second trial started before the circuit closed, its failure does not count
+	second(errUnavailable)
+	if b.State() != CircuitClosed {
+		t.Errorf("state = %v after a stale trial failed, want closed", b.State())
+	}
+}
+
+func TestGuardRejectsWhileOpen(t *testing.T) {
+	m := New(
+		WithCircuitBreaker(CircuitBreakerSettings{FailureThreshold: 1, OpenTimeout: time.Minute}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	ctx := context.Background()
+	fail := func(ctx context.Context) error { return errUnavailable }
+	if err := m.guard(ctx, opGetByID, "people", fail); !IsRetryable(err) {
+		t.Fatalf("guard() = %v, want the network error of the operation", err)
+	}
+
+	called := false
+	err := m.guard(ctx, opGetByID, "people", func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if called {
+		t.Error("guard() ran the operation while the circuit is open")
+	}
+	if !stderrors.Is(err, errors.ErrCircuitOpen) {
+		t.Errorf("guard() = %v, want ErrCircuitOpen", err)
+	}
+	if class := errorClass(err); class != "circuit_open" {
+		t.Errorf("errorClass() = %q, want circuit_open", class)
+	}
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/cache"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IMongoDocumentCache can be implemented by a document to set how long it is cached, overriding the
+// default of WithCache. A negative duration disables caching for the document type and zero uses the default.
+// Example:
+//
+//	func (c *Country) CacheTTL() time.Duration {
+//		return time.Hour
+//	}
+type IMongoDocumentCache interface {
+	CacheTTL() time.Duration
+}
+
+// documentCache is the cache set by WithCache.
+type documentCache struct {
+	cache cache.ICache
+	ttl   time.Duration
+}
+
+// WithCache is a functional option that reads GetByID and Query through c. Results are cached for ttl, or
+// for the CacheTTL of documents that implement IMongoDocumentCache. With a ttl of zero only those documents
+// are cached. Upsert, Update, UpdateFields and Delete evict the document they wrote and every cached Query
+// of its collection. The cache holds documents as they are stored, so encrypted fields stay encrypted.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithCache(cache.NewLRU(10000), 5*time.Minute),
+//	)
+func WithCache(c cache.ICache, ttl time.Duration) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.cache = &documentCache{cache: c, ttl: ttl}
+	}
+}
+
+// cacheTTL returns how long doc is cached, or false when it is not cached.
+func (m *MongoDB) cacheTTL(doc IMongoDocument) (time.Duration, bool) {
+	if m.cache == nil {
+		return 0, false
+	}
+	ttl := m.cache.ttl
+	if d, ok := doc.(IMongoDocumentCache); ok && d.CacheTTL() != 0 {
+		ttl = d.CacheTTL()
+	}
+	return ttl, ttl > 0
+}
+
+// cacheNamespace returns the prefix of the cache keys of a collection.
+func cacheNamespace(collection IMongoCollection) string {
+	return collection.Database().Name() + "." + collection.Name() + "|"
+}
+
+// idCacheKey returns the cache key of a GetByID. The tenant is part of the key so that a document cached
+// for one tenant is never returned to another.
+func (m *MongoDB) idCacheKey(ctx context.Context, collection IMongoCollection, id primitive.ObjectID) string {
+	tenant, _ := m.tenant(ctx)
+	return cacheNamespace(collection) + "id|" + id.Hex() + "|" + tenant
+}
+
+// queryCacheKey returns the cache key of a Query, a hash of the filter with its keys sorted.
+func queryCacheKey(collection IMongoCollection, filter bson.M) (string, error) {
+	data, err := bson.Marshal(canonicalFilter(filter))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return cacheNamespace(collection) + "query|" + hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalFilter returns v with every map replaced by a bson.D sorted by key, so equal filters marshal the same.
+func canonicalFilter(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		return canonicalMap(v)
+	case map[string]interface{}:
+		return canonicalMap(v)
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: canonicalFilter(e.Value)}
+		}
+		return d
+	case bson.A:
+		return canonicalSlice(v)
+	case []interface{}:
+		return canonicalSlice(v)
+	}
+	return v
+}
+
+func canonicalMap(m map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	d := make(bson.D, len(keys))
+	for i, key := range keys {
+		d[i] = bson.E{Key: key, Value: canonicalFilter(m[key])}
+	}
+	return d
+}
+
+func canonicalSlice(s []interface{}) bson.A {
+	a := make(bson.A, len(s))
+	for i, v := range s {
+		a[i] = canonicalFilter(v)
+	}
+	return a
+}
+
+// cachedQuery is how the documents found by a Query are stored in the cache.
+type cachedQuery struct {
+	Docs []bson.Raw `bson:"docs"`
+}
+
+// cacheGet looks key up and records a hit or a miss.
+func (m *MongoDB) cacheGet(ctx context.Context, doc IMongoDocument, key string) ([]byte, bool) {
+	value, ok := m.cache.cache.Get(ctx, key)
+	m.metrics.observeCache(m.collectionName(doc), ok)
+	return value, ok
+}
+
+// cacheSet stores value under key for the cache duration of doc.
+func (m *MongoDB) cacheSet(ctx context.Context, doc IMongoDocument, key string, value []byte) {
+	if ttl, ok := m.cacheTTL(doc); ok {
+		m.cache.cache.Set(ctx, key, value, ttl)
+	}
+}
+
+// invalidate evicts the documents with the given ids, for every tenant, and every cached Query of the collection.
+func (m *MongoDB) invalidate(ctx context.Context, collection IMongoCollection, ids ...primitive.ObjectID) {
+	if m.cache == nil {
+		return
+	}
+	namespace := cacheNamespace(collection)
+	for _, id := range ids {
+		if id != primitive.NilObjectID {
+			m.cache.cache.DeletePrefix(ctx, namespace+"id|"+id.Hex()+"|")
+		}
+	}
+	m.cache.cache.DeletePrefix(ctx, namespace+"query|")
+}
+
+// invalidateCollection evicts every cached document and query of the collection.
+func (m *MongoDB) invalidateCollection(ctx context.Context, collection IMongoCollection) {
+	if m.cache != nil {
+		m.cache.cache.DeletePrefix(ctx, cacheNamespace(collection))
+	}
+}
+
+// queryFromCache returns the cached documents of a Query, or nil on a miss. cached reports whether the result
+// should be stored under key after it is read from MongoDB. The key also identifies the query for
+// WithRequestCoalescing; it is empty when the filter cannot be hashed.
+func (m *MongoDB) queryFromCache(ctx context.Context, doc IMongoDocument, collection IMongoCollection, filter bson.M) (raws []bson.Raw, cached bool, key string, err error) {
+	_, cached = m.cacheTTL(doc)
+	if !cached && m.flights == nil {
+		return nil, false, "", nil
+	}
+	key, err = queryCacheKey(collection, filter)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if !cached {
+		return nil, false, key, nil
+	}
+	value, ok := m.cacheGet(ctx, doc, key)
+	if !ok {
+		return nil, true, key, nil
+	}
+	var result cachedQuery
+	if err := bson.Unmarshal(value, &result); err != nil {
+		return nil, true, key, err
+	}
+	if result.Docs == nil {
+		result.Docs = []bson.Raw{}
+	}
+	return result.Docs, true, key, nil
+}
+
+// existingID returns the _id of a document found by Upsert, or the nil ObjectID.
+func existingID(found bson.M) primitive.ObjectID {
+	id, _ := found["_id"].(primitive.ObjectID)
+	return id
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"bytes"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ITrackedDocument is implemented by documents that opt in to change tracking, usually by embedding a
+// ChangeTracker. After GetByID, Query or GetAll load a tracked document, the library keeps a snapshot of it.
+// Update then writes only the fields that changed since the snapshot.
+type ITrackedDocument interface {
+	Snapshot() bson.Raw
+	SetSnapshot(snapshot bson.Raw)
+}
+
+// ChangeTracker implements ITrackedDocument. Embed it in a document to enable change tracking. The bson:"-"
+// tag is required, otherwise the tracker is stored as an empty sub document.
+// Example:
+//
+//	type Customer struct {
+//		db.ChangeTracker `bson:"-" json:"-"`
+//		ID    primitive.ObjectID `bson:"_id,omitempty"`
+//		Name  string             `bson:"name"`
+//		Email string             `bson:"email"`
+//	}
+type ChangeTracker struct {
+	snapshot bson.Raw
+}
+
+// Snapshot returns the document as it was last loaded or saved, or nil.
+func (t *ChangeTracker) Snapshot() bson.Raw {
+	return t.snapshot
+}
+
+// SetSnapshot replaces the snapshot. A nil snapshot makes the next Update write the whole document.
+func (t *ChangeTracker) SetSnapshot(snapshot bson.Raw) {
+	t.snapshot = snapshot
+}
+
+// ChangeSet is the field level difference between a tracked document and its snapshot.
+type ChangeSet struct {
+	Database   string
+	Collection string
+	ID         primitive.ObjectID
+	// Set holds the changed and added fields with their new values. Nested documents are compared
+	// field by field, so a change inside one is named with a dotted path such as "address.city".
+	Set bson.D
+	// Unset holds the fields that were removed.
+	Unset []string
+}
+
+// IsEmpty reports whether nothing changed.
+func (c ChangeSet) IsEmpty() bool {
+	return len(c.Set) == 0 && len(c.Unset) == 0
+}
+
+// Fields returns the paths of every changed field.
+func (c ChangeSet) Fields() []string {
+	fields := make([]string, 0, len(c.Set)+len(c.Unset))
+	for _, e := range c.Set {
+		fields = append(fields, e.Key)
+	}
+	return append(fields, c.Unset...)
+}
+
+// Update returns the change set as an UpdateBuilder with $set and $unset.
+func (c ChangeSet) Update() *UpdateBuilder {
+	update := NewUpdate()
+	for _, e := range c.Set {
+		update.Set(e.Key, e.Value)
+	}
+	update.Unset(c.Unset...)
+	return update
+}
+
+// ChangeHook is called with the ChangeSet of every Update of a tracked document that changed something.
+type ChangeHook func(ctx context.Context, changes ChangeSet)
+
+// IChangeSink can be implemented by an ICommandSink passed to WithCommandMonitoring to add the change sets
+// of tracked documents to the audit trail.
+type IChangeSink interface {
+	RecordChange(ctx context.Context, changes ChangeSet)
+}
+
+// WithChangeHook is a functional option that adds hooks that receive the ChangeSet of every Update of a
+// tracked document. The hooks run after the update succeeded.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithChangeHook(func(ctx context.Context, changes ChangeSet) {
+//			log.Printf("%s %s changed %v", changes.Collection, changes.ID.Hex(), changes.Fields())
+//		}),
+//	)
+func WithChangeHook(hooks ...ChangeHook) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.changeHooks = append(s.changeHooks, hooks...)
+	}
+}
+
+// Changes returns the difference between a tracked document and its snapshot. ok is false when doc is not
+// tracked or has no snapshot yet, in which case Update writes the whole document.
+func (m *MongoDB) Changes(doc IMongoDocument) (changes ChangeSet, ok bool, err error) {
+	tracked, isTracked := doc.(ITrackedDocument)
+	if !isTracked || tracked.Snapshot() == nil {
+		return ChangeSet{}, false, nil
+	}
+	current, err := bson.Marshal(doc)
+	if err != nil {
+		return ChangeSet{}, false, err
+	}
+	changes = ChangeSet{
+		Database:   m.databaseName(doc),
+		Collection: m.collectionName(doc),
+		ID:         doc.GetID(),
+	}
+	diffDocuments("", tracked.Snapshot(), current, &changes)
+	return changes, true, nil
+}
+
+// snapshot records the current state of a tracked document. Documents that are not tracked are ignored.
+func (m *MongoDB) snapshot(ctx context.Context, doc IMongoDocument) {
+	tracked, ok := doc.(ITrackedDocument)
+	if !ok {
+		return
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		m.Logger.WarningContext(ctx, "MongoDB.snapshot() Could not snapshot the document, the next Update writes every field", "error", err)
+		tracked.SetSnapshot(nil)
+		return
+	}
+	tracked.SetSnapshot(raw)
+}
+
+// publishChanges passes a change set to the change hooks and to the command sinks that implement IChangeSink.
+func (m *MongoDB) publishChanges(ctx context.Context, changes ChangeSet) {
+	for _, hook := range m.changeHooks {
+		hook(ctx, changes)
+	}
+	if m.commandMonitor == nil {
+		return
+	}
+	for _, sink := range m.commandMonitor.sinks {
+		if changeSink, ok := sink.(IChangeSink); ok {
+			changeSink.RecordChange(ctx, changes)
+		}
+	}
+}
+
+// diffDocuments adds the differences between the before and after documents to changes. Sub documents
+// present on both sides are compared field by field; any other value, arrays included, is compared as a whole.
+func diffDocuments(prefix string, before, after bson.Raw, changes *ChangeSet) {
+	afterElements, _ := after.Elements()
+	seen := make(map[string]bool, len(afterElements))
+	for _, element := range afterElements {
+		key := element.Key()
+		seen[key] = true
+		if prefix == "" && key == "_id" {
+			continue
+		}
+		path := key
+		if len(prefix) > 0 {
+			path = prefix + "." + key
+		}
+		value := element.Value()
+		old, err := before.LookupErr(key)
+		if err != nil {
+			changes.Set = append(changes.Set, bson.E{Key: path, Value: value})
+			continue
+		}
+		oldDoc, oldIsDoc := old.DocumentOK()
+		newDoc, newIsDoc := value.DocumentOK()
+		if oldIsDoc && newIsDoc {
+			diffDocuments(path, oldDoc, newDoc, changes)
+			continue
+		}
+		if old.Type != value.Type || !bytes.Equal(old.Value, value.Value) {
+			changes.Set = append(changes.Set, bson.E{Key: path, Value: value})
+		}
+	}
+
+	beforeElements, _ := before.Elements()
+	for _, element := range beforeElements {
+		if key := element.Key(); !seen[key] {
+			if len(prefix) > 0 {
+				key = prefix + "." + key
+			}
+			changes.Unset = append(changes.Unset, key)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name      string
+		before    bson.D
+		after     bson.D
+		wantSet   bson.D
+		wantUnset []string
+	}{
+		{
+			name:   "untouched document",
+			before: bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Jane"}, {Key: "tags", Value: bson.A{"a", "b"}}},
+			after:  bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Jane"}, {Key: "tags", Value: bson.A{"a", "b"}}},
+		},
+		{
+			name:    "changed and added fields",
+			before:  bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Jane"}},
+			after:   bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Janet"}, {Key: "age", Value: 35}},
+			wantSet: bson.D{{Key: "name", Value: "Janet"}, {Key: "age", Value: 35}},
+		},
+		{
+			name:    "the _id is not part of the changes",
+			before:  bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Jane"}},
+			after:   bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: "Jane"}},
+			wantSet: nil,
+		},
+		{
+			name:      "removed field",
+			before:    bson.D{{Key: "name", Value: "Jane"}, {Key: "email", Value: "jane@example.com"}},
+			after:     bson.D{{Key: "name", Value: "Jane"}},
+			wantUnset: []string{"email"},
+		},
+		{
+			name:    "same value with another type",
+			before:  bson.D{{Key: "age", Value: int32(34)}},
+			after:   bson.D{{Key: "age", Value: int64(34)}},
+			wantSet: bson.D{{Key: "age", Value: int64(34)}},
+		},
+		{
+			name: "subdocument compared field by field",
+			before: bson.D{{Key: "address", Value: bson.D{
+				{Key: "city", Value: "Lisbon"}, {Key: "zip", Value: "1000"}, {Key: "geo", Value: bson.D{{Key: "lat", Value: 38.7}}},
+			}}},
+			after: bson.D{{Key: "address", Value: bson.D{
+				{Key: "city", Value: "Porto"}, {Key: "street", Value: "Rua A"}, {Key: "geo", Value: bson.D{{Key: "lat", Value: 41.1}}},
+			}}},
+			wantSet:   bson.D{{Key: "address.city", Value: "Porto"}, {Key: "address.street", Value: "Rua A"}, {Key: "address.geo.lat", Value: 41.1}},
+			wantUnset: []string{"address.zip"},
+		},
+		{
+			name:    "subdocument replaced by another type",
+			before:  bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+			after:   bson.D{{Key: "address", Value: "Lisbon"}},
+			wantSet: bson.D{{Key: "address", Value: "Lisbon"}},
+		},
+		{
+			name:    "array compared whole",
+			before:  bson.D{{Key: "tags", Value: bson.A{"a", "b", "c"}}},
+			after:   bson.D{{Key: "tags", Value: bson.A{"a", "x", "c"}}},
+			wantSet: bson.D{{Key: "tags", Value: bson.A{"a", "x", "c"}}},
+		},
+		{
+			name:    "array of subdocuments compared whole",
+			before:  bson.D{{Key: "contacts", Value: bson.A{bson.D{{Key: "email", Value: "a@x"}}}}},
+			after:   bson.D{{Key: "contacts", Value: bson.A{bson.D{{Key: "email", Value: "b@x"}}}}},
+			wantSet: bson.D{{Key: "contacts", Value: bson.A{bson.D{{Key: "email", Value: "b@x"}}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes ChangeSet
+			diffDocuments("", marshal(t, tt.before), marshal(t, tt.after), &changes)
+
+			if len(changes.Set) != len(tt.wantSet) {
+				t.Fatalf("Set = %v, want %v", changes.Set, tt.wantSet)
+			}
+			for i, want := range tt.wantSet {
+				got := changes.Set[i]
+				typ, value, err := bson.MarshalValue(want.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw := got.Value.(bson.RawValue)
+				if got.Key != want.Key || raw.Type != typ || !bytes.Equal(raw.Value, value) {
+					t.Errorf("Set[%d] = %s: %v, want %s: %v", i, got.Key, got.Value, want.Key, want.Value)
+				}
+			}
+			if !reflect.DeepEqual(changes.Unset, tt.wantUnset) {
+				t.Errorf("Unset = %v, want %v", changes.Unset, tt.wantUnset)
+			}
+		})
+	}
+}
+
+func TestChangeSetUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes ChangeSet
+		want    bson.D
+		wantErr bool
+	}{
+		{
+			name:    "set and unset",
+			changes: ChangeSet{Set: bson.D{{Key: "name", Value: "Janet"}, {Key: "address.city", Value: "Porto"}}, Unset: []string{"email"}},
+			want: bson.D{
+				{Key: "$set", Value: bson.D{{Key: "name", Value: "Janet"}, {Key: "address.city", Value: "Porto"}}},
+				{Key: "$unset", Value: bson.D{{Key: "email", Value: ""}}},
+			},
+		},
+		{
+			name:    "only unset",
+			changes: ChangeSet{Unset: []string{"address.zip"}},
+			want:    bson.D{{Key: "$unset", Value: bson.D{{Key: "address.zip", Value: ""}}}},
+		},
+		{
+			name:    "no changes",
+			changes: ChangeSet{},
+			want:    bson.D{},
+			wantErr: true,
+		},
+		{
+			name:    "a field and its parent",
+			changes: ChangeSet{Set: bson.D{{Key: "attributes.color", Value: "red"}, {Key: "attributes.color.shade", Value: "dark"}}},
+			want:    bson.D{{Key: "$set", Value: bson.D{{Key: "attributes.color", Value: "red"}}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := tt.changes.Update()
+			if err := update.Err(); (err != nil) != tt.wantErr {
+				t.Errorf("Err() = %v, want an error: %v", err, tt.wantErr)
+			}
+			if got := update.Document(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Document() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// marshal returns doc as a bson.Raw.
+func marshal(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	stderrors "errors"
+	"sync"
+)
+
+// flightGroup runs one call per key at a time and shares its result with the callers that ask for the
+// same key while it runs.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress. done is closed when value and err are set.
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// WithRequestCoalescing is a functional option that merges concurrent identical GetByID and Query calls:
+// while one call reads a document or a query result from MongoDB, other calls for the same collection and
+// filter wait for it instead of sending their own request. Every caller decodes its own copy of the result,
+// so callers never share or see each other's changes to a document.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithRequestCoalescing(),
+//	)
+func WithRequestCoalescing() func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.flights = &flightGroup{flights: map[string]*flight{}}
+	}
+}
+
+// coalesce runs fn, or waits for the call already running fn for key and returns its result. A caller whose
+// context is still live does not inherit the cancellation or deadline of the call it waited for; it runs
+// fn itself instead. Without WithRequestCoalescing, or with an empty key, fn is always run.
+func (m *MongoDB) coalesce(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g := m.flights
+	if g == nil || len(key) == 0 {
+		return fn(ctx)
+	}
+
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if isContextError(f.err) && ctx.Err() == nil {
+			return fn(ctx)
+		}
+		m.Logger.DebugContext(ctx, "MongoDB.coalesce() Shared the result of a concurrent identical call", "key", key)
+		return f.value, f.err
+	}
+	// the error is only seen by the waiting callers if fn panics
+	f := &flight{done: make(chan struct{}), err: errCoalescedCallFailed}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fn(ctx)
+	return f.value, f.err
+}
+
+// errCoalescedCallFailed is returned to the callers waiting for a call that panicked.
+var errCoalescedCallFailed = stderrors.New("the coalesced call did not complete")
+
+// isContextError reports whether err comes from a cancelled or expired context.
+func isContextError(err error) bool {
+	return stderrors.Is(err, context.Canceled) || stderrors.Is(err, context.DeadlineExceeded)
+}
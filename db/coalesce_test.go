@@ -0,0 +1,148 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/mongofake"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// blockingClient is a client whose FindOne calls are counted and wait until release is closed or their
+// context is done.
+type blockingClient struct {
+	db.IMongoClient
+	calls   int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingClient(client db.IMongoClient) *blockingClient {
+	return &blockingClient{IMongoClient: client, entered: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (c *blockingClient) Database(name string, opts ...*options.DatabaseOptions) db.IMongoDatabase {
+	return &blockingDatabase{IMongoDatabase: c.IMongoClient.Database(name, opts...), client: c}
+}
+
+type blockingDatabase struct {
+	db.IMongoDatabase
+	client *blockingClient
+}
+
+func (d *blockingDatabase) Collection(name string, opts ...*options.CollectionOptions) db.IMongoCollection {
+	return &blockingCollection{IMongoCollection: d.IMongoDatabase.Collection(name, opts...), client: d.client}
+}
+
+type blockingCollection struct {
+	db.IMongoCollection
+	client *blockingClient
+}
+
+func (c *blockingCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) db.IMongoSingleResult {
+	atomic.AddInt32(&c.client.calls, 1)
+	c.client.entered <- struct{}{}
+	select {
+	case <-c.client.release:
+	case <-ctx.Done():
+	}
+	return c.IMongoCollection.FindOne(ctx, filter, opts...)
+}
+
+// waitForWaiters gives the callers started after the first one time to join its call.
+func waitForWaiters() {
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestRequestCoalescingSharesOneRead(t *testing.T) {
+	fake := mongofake.NewClient()
+	jane := &Person{Name: "Jane", Age: 34}
+	if err := newFakeDB(db.WithClient(fake)).Upsert(jane); err != nil {
+		t.Fatal(err)
+	}
+	client := newBlockingClient(fake)
+	mongoDB := newFakeDB(db.WithClient(client), db.WithRequestCoalescing())
+
+	const callers = 5
+	people := make([]*Person, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	get := func(i int) {
+		defer wg.Done()
+		people[i] = &Person{}
+		_, errs[i] = mongoDB.GetByID(people[i], jane.ID.Hex())
+	}
+	wg.Add(callers)
+	go get(0)
+	<-client.entered
+	for i := 1; i < callers; i++ {
+		go get(i)
+	}
+	waitForWaiters()
+	close(client.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Errorf("%d identical GetByID calls sent %d FindOne, want 1", callers, calls)
+	}
+	for i := range people {
+		if errs[i] != nil {
+			t.Fatalf("GetByID() of caller %d = %v", i, errs[i])
+		}
+		if people[i].Name != "Jane" || people[i].Age != 34 {
+			t.Errorf("GetByID() of caller %d = %+v, want Jane", i, people[i])
+		}
+	}
+	people[0].Name = "Janet"
+	for i := 1; i < callers; i++ {
+		if people[i].Name != "Jane" {
+			t.Errorf("caller %d sees the change of caller 0: %+v", i, people[i])
+		}
+	}
+}
+
+func TestRequestCoalescingRerunsAfterTheFirstCallerIsCanceled(t *testing.T) {
+	fake := mongofake.NewClient()
+	jane := &Person{Name: "Jane", Age: 34}
+	if err := newFakeDB(db.WithClient(fake)).Upsert(jane); err != nil {
+		t.Fatal(err)
+	}
+	client := newBlockingClient(fake)
+	mongoDB := newFakeDB(db.WithClient(client), db.WithRequestCoalescing())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := mongoDB.WithContext(ctx).GetByID(&Person{}, jane.ID.Hex())
+		leaderErr <- err
+	}()
+	<-client.entered
+
+	waiter := &Person{}
+	waiterErr := make(chan error, 1)
+	go func() {
+		_, err := mongoDB.GetByID(waiter, jane.ID.Hex())
+		waiterErr <- err
+	}()
+	waitForWaiters()
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetByID() of the canceled caller = %v, want context.Canceled", err)
+	}
+	close(client.release)
+
+	if err := <-waiterErr; err != nil {
+		t.Fatalf("GetByID() of the waiting caller = %v, want the document", err)
+	}
+	if waiter.Name != "Jane" {
+		t.Errorf("GetByID() of the waiting caller = %+v, want Jane", waiter)
+	}
+	if calls := atomic.LoadInt32(&client.calls); calls != 2 {
+		t.Errorf("FindOne was called %d times, want 2: the canceled call and the rerun", calls)
+	}
+}
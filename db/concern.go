@@ -0,0 +1,160 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// IMongoDocumentConcerns can be implemented by an IMongoDocument to choose the read preference, read concern
+// and write concern of the operations on its collection. A method that returns nil keeps the value set with
+// WithReadPreference, WithReadConcern or WithWriteConcern. Options passed to WithCallOptions take precedence.
+// Example:
+//
+//	// reports are analytics reads that can be served by a secondary
+//	func (r *Report) GetReadPreference() *readpref.ReadPref {
+//		return readpref.SecondaryPreferred()
+//	}
+//	func (r *Report) GetReadConcern() *readconcern.ReadConcern {
+//		return nil
+//	}
+//	func (r *Report) GetWriteConcern() *writeconcern.WriteConcern {
+//		return nil
+//	}
+type IMongoDocumentConcerns interface {
+	GetReadPreference() *readpref.ReadPref
+	GetReadConcern() *readconcern.ReadConcern
+	GetWriteConcern() *writeconcern.WriteConcern
+}
+
+// concerns are the read preference, read concern and write concern of an operation. A nil value means the
+// level below decides: the call, then the document, then the MongoDB defaults, then the client.
+type concerns struct {
+	readPreference *readpref.ReadPref
+	readConcern    *readconcern.ReadConcern
+	writeConcern   *writeconcern.WriteConcern
+}
+
+// merge returns c with the values that are set in override replacing its own.
+func (c concerns) merge(override concerns) concerns {
+	if override.readPreference != nil {
+		c.readPreference = override.readPreference
+	}
+	if override.readConcern != nil {
+		c.readConcern = override.readConcern
+	}
+	if override.writeConcern != nil {
+		c.writeConcern = override.writeConcern
+	}
+	return c
+}
+
+// collectionOptions returns the collection options for the concerns that are set.
+func (c concerns) collectionOptions() *options.CollectionOptions {
+	o := options.Collection()
+	if c.readPreference != nil {
+		o.SetReadPreference(c.readPreference)
+	}
+	if c.readConcern != nil {
+		o.SetReadConcern(c.readConcern)
+	}
+	if c.writeConcern != nil {
+		o.SetWriteConcern(c.writeConcern)
+	}
+	return o
+}
+
+// WithReadPreference is a functional option that sets the default read preference of every operation.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithReadPreference(readpref.SecondaryPreferred()),
+//	)
+func WithReadPreference(rp *readpref.ReadPref) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.concerns.readPreference = rp
+	}
+}
+
+// WithReadConcern is a functional option that sets the default read concern of every operation.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithReadConcern(readconcern.Majority()),
+//	)
+func WithReadConcern(rc *readconcern.ReadConcern) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.concerns.readConcern = rc
+	}
+}
+
+// WithWriteConcern is a functional option that sets the default write concern of every operation.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithWriteConcern(writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))),
+//	)
+func WithWriteConcern(wc *writeconcern.WriteConcern) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.concerns.writeConcern = wc
+	}
+}
+
+// CallOption sets the read preference, read concern or write concern of the operations of a
+// MongoDB returned by WithCallOptions.
+type CallOption func(*concerns)
+
+// CallReadPreference sets the read preference of a call.
+func CallReadPreference(rp *readpref.ReadPref) CallOption {
+	return func(c *concerns) {
+		c.readPreference = rp
+	}
+}
+
+// CallReadConcern sets the read concern of a call.
+func CallReadConcern(rc *readconcern.ReadConcern) CallOption {
+	return func(c *concerns) {
+		c.readConcern = rc
+	}
+}
+
+// CallWriteConcern sets the write concern of a call.
+func CallWriteConcern(wc *writeconcern.WriteConcern) CallOption {
+	return func(c *concerns) {
+		c.writeConcern = wc
+	}
+}
+
+// WithCallOptions returns a shallow copy of the MongoDB whose operations use the given options. They take
+// precedence over the document's IMongoDocumentConcerns and the defaults set on New.
+// Example:
+//
+//	critical := writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))
+//	err := mongoDB.WithCallOptions(CallWriteConcern(critical)).Upsert(order)
+func (m *MongoDB) WithCallOptions(opts ...CallOption) *MongoDB {
+	c := *m
+	for _, o := range opts {
+		o(&c.callConcerns)
+	}
+	return &c
+}
+
+// concernsFor returns the concerns of an operation on doc: the call options, then the document, then the defaults.
+func (m *MongoDB) concernsFor(doc IMongoDocument) concerns {
+	resolved := m.concerns
+	if d, ok := doc.(IMongoDocumentConcerns); ok {
+		resolved = resolved.merge(concerns{
+			readPreference: d.GetReadPreference(),
+			readConcern:    d.GetReadConcern(),
+			writeConcern:   d.GetWriteConcern(),
+		})
+	}
+	return resolved.merge(m.callConcerns)
+}
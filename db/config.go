@@ -0,0 +1,609 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables read by FromEnv and FromConfig.
+const EnvPrefix = "CHUX_DATASTORE_"
+
+// Config is the configuration of a MongoDB that can be loaded from a file or from the environment.
+// Durations are written as Go durations such as "1m30s", or as a number of seconds.
+//
+// A YAML config file looks like this; JSON and TOML files use the same keys:
+//
+//	uri: mongodb://db1:27017,db2:27017/?replicaSet=rs0
+//	database: app
+//	collection: products
+//	timeout: 30s
+//	connectTimeout: 10s
+//	serverSelectionTimeout: 5s
+//	maxPoolSize: 100
+//	minPoolSize: 5
+//	maxConnIdleTime: 5m
+//	heartbeatInterval: 10s
+//	appName: catalog-api
+//	authMechanism: SCRAM-SHA-256
+//	authSource: admin
+//	compressors: [zstd, snappy]
+//	directConnection: false
+//	tls:
+//	  caFile: /etc/ssl/mongo-ca.pem
+//	  certificateKeyFile: /etc/ssl/mongo-client.pem
+//	readPreference: secondaryPreferred
+//	readConcern: majority
+//	writeConcern:
+//	  w: majority
+//	  journal: true
+//	  wtimeout: 5s
+type Config struct {
+	URI                    string
+	DatabaseName           string
+	CollectionName         string
+	Timeout                time.Duration
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	// MaxPoolSize and MinPoolSize are nil when they are not configured. A MaxPoolSize of 0 means no limit.
+	MaxPoolSize           *uint64
+	MinPoolSize           *uint64
+	MaxConnIdleTime       time.Duration
+	HeartbeatInterval     time.Duration
+	TLSCAFile             string
+	TLSCertificateKeyFile string
+	AppName               string
+	AuthMechanism         string
+	AuthSource            string
+	// Compressors is written as a list or as a comma separated string.
+	Compressors []string
+	// DirectConnection is nil when not configured.
+	DirectConnection *bool
+	// ReadPreference is a read preference mode such as "primary" or "secondaryPreferred".
+	ReadPreference string
+	// ReadConcern is a read concern level such as "local" or "majority".
+	ReadConcern  string
+	WriteConcern WriteConcernConfig
+
+	// sources maps the key of a value that was read from the environment to its environment variable,
+	// so validation errors name the setting the user actually wrote.
+	sources map[string]string
+}
+
+// WriteConcernConfig is the write concern part of a Config.
+type WriteConcernConfig struct {
+	// W is "majority", a number of members or the name of a tag set. It is empty when not configured.
+	W string
+	// Journal is nil when not configured.
+	Journal  *bool
+	WTimeout time.Duration
+}
+
+// ConfigError is returned, wrapped in a ChuxDataStoreError, when a configuration value is invalid.
+// Key is the key in the config file, such as "writeConcern.w", or the name of the environment variable.
+// Use errors.As to get it:
+//
+//	var configErr *db.ConfigError
+//	if errors.As(err, &configErr) {
+//		log.Fatalf("fix %s in the datastore configuration", configErr.Key)
+//	}
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+// Error returns the key followed by what is wrong with its value.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configField is a setting that can be configured, with its key in a config file and its environment variable.
+type configField struct {
+	key string
+	env string
+	set func(c *Config, value interface{}) error
+}
+
+var configFields = []configField{
+	{"uri", "URI", func(c *Config, v interface{}) (err error) { c.URI, err = configString(v); return }},
+	{"database", "DATABASE", func(c *Config, v interface{}) (err error) { c.DatabaseName, err = configString(v); return }},
+	{"collection", "COLLECTION", func(c *Config, v interface{}) (err error) { c.CollectionName, err = configString(v); return }},
+	{"timeout", "TIMEOUT", func(c *Config, v interface{}) (err error) { c.Timeout, err = configDuration(v); return }},
+	{"connectTimeout", "CONNECT_TIMEOUT", func(c *Config, v interface{}) (err error) {
+		c.ConnectTimeout, err = configDuration(v)
+		return
+	}},
+	{"serverSelectionTimeout", "SERVER_SELECTION_TIMEOUT", func(c *Config, v interface{}) (err error) {
+		c.ServerSelectionTimeout, err = configDuration(v)
+		return
+	}},
+	{"maxPoolSize", "MAX_POOL_SIZE", func(c *Config, v interface{}) (err error) { c.MaxPoolSize, err = configUint(v); return }},
+	{"minPoolSize", "MIN_POOL_SIZE", func(c *Config, v interface{}) (err error) { c.MinPoolSize, err = configUint(v); return }},
+	{"maxConnIdleTime", "MAX_CONN_IDLE_TIME", func(c *Config, v interface{}) (err error) {
+		c.MaxConnIdleTime, err = configDuration(v)
+		return
+	}},
+	{"heartbeatInterval", "HEARTBEAT_INTERVAL", func(c *Config, v interface{}) (err error) {
+		c.HeartbeatInterval, err = configDuration(v)
+		return
+	}},
+	{"appName", "APP_NAME", func(c *Config, v interface{}) (err error) { c.AppName, err = configString(v); return }},
+	{"authMechanism", "AUTH_MECHANISM", func(c *Config, v interface{}) (err error) { c.AuthMechanism, err = configString(v); return }},
+	{"authSource", "AUTH_SOURCE", func(c *Config, v interface{}) (err error) { c.AuthSource, err = configString(v); return }},
+	{"compressors", "COMPRESSORS", func(c *Config, v interface{}) (err error) { c.Compressors, err = configStrings(v); return }},
+	{"directConnection", "DIRECT_CONNECTION", func(c *Config, v interface{}) (err error) {
+		c.DirectConnection, err = configBool(v)
+		return
+	}},
+	{"tls.caFile", "TLS_CA_FILE", func(c *Config, v interface{}) (err error) { c.TLSCAFile, err = configString(v); return }},
+	{"tls.certificateKeyFile", "TLS_CERTIFICATE_KEY_FILE", func(c *Config, v interface{}) (err error) {
+		c.TLSCertificateKeyFile, err = configString(v)
+		return
+	}},
+	{"readPreference", "READ_PREFERENCE", func(c *Config, v interface{}) (err error) { c.ReadPreference, err = configString(v); return }},
+	{"readConcern", "READ_CONCERN", func(c *Config, v interface{}) (err error) { c.ReadConcern, err = configString(v); return }},
+	{"writeConcern.w", "WRITE_CONCERN_W", func(c *Config, v interface{}) (err error) { c.WriteConcern.W, err = configString(v); return }},
+	{"writeConcern.journal", "WRITE_CONCERN_JOURNAL", func(c *Config, v interface{}) (err error) {
+		c.WriteConcern.Journal, err = configBool(v)
+		return
+	}},
+	{"writeConcern.wtimeout", "WRITE_CONCERN_WTIMEOUT", func(c *Config, v interface{}) (err error) {
+		c.WriteConcern.WTimeout, err = configDuration(v)
+		return
+	}},
+}
+
+// FromEnv returns a functional option that configures a MongoDB from the CHUX_DATASTORE_* environment
+// variables, for example CHUX_DATASTORE_URI, CHUX_DATASTORE_MAX_POOL_SIZE or CHUX_DATASTORE_WRITE_CONCERN_W.
+// The name of each variable is the key of the setting in a config file in upper snake case.
+// Example:
+//
+//	withEnv, err := FromEnv()
+//	if err != nil {
+//		return err
+//	}
+//	mongoDB := New(withEnv, WithCollectionName("products"))
+func FromEnv() (func(*MongoDB), error) {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return config.Option(), nil
+}
+
+// FromConfig returns a functional option that configures a MongoDB from a YAML, JSON or TOML file.
+// The format is chosen by the file extension: .yaml, .yml, .json or .toml.
+// CHUX_DATASTORE_* environment variables override the values in the file.
+// Example:
+//
+//	withConfig, err := FromConfig("/etc/app/datastore.yaml")
+//	if err != nil {
+//		return err
+//	}
+//	mongoDB := New(withConfig)
+func FromConfig(path string) (func(*MongoDB), error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return config.Option(), nil
+}
+
+// ConfigFromEnv reads and validates a Config from the CHUX_DATASTORE_* environment variables.
+func ConfigFromEnv() (*Config, error) {
+	config := &Config{}
+	if err := config.readEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadConfig reads and validates a Config from a YAML, JSON or TOML file. CHUX_DATASTORE_* environment
+// variables override the values in the file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		msg := fmt.Sprintf("LoadConfig() Could not read the config file %s. Check the inner error for details", path)
+		return nil, errors.NewChuxDataStoreError(msg, 1010, err)
+	}
+
+	values := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		msg := fmt.Sprintf("LoadConfig() Unsupported config file extension %q. Use .yaml, .yml, .json or .toml", ext)
+		return nil, errors.NewChuxDataStoreError(msg, 1011, nil)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("LoadConfig() Could not parse the config file %s. Check the inner error for details", path)
+		return nil, errors.NewChuxDataStoreError(msg, 1011, err)
+	}
+
+	config := &Config{}
+	flat := map[string]interface{}{}
+	flattenConfig("", values, flat)
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	// sort so that the first invalid key is always the same one
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, ok := lookupConfigField(key)
+		if !ok {
+			return nil, configError(key, fmt.Errorf("unknown key"))
+		}
+		if err := field.set(config, flat[key]); err != nil {
+			return nil, configError(key, err)
+		}
+	}
+
+	if err := config.readEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readEnv sets every setting that has a non-empty CHUX_DATASTORE_* environment variable.
+func (c *Config) readEnv() error {
+	for _, field := range configFields {
+		name := EnvPrefix + field.env
+		value, ok := os.LookupEnv(name)
+		if !ok || len(value) == 0 {
+			continue
+		}
+		if err := field.set(c, value); err != nil {
+			return configError(name, err)
+		}
+		if c.sources == nil {
+			c.sources = map[string]string{}
+		}
+		c.sources[field.key] = name
+	}
+	return nil
+}
+
+// Validate checks the values of the Config. The returned error wraps a ConfigError that names the invalid key.
+func (c *Config) Validate() error {
+	if len(c.URI) > 0 {
+		if _, err := connstring.ParseAndValidate(c.URI); err != nil {
+			return c.invalid("uri", err)
+		}
+	}
+	durations := []struct {
+		key string
+		d   time.Duration
+	}{
+		{"timeout", c.Timeout},
+		{"connectTimeout", c.ConnectTimeout},
+		{"serverSelectionTimeout", c.ServerSelectionTimeout},
+		{"maxConnIdleTime", c.MaxConnIdleTime},
+		{"writeConcern.wtimeout", c.WriteConcern.WTimeout},
+	}
+	for _, duration := range durations {
+		if duration.d < 0 {
+			return c.invalid(duration.key, fmt.Errorf("must not be negative, got %s", duration.d))
+		}
+	}
+	if err := validatePoolSize(c.MaxPoolSize, c.MinPoolSize); err != nil {
+		return c.invalid("minPoolSize", err)
+	}
+	if err := validateHeartbeatInterval(c.HeartbeatInterval); err != nil {
+		return c.invalid("heartbeatInterval", err)
+	}
+	if err := validateAuthMechanism(c.AuthMechanism); err != nil {
+		return c.invalid("authMechanism", err)
+	}
+	if err := validateCompressors(c.Compressors); err != nil {
+		return c.invalid("compressors", err)
+	}
+	if len(c.TLSCAFile) > 0 {
+		if _, err := os.Stat(c.TLSCAFile); err != nil {
+			return c.invalid("tls.caFile", err)
+		}
+	}
+	if len(c.TLSCertificateKeyFile) > 0 {
+		if _, err := os.Stat(c.TLSCertificateKeyFile); err != nil {
+			return c.invalid("tls.certificateKeyFile", err)
+		}
+	}
+	if _, err := c.readPreference(); err != nil {
+		return c.invalid("readPreference", err)
+	}
+	if _, err := c.readConcern(); err != nil {
+		return c.invalid("readConcern", err)
+	}
+	if _, err := c.writeConcern(); err != nil {
+		key := "writeConcern.w"
+		if len(c.WriteConcern.W) == 0 {
+			key = "writeConcern.journal"
+		}
+		return c.invalid(key, err)
+	}
+	return nil
+}
+
+// Option returns a functional option that applies the Config. Settings that are not configured are left as they are.
+func (c *Config) Option() func(*MongoDB) {
+	readPreference, _ := c.readPreference()
+	readConcern, _ := c.readConcern()
+	writeConcern, _ := c.writeConcern()
+
+	return func(s *MongoDB) {
+		if len(c.URI) > 0 {
+			s.URI = c.URI
+		}
+		if len(c.DatabaseName) > 0 {
+			s.DatabaseName = c.DatabaseName
+		}
+		if len(c.CollectionName) > 0 {
+			s.CollectionName = c.CollectionName
+		}
+		if c.Timeout > 0 {
+			s.Timeout = c.Timeout.Seconds()
+		}
+		if c.ConnectTimeout > 0 {
+			s.settings.connectTimeout = c.ConnectTimeout
+		}
+		if c.ServerSelectionTimeout > 0 {
+			s.settings.serverSelectionTimeout = c.ServerSelectionTimeout
+		}
+		if c.MaxPoolSize != nil {
+			s.settings.maxPoolSize = c.MaxPoolSize
+		}
+		if c.MinPoolSize != nil {
+			s.settings.minPoolSize = c.MinPoolSize
+		}
+		if c.MaxConnIdleTime > 0 {
+			s.settings.maxConnIdleTime = c.MaxConnIdleTime
+		}
+		if c.HeartbeatInterval > 0 {
+			s.settings.heartbeatInterval = c.HeartbeatInterval
+		}
+		if len(c.TLSCAFile) > 0 {
+			s.settings.tlsCAFile = c.TLSCAFile
+		}
+		if len(c.TLSCertificateKeyFile) > 0 {
+			s.settings.tlsCertificateKeyFile = c.TLSCertificateKeyFile
+		}
+		if len(c.AppName) > 0 {
+			s.settings.appName = c.AppName
+		}
+		if len(c.AuthMechanism) > 0 {
+			s.settings.authMechanism = c.AuthMechanism
+		}
+		if len(c.AuthSource) > 0 {
+			s.settings.authSource = c.AuthSource
+		}
+		if len(c.Compressors) > 0 {
+			s.settings.compressors = c.Compressors
+		}
+		if c.DirectConnection != nil {
+			s.settings.directConnection = c.DirectConnection
+		}
+		if readPreference != nil {
+			s.concerns.readPreference = readPreference
+		}
+		if readConcern != nil {
+			s.concerns.readConcern = readConcern
+		}
+		if writeConcern != nil {
+			s.concerns.writeConcern = writeConcern
+		}
+	}
+}
+
+// readPreference returns the configured read preference, or nil when none is configured.
+func (c *Config) readPreference() (*readpref.ReadPref, error) {
+	if len(c.ReadPreference) == 0 {
+		return nil, nil
+	}
+	mode, err := readpref.ModeFromString(c.ReadPreference)
+	if err != nil {
+		return nil, fmt.Errorf("unknown read preference %q, use primary, primaryPreferred, secondary, secondaryPreferred or nearest", c.ReadPreference)
+	}
+	return readpref.New(mode)
+}
+
+// readConcern returns the configured read concern, or nil when none is configured.
+func (c *Config) readConcern() (*readconcern.ReadConcern, error) {
+	switch level := c.ReadConcern; level {
+	case "":
+		return nil, nil
+	case "local", "available", "majority", "linearizable", "snapshot":
+		return readconcern.New(readconcern.Level(level)), nil
+	default:
+		return nil, fmt.Errorf("unknown read concern %q, use local, available, majority, linearizable or snapshot", level)
+	}
+}
+
+// writeConcern returns the configured write concern, or nil when none is configured.
+func (c *Config) writeConcern() (*writeconcern.WriteConcern, error) {
+	wc := c.WriteConcern
+	if len(wc.W) == 0 && wc.Journal == nil && wc.WTimeout == 0 {
+		return nil, nil
+	}
+	var opts []writeconcern.Option
+	switch n, err := strconv.Atoi(wc.W); {
+	case len(wc.W) == 0:
+	case strings.EqualFold(wc.W, "majority"):
+		opts = append(opts, writeconcern.WMajority())
+	case err == nil && n < 0:
+		return nil, fmt.Errorf("must not be negative, got %d", n)
+	case err == nil:
+		opts = append(opts, writeconcern.W(n))
+	default:
+		opts = append(opts, writeconcern.WTagSet(wc.W))
+	}
+	if wc.Journal != nil {
+		opts = append(opts, writeconcern.J(*wc.Journal))
+	}
+	if wc.WTimeout > 0 {
+		opts = append(opts, writeconcern.WTimeout(wc.WTimeout))
+	}
+	concern := writeconcern.New(opts...)
+	if !concern.IsValid() {
+		return nil, fmt.Errorf("an unacknowledged write concern (w: 0) cannot require the journal")
+	}
+	return concern, nil
+}
+
+// invalid returns the error for an invalid value, naming the environment variable when the value came from one.
+func (c *Config) invalid(key string, err error) error {
+	if name, ok := c.sources[key]; ok {
+		key = name
+	}
+	return configError(key, err)
+}
+
+func configError(key string, err error) error {
+	msg := fmt.Sprintf("Invalid datastore configuration %q: %s", key, err)
+	return errors.NewChuxDataStoreError(msg, 1010, &ConfigError{Key: key, Err: err})
+}
+
+// flattenConfig turns nested tables into dotted keys, so {"tls": {"caFile": ...}} becomes "tls.caFile".
+func flattenConfig(prefix string, values map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range values {
+		if len(prefix) > 0 {
+			key = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenConfig(key, nested, flat)
+			continue
+		}
+		flat[key] = value
+	}
+}
+
+// lookupConfigField finds the field for a config file key. Keys are matched without regard to case.
+func lookupConfigField(key string) (configField, bool) {
+	for _, field := range configFields {
+		if strings.EqualFold(field.key, key) {
+			return field, true
+		}
+	}
+	return configField{}, false
+}
+
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("expected a string, got %T", value)
+}
+
+func configStrings(value interface{}) ([]string, error) {
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			s, err := configString(item)
+			if err != nil {
+				return nil, fmt.Errorf("expected a list of strings, got a %T", item)
+			}
+			values = append(values, strings.TrimSpace(s))
+		}
+		return values, nil
+	}
+	s, err := configString(value)
+	if err != nil {
+		return nil, fmt.Errorf("expected a list or a comma separated string, got %T", value)
+	}
+	var values []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			values = append(values, item)
+		}
+	}
+	return values, nil
+}
+
+func configDuration(value interface{}) (time.Duration, error) {
+	seconds := func(f float64) time.Duration { return time.Duration(f * float64(time.Second)) }
+	switch v := value.(type) {
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return seconds(f), nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("expected a duration such as \"30s\" or a number of seconds, got %q", v)
+		}
+		return d, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return seconds(f), nil
+	case int:
+		return seconds(float64(v)), nil
+	case int64:
+		return seconds(float64(v)), nil
+	case float64:
+		return seconds(v), nil
+	}
+	return 0, fmt.Errorf("expected a duration such as \"30s\" or a number of seconds, got %T", value)
+}
+
+func configUint(value interface{}) (*uint64, error) {
+	s, err := configString(value)
+	if err != nil {
+		return nil, fmt.Errorf("expected a non-negative integer, got %T", value)
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("expected a non-negative integer, got %q", s)
+	}
+	return &n, nil
+}
+
+func configBool(value interface{}) (*bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return &v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("expected true or false, got %q", v)
+		}
+		return &b, nil
+	}
+	return nil, fmt.Errorf("expected true or false, got %T", value)
+}
@@ -0,0 +1,313 @@
+package db
+
+import (
+	stderrors "errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a file with the given name in a temporary directory and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// configKey returns the key named by the ConfigError wrapped in err, or "" when there is none.
+func configKey(err error) string {
+	var configErr *ConfigError
+	if !stderrors.As(err, &configErr) {
+		return ""
+	}
+	return configErr.Key
+}
+
+func TestLoadConfig(t *testing.T) {
+	caFile := writeConfig(t, "ca.pem", "")
+	maxPoolSize, minPoolSize, journal := uint64(100), uint64(5), true
+	want := &Config{
+		URI:                    "mongodb://db1:27017,db2:27017/?replicaSet=rs0",
+		DatabaseName:           "app",
+		CollectionName:         "products",
+		Timeout:                30 * time.Second,
+		ServerSelectionTimeout: 5 * time.Second,
+		MaxPoolSize:            &maxPoolSize,
+		MinPoolSize:            &minPoolSize,
+		TLSCAFile:              caFile,
+		Compressors:            []string{"zstd", "snappy"},
+		ReadPreference:         "secondaryPreferred",
+		ReadConcern:            "majority",
+		WriteConcern:           WriteConcernConfig{W: "majority", Journal: &journal, WTimeout: 1500 * time.Millisecond},
+	}
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "config.yaml",
+			content: `uri: mongodb://db1:27017,db2:27017/?replicaSet=rs0
+database: app
+collection: products
+timeout: 30s
+serverSelectionTimeout: 5
+maxPoolSize: 100
+minPoolSize: 5
+compressors: [zstd, snappy]
+tls:
+  caFile: ` + caFile + `
+readPreference: secondaryPreferred
+readConcern: majority
+writeConcern:
+  w: majority
+  journal: true
+  wtimeout: 1.5
+`,
+		},
+		{
+			name: "config.json",
+			content: `{
+	"uri": "mongodb://db1:27017,db2:27017/?replicaSet=rs0",
+	"database": "app",
+	"collection": "products",
+	"timeout": "30s",
+	"serverSelectionTimeout": 5,
+	"maxPoolSize": 100,
+	"minPoolSize": "5",
+	"compressors": "zstd, snappy",
+	"tls": {"caFile": "` + caFile + `"},
+	"readPreference": "secondaryPreferred",
+	"readConcern": "majority",
+	"writeConcern": {"w": "majority", "journal": true, "wtimeout": "1500ms"}
+}`,
+		},
+		{
+			name: "config.toml",
+			content: `uri = "mongodb://db1:27017,db2:27017/?replicaSet=rs0"
+database = "app"
+collection = "products"
+timeout = "30s"
+serverSelectionTimeout = 5
+maxPoolSize = 100
+minPoolSize = 5
+compressors = ["zstd", "snappy"]
+readPreference = "secondaryPreferred"
+readConcern = "majority"
+
+[tls]
+caFile = "` + caFile + `"
+
+[writeConcern]
+w = "majority"
+journal = true
+wtimeout = 1.5
+`,
+		},
+		{
+			name: "keys in any case.yml",
+			content: `URI: mongodb://db1:27017,db2:27017/?replicaSet=rs0
+Database: app
+COLLECTION: products
+Timeout: 30s
+serverselectiontimeout: 5s
+MaxPoolSize: 100
+minpoolsize: 5
+Compressors: zstd,snappy
+TLS:
+  CAFile: ` + caFile + `
+ReadPreference: secondaryPreferred
+ReadConcern: majority
+WriteConcern:
+  W: majority
+  Journal: "true"
+  WTimeout: 1.5s
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(writeConfig(t, tt.name, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("LoadConfig() = %+v, want %+v", config, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantKey string
+	}{
+		{name: "unknown.yaml", content: "databse: app\n", wantKey: "databse"},
+		{name: "unknown nested.yaml", content: "tls:\n  caFiles: /ca.pem\n", wantKey: "tls.caFiles"},
+		{name: "not a duration.yaml", content: "timeout: soon\n", wantKey: "timeout"},
+		{name: "negative duration.yaml", content: "connectTimeout: -5s\n", wantKey: "connectTimeout"},
+		{name: "negative pool size.yaml", content: "maxPoolSize: -1\n", wantKey: "maxPoolSize"},
+		{name: "not a bool.yaml", content: "directConnection: maybe\n", wantKey: "directConnection"},
+		{name: "list of lists.yaml", content: "compressors: [[zstd]]\n", wantKey: "compressors"},
+		{name: "invalid uri.yaml", content: "uri: http://db1\n", wantKey: "uri"},
+		{name: "min above max.yaml", content: "maxPoolSize: 5\nminPoolSize: 10\n", wantKey: "minPoolSize"},
+		{name: "short heartbeat.yaml", content: "heartbeatInterval: 100ms\n", wantKey: "heartbeatInterval"},
+		{name: "auth mechanism.yaml", content: "authMechanism: PLAINTEXT\n", wantKey: "authMechanism"},
+		{name: "compressor.yaml", content: "compressors: gzip\n", wantKey: "compressors"},
+		{name: "compressor twice.yaml", content: "compressors: zstd,zstd\n", wantKey: "compressors"},
+		{name: "missing ca file.yaml", content: "tls:\n  caFile: /does/not/exist.pem\n", wantKey: "tls.caFile"},
+		{name: "missing key file.yaml", content: "tls:\n  certificateKeyFile: /does/not/exist.pem\n", wantKey: "tls.certificateKeyFile"},
+		{name: "read preference.yaml", content: "readPreference: fastest\n", wantKey: "readPreference"},
+		{name: "read concern.yaml", content: "readConcern: strong\n", wantKey: "readConcern"},
+		{name: "negative w.yaml", content: "writeConcern:\n  w: -1\n", wantKey: "writeConcern.w"},
+		{name: "unacknowledged journal.yaml", content: "writeConcern:\n  w: 0\n  journal: true\n", wantKey: "writeConcern.w"},
+		{name: "negative wtimeout.yaml", content: "writeConcern:\n  wtimeout: -1\n", wantKey: "writeConcern.wtimeout"},
+		{name: "unparsable.json", content: `{"database": }`},
+		{name: "unparsable.toml", content: `database = `},
+		{name: "config.ini", content: "database=app\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.name, tt.content))
+			if err == nil {
+				t.Fatal("LoadConfig() succeeded")
+			}
+			if key := configKey(err); key != tt.wantKey {
+				t.Errorf("LoadConfig() error %v names the key %q, want %q", err, key, tt.wantKey)
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig() of a missing file succeeded")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("CHUX_DATASTORE_URI", "mongodb://db1:27017")
+	t.Setenv("CHUX_DATASTORE_DATABASE", "app")
+	t.Setenv("CHUX_DATASTORE_TIMEOUT", "45s")
+	t.Setenv("CHUX_DATASTORE_MAX_POOL_SIZE", "50")
+	t.Setenv("CHUX_DATASTORE_COMPRESSORS", "zstd, zlib")
+	t.Setenv("CHUX_DATASTORE_DIRECT_CONNECTION", "true")
+	t.Setenv("CHUX_DATASTORE_WRITE_CONCERN_W", "2")
+	t.Setenv("CHUX_DATASTORE_COLLECTION", "")
+
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.URI != "mongodb://db1:27017" || config.DatabaseName != "app" || config.Timeout != 45*time.Second {
+		t.Errorf("ConfigFromEnv() = %+v, want the uri, database and timeout of the environment", config)
+	}
+	if config.MaxPoolSize == nil || *config.MaxPoolSize != 50 {
+		t.Errorf("ConfigFromEnv() max pool size = %v, want 50", config.MaxPoolSize)
+	}
+	if !reflect.DeepEqual(config.Compressors, []string{"zstd", "zlib"}) {
+		t.Errorf("ConfigFromEnv() compressors = %v, want [zstd zlib]", config.Compressors)
+	}
+	if config.DirectConnection == nil || !*config.DirectConnection || config.WriteConcern.W != "2" {
+		t.Errorf("ConfigFromEnv() = %+v, want a direct connection and w: 2", config)
+	}
+	if config.CollectionName != "" {
+		t.Errorf("ConfigFromEnv() collection = %q, want an empty variable ignored", config.CollectionName)
+	}
+
+	file := writeConfig(t, "config.yaml", "database: catalog\ncollection: products\n")
+	config, err = LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DatabaseName != "app" || config.CollectionName != "products" {
+		t.Errorf("LoadConfig() = %+v, want the database of the environment and the collection of the file", config)
+	}
+}
+
+func TestConfigFromEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantKey string
+	}{
+		{name: "CHUX_DATASTORE_MAX_POOL_SIZE", value: "many", wantKey: "CHUX_DATASTORE_MAX_POOL_SIZE"},
+		{name: "CHUX_DATASTORE_TIMEOUT", value: "soon", wantKey: "CHUX_DATASTORE_TIMEOUT"},
+		{name: "CHUX_DATASTORE_READ_CONCERN", value: "strong", wantKey: "CHUX_DATASTORE_READ_CONCERN"},
+		{name: "CHUX_DATASTORE_WRITE_CONCERN_W", value: "-2", wantKey: "CHUX_DATASTORE_WRITE_CONCERN_W"},
+		{name: "CHUX_DATASTORE_URI", value: "db1:27017", wantKey: "CHUX_DATASTORE_URI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := ConfigFromEnv()
+			if key := configKey(err); key != tt.wantKey {
+				t.Errorf("ConfigFromEnv() error %v names the key %q, want %q", err, key, tt.wantKey)
+			}
+			_, err = LoadConfig(writeConfig(t, "config.yaml", "database: app\n"))
+			if key := configKey(err); key != tt.wantKey {
+				t.Errorf("LoadConfig() error %v names the key %q, want %q", err, key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	journal := true
+	tests := []struct {
+		name    string
+		config  Config
+		wantKey string
+	}{
+		{name: "empty", config: Config{}},
+		{name: "tag set write concern", config: Config{WriteConcern: WriteConcernConfig{W: "eastCoast"}}},
+		{name: "journal without w", config: Config{WriteConcern: WriteConcernConfig{Journal: &journal}}},
+		{name: "negative timeout", config: Config{Timeout: -time.Second}, wantKey: "timeout"},
+		{name: "negative idle time", config: Config{MaxConnIdleTime: -time.Second}, wantKey: "maxConnIdleTime"},
+		{name: "unknown read preference", config: Config{ReadPreference: "any"}, wantKey: "readPreference"},
+		{
+			name:    "value from the environment",
+			config:  Config{ReadConcern: "strong", sources: map[string]string{"readConcern": "CHUX_DATASTORE_READ_CONCERN"}},
+			wantKey: "CHUX_DATASTORE_READ_CONCERN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != (tt.wantKey != "") {
+				t.Fatalf("Validate() = %v, want an error: %v", err, tt.wantKey != "")
+			}
+			if key := configKey(err); key != tt.wantKey {
+				t.Errorf("Validate() error %v names the key %q, want %q", err, key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestFlattenConfig(t *testing.T) {
+	values := map[string]interface{}{
+		"database": "app",
+		"tls":      map[string]interface{}{"caFile": "/ca.pem"},
+		"writeConcern": map[string]interface{}{
+			"w":     "majority",
+			"extra": map[string]interface{}{"deep": 1},
+		},
+		"compressors": []interface{}{"zstd"},
+	}
+	want := map[string]interface{}{
+		"database":                "app",
+		"tls.caFile":              "/ca.pem",
+		"writeConcern.w":          "majority",
+		"writeConcern.extra.deep": 1,
+		"compressors":             []interface{}{"zstd"},
+	}
+	flat := map[string]interface{}{}
+	flattenConfig("", values, flat)
+	if !reflect.DeepEqual(flat, want) {
+		t.Errorf("flattenConfig() = %v, want %v", flat, want)
+	}
+}
@@ -0,0 +1,560 @@
+package db
+
+import (
+	"context"
+	"encoding"
+	"encoding/csv"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// csvTimeLayouts are the layouts tried, in order, to read a time from a CSV cell.
+var csvTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+var (
+	objectIDType        = reflect.TypeOf(primitive.ObjectID{})
+	timeType            = reflect.TypeOf(time.Time{})
+	dateTimeType        = reflect.TypeOf(primitive.DateTime(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// CSVRowError is a row of a CSV file that could not be decoded into a document.
+type CSVRowError struct {
+	// Line is the line of the row in the file, starting at 1 for the header.
+	Line int
+	// Column is the header of the cell that could not be decoded, or empty when the row has the wrong
+	// number of cells.
+	Column string
+	Err    error
+}
+
+func (e *CSVRowError) Error() string {
+	if len(e.Column) == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %s: %s", e.Line, e.Column, e.Err)
+}
+
+func (e *CSVRowError) Unwrap() error {
+	return e.Err
+}
+
+// csvColumn maps a CSV column to a field of the document type.
+type csvColumn struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+// csvColumns resolves the column names to fields of the struct type t and checks that every column is
+// known, appears once and has a type that can be written to a cell.
+func csvColumns(t reflect.Type, names []string) ([]csvColumn, error) {
+	columns := make([]csvColumn, 0, len(names))
+	seen := map[string]bool{}
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if len(name) == 0 {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %s appears more than once", name)
+		}
+		seen[name] = true
+		index, typ, err := bsonFieldIndex(t, name)
+		if err != nil {
+			return nil, fmt.Errorf("column %s does not match a field of %s", name, t.Name())
+		}
+		if !isCSVType(typ) {
+			return nil, fmt.Errorf("column %s has type %s, which cannot be stored in a CSV cell", name, typ)
+		}
+		columns = append(columns, csvColumn{name: name, index: index, typ: typ})
+	}
+	return columns, nil
+}
+
+// isCSVType reports whether values of t can be converted from and to a CSV cell.
+func isCSVType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case objectIDType, timeType, dateTimeType:
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return reflect.PointerTo(t).Implements(textUnmarshalerType) && t.Implements(textMarshalerType)
+}
+
+// leafColumns returns the bson paths of every field of t that can be written to a cell, nested structs
+// flattened with dotted paths, in declaration order.
+func leafColumns(t reflect.Type, prefix string, visiting map[reflect.Type]bool) []string {
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, inline, skip := bsonFieldName(field)
+		if skip {
+			continue
+		}
+		nested := field.Type
+		if nested.Kind() == reflect.Ptr {
+			nested = nested.Elem()
+		}
+		switch {
+		case isCSVType(field.Type):
+			names = append(names, prefix+name)
+		case nested.Kind() == reflect.Struct && inline:
+			names = append(names, leafColumns(nested, prefix, visiting)...)
+		case nested.Kind() == reflect.Struct:
+			names = append(names, leafColumns(nested, prefix+name+".", visiting)...)
+		}
+	}
+	return names
+}
+
+// CSVReader reads documents from a CSV file whose header names the bson fields of the document type.
+// Nested fields use dotted headers such as "address.city". Cells are converted to the type of their field:
+// ObjectIDs from hex, times from RFC 3339 or "2006-01-02 15:04:05" or "2006-01-02", booleans from
+// true/false, 1/0 or yes/no, and numbers in base 10. Empty cells leave the field at its zero value.
+// Example:
+//
+//	reader, err := NewCSVReader(f, &Customer{})
+//	for {
+//		doc, err := reader.Read()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+type CSVReader struct {
+	r       *csv.Reader
+	typ     reflect.Type
+	columns []csvColumn
+	// filled reports which cells of the last row read were not empty
+	filled []bool
+}
+
+// NewCSVReader reads the header from r and checks that every column matches a field of doc.
+func NewCSVReader(r io.Reader, doc IMongoDocument) (*CSVReader, error) {
+	typ := reflect.TypeOf(doc).Elem()
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the CSV file has no header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns, err := csvColumns(typ, header)
+	if err != nil {
+		return nil, err
+	}
+	return &CSVReader{r: reader, typ: typ, columns: columns, filled: make([]bool, len(columns))}, nil
+}
+
+// Columns returns the bson paths of the columns in the order of the header.
+func (c *CSVReader) Columns() []string {
+	names := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+// fieldOf returns the column of the header that holds the field with the given bson path.
+func (c *CSVReader) fieldOf(path string) (csvColumn, error) {
+	for _, column := range c.columns {
+		if column.name == path {
+			return column, nil
+		}
+	}
+	return csvColumn{}, fmt.Errorf("no column %s", path)
+}
+
+// Read returns the document of the next row, or io.EOF after the last row. A row that cannot be decoded
+// returns a *CSVRowError; the next call reads the following row.
+func (c *CSVReader) Read() (IMongoDocument, error) {
+	record, err := c.r.Read()
+	var parseErr *csv.ParseError
+	if stderrors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+		return nil, &CSVRowError{Line: parseErr.Line, Err: fmt.Errorf("the row has %d cells, the header has %d", len(record), len(c.columns))}
+	}
+	if err != nil {
+		return nil, err
+	}
+	line, _ := c.r.FieldPos(0)
+	doc := reflect.New(c.typ)
+	for i, column := range c.columns {
+		cell := strings.TrimSpace(record[i])
+		c.filled[i] = len(cell) > 0
+		if len(cell) == 0 {
+			continue
+		}
+		if err := setCSVValue(settableField(doc.Elem(), column.index), cell); err != nil {
+			return nil, &CSVRowError{Line: line, Column: column.name, Err: err}
+		}
+	}
+	return doc.Interface().(IMongoDocument), nil
+}
+
+// cells returns the fields of doc, the document of the last row read, that had a cell in the row, keyed by
+// their dotted bson path. A $set of them leaves the fields the file does not have as they are.
+func (c *CSVReader) cells(doc IMongoDocument) bson.D {
+	v := reflect.ValueOf(doc).Elem()
+	d := bson.D{}
+	for i, column := range c.columns {
+		if !c.filled[i] {
+			continue
+		}
+		if field, err := v.FieldByIndexErr(column.index); err == nil {
+			d = append(d, bson.E{Key: column.name, Value: field.Interface()})
+		}
+	}
+	return d
+}
+
+// setCSVValue converts cell to the type of v and stores it.
+func setCSVValue(v reflect.Value, cell string) error {
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	switch v.Type() {
+	case objectIDType:
+		id, err := primitive.ObjectIDFromHex(cell)
+		if err != nil {
+			return fmt.Errorf("%q is not an ObjectID", cell)
+		}
+		v.Set(reflect.ValueOf(id))
+		return nil
+	case timeType, dateTimeType:
+		t, err := parseCSVTime(cell)
+		if err != nil {
+			return err
+		}
+		if v.Type() == dateTimeType {
+			v.Set(reflect.ValueOf(primitive.NewDateTimeFromTime(t)))
+		} else {
+			v.Set(reflect.ValueOf(t))
+		}
+		return nil
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok && v.Kind() != reflect.String {
+		return u.UnmarshalText([]byte(cell))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(cell)
+	case reflect.Bool:
+		switch strings.ToLower(cell) {
+		case "true", "1", "yes", "y":
+			v.SetBool(true)
+		case "false", "0", "no", "n":
+			v.SetBool(false)
+		default:
+			return fmt.Errorf("%q is not a boolean", cell)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(cell, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer of %d bits", cell, v.Type().Bits())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(cell, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an unsigned integer of %d bits", cell, v.Type().Bits())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(cell, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a number", cell)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func parseCSVTime(cell string) (time.Time, error) {
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, cell); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time, use RFC 3339 such as 2006-01-02T15:04:05Z", cell)
+}
+
+// CSVWriter writes documents as CSV rows under a header of bson field names.
+type CSVWriter struct {
+	w       *csv.Writer
+	columns []csvColumn
+	record  []string
+}
+
+// NewCSVWriter writes the header of the given columns to w. Without columns, every field of doc that fits
+// in a cell is written, nested structs flattened into dotted columns.
+func NewCSVWriter(w io.Writer, doc IMongoDocument, columns ...string) (*CSVWriter, error) {
+	typ := reflect.TypeOf(doc).Elem()
+	if len(columns) == 0 {
+		columns = leafColumns(typ, "", map[reflect.Type]bool{})
+	}
+	resolved, err := csvColumns(typ, columns)
+	if err != nil {
+		return nil, err
+	}
+	writer := &CSVWriter{w: csv.NewWriter(w), columns: resolved, record: make([]string, len(resolved))}
+	if err := writer.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write writes doc as a row.
+func (c *CSVWriter) Write(doc IMongoDocument) error {
+	v := reflect.ValueOf(doc).Elem()
+	for i, column := range c.columns {
+		c.record[i] = ""
+		if field, err := v.FieldByIndexErr(column.index); err == nil {
+			c.record[i] = formatCSVValue(field)
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+// Flush writes the buffered rows to the underlying writer.
+func (c *CSVWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// formatCSVValue returns v as it is written to a cell.
+func formatCSVValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch value := v.Interface().(type) {
+	case primitive.ObjectID:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Hex()
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Format(time.RFC3339Nano)
+	case primitive.DateTime:
+		return value.Time().UTC().Format(time.RFC3339Nano)
+	case encoding.TextMarshaler:
+		if v.Kind() != reflect.String {
+			text, err := value.MarshalText()
+			if err != nil {
+				return ""
+			}
+			return string(text)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// CSVImportResult counts the documents handled by ImportCSV and lists the rows it skipped.
+type CSVImportResult struct {
+	TransferResult
+	// RowErrors holds the rows that could not be decoded. They are skipped and the import goes on.
+	RowErrors []*CSVRowError
+}
+
+// ImportCSV loads the rows of a CSV file into the collection of doc in batches, as Import does. The header
+// must name bson fields of doc, see CSVReader; with ImportUpsert it must include the key fields, and only the
+// non-empty cells are set, so fields the file does not have keep their values. Rows that cannot be decoded
+// are skipped and reported in the result. Documents without an _id get a new ObjectID and the fields tagged
+// datastore:"encrypt" are encrypted.
+// Example:
+//
+//	f, err := os.Open("customers.csv")
+//	...
+//	result, err := mongoDB.ImportCSV(&Customer{}, f, ImportUpsert, TransferKeyFields("email"))
+//	for _, rowErr := range result.RowErrors {
+//		log.Printf("skipped %s", rowErr)
+//	}
+func (m *MongoDB) ImportCSV(doc IMongoDocument, r io.Reader, mode ImportMode, opts ...TransferOption) (*CSVImportResult, error) {
+	result := &CSVImportResult{}
+	err := m.doOnce(opImport, doc, func(ctx context.Context) error {
+		return m.importCSV(ctx, doc, r, mode, newTransferOptions(opts), result)
+	})
+	return result, err
+}
+
+func (m *MongoDB) importCSV(ctx context.Context, doc IMongoDocument, r io.Reader, mode ImportMode, o transferOptions, result *CSVImportResult) error {
+	logging := m.Logger
+
+	if _, err := ParseImportMode(string(mode)); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ImportCSV() Invalid mode", "mode", mode, "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.ImportCSV() Invalid mode: %s", err), 1070, err)
+	}
+	reader, err := NewCSVReader(r, doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ImportCSV() Invalid header", "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.ImportCSV() Invalid header: %s", err), 1070, err)
+	}
+	if mode == ImportUpsert {
+		for _, key := range o.keyFields {
+			if _, err := reader.fieldOf(key); err != nil {
+				logging.ErrorContext(ctx, "MongoDB.ImportCSV() The header has no key field", "key", key)
+				return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.ImportCSV() The header has no key field %s", key), 1070, err)
+			}
+		}
+	}
+
+	next := func() (bson.D, error) {
+		for {
+			row, err := reader.Read()
+			if rowErr, ok := err.(*CSVRowError); ok {
+				logging.WarningContext(ctx, "MongoDB.ImportCSV() Skipped a row", "line", rowErr.Line, "column", rowErr.Column, "error", rowErr.Err)
+				result.RowErrors = append(result.RowErrors, rowErr)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if row.GetID() == primitive.NilObjectID {
+				row.SetID(primitive.NewObjectID())
+			}
+			if _, err := m.encryptFields(ctx, row); err != nil {
+				return nil, err
+			}
+			if mode == ImportUpsert {
+				// only the columns of the file are set, with the _id for a document that is inserted
+				d := reader.cells(row)
+				if _, ok := lookupPath(d, "_id"); !ok {
+					d = append(bson.D{{Key: "_id", Value: row.GetID()}}, d...)
+				}
+				return d, nil
+			}
+			data, err := bson.Marshal(row)
+			if err != nil {
+				return nil, err
+			}
+			var d bson.D
+			return d, bson.Unmarshal(data, &d)
+		}
+	}
+	return m.load(ctx, "MongoDB.ImportCSV()", doc, mode, o, &result.TransferResult, next)
+}
+
+// ExportCSV writes the documents of the collection of doc that match filter to w as CSV. filter is a bson.M
+// or bson.D query; nil exports every document. TransferColumns selects and orders the columns; by default
+// every field that fits in a cell is written. Unlike Export, encrypted fields are decrypted.
+// Example:
+//
+//	result, err := mongoDB.ExportCSV(&Customer{}, nil, os.Stdout, TransferColumns("name", "email", "address.city"))
+func (m *MongoDB) ExportCSV(doc IMongoDocument, filter interface{}, w io.Writer, opts ...TransferOption) (*TransferResult, error) {
+	result := &TransferResult{}
+	err := m.doOnce(opExport, doc, func(ctx context.Context) error {
+		return m.exportCSV(ctx, doc, filter, w, newTransferOptions(opts), result)
+	})
+	return result, err
+}
+
+func (m *MongoDB) exportCSV(ctx context.Context, doc IMongoDocument, filter interface{}, w io.Writer, o transferOptions, result *TransferResult) error {
+	logging := m.Logger
+
+	writer, err := NewCSVWriter(w, doc, o.columns...)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ExportCSV() Invalid columns", "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.ExportCSV() Invalid columns: %s", err), 1070, err)
+	}
+	collection, err := m.getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ExportCSV() error occurred connecting to Mongo", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.ExportCSV() error occurred connecting to Mongo", 1070, err)
+	}
+	filter, err = m.tenantFilter(ctx, filter)
+	if err != nil {
+		return err
+	}
+	setStatement(ctx, filter)
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetBatchSize(int32(o.batchSize)))
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ExportCSV() Failed to find documents", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.ExportCSV() Failed to find documents. Check the inner error.", 1070, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		row := reflect.New(reflect.TypeOf(doc).Elem()).Interface().(IMongoDocument)
+		if err := cursor.Decode(row); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.ExportCSV() Failed to decode document", "error", err)
+			return errors.NewChuxDataStoreError("MongoDB.ExportCSV() Failed to decode document. Check the inner error.", 1070, err)
+		}
+		if err := m.decryptFields(ctx, row); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.ExportCSV() Failed to decrypt document", "error", err)
+			return errors.NewChuxDataStoreError("MongoDB.ExportCSV() Failed to decrypt document. Check the inner error.", 1041, err)
+		}
+		if err := writer.Write(row); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.ExportCSV() Failed to write document", "document", result.Documents+1, "error", err)
+			return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.ExportCSV() Failed to write document %d. Check the inner error.", result.Documents+1), 1070, err)
+		}
+		result.Documents++
+		if result.Documents%int64(o.batchSize) == 0 {
+			o.report(result)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ExportCSV() Cursor error", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.ExportCSV() Cursor error. Check the inner error.", 1070, err)
+	}
+	if err := writer.Flush(); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.ExportCSV() Failed to write the export", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.ExportCSV() Failed to write the export. Check the inner error.", 1070, err)
+	}
+	o.report(result)
+	logging.InfoContext(ctx, "MongoDB.ExportCSV() Exported documents", "collection", collection.Name(), "documents", result.Documents)
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	dserrors "github.com/chuxorg/chux-datastore/errors"
+)
+
+func TestImportCSVUpsertSetsOnlyTheColumnsOfTheFile(t *testing.T) {
+	mongoDB := newFakeDB()
+	alice := &Person{Name: "Alice", Email: "a@x", Age: 30}
+	if err := mongoDB.Upsert(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := "email,age,name\na@x,31,\nb@x,40,Bob\n"
+	result, err := mongoDB.ImportCSV(&Person{}, strings.NewReader(csv), db.ImportUpsert, db.TransferKeyFields("email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Matched != 1 || result.Upserted != 1 {
+		t.Errorf("matched %d and upserted %d, want 1 and 1", result.Matched, result.Upserted)
+	}
+
+	got := &Person{}
+	if _, err := mongoDB.GetByID(got, alice.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Person{ID: alice.ID, Name: "Alice", Email: "a@x", Age: 31}); *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+	bobs, err := mongoDB.Query(&Person{}, "email", "b@x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bobs) != 1 || bobs[0].(*Person).Name != "Bob" || bobs[0].GetID().IsZero() {
+		t.Errorf("got %+v, want Bob with an _id", bobs)
+	}
+}
+
+func TestImportCSVSetsTheTenantOfTheOperation(t *testing.T) {
+	mongoDB := newFakeDB(db.WithTenantField("tenantId"))
+	ctx := db.ContextWithTenant(context.Background(), "t1")
+
+	csv := "name,email\nAlice,a@x\n"
+	if _, err := mongoDB.WithContext(ctx).ImportCSV(&Person{}, strings.NewReader(csv), db.ImportInsert); err != nil {
+		t.Fatal(err)
+	}
+	people, err := mongoDB.WithContext(ctx).GetAll(&Person{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 1 || people[0].(*Person).TenantID != "t1" {
+		t.Errorf("got %+v, want Alice in tenant t1", people)
+	}
+
+	csv = "name,tenantId\nMallory,t2\n"
+	_, err = mongoDB.WithContext(ctx).ImportCSV(&Person{}, strings.NewReader(csv), db.ImportInsert)
+	if !errors.Is(err, dserrors.ErrTenantMismatch) {
+		t.Errorf("got %v, want ErrTenantMismatch", err)
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Document is an IMongoDocument without a schema, for code that does not know the shape of the documents
+// it reads and writes, such as tools and test fixtures. Fields holds every field of the document except
+// _id, which must be an ObjectID. The collection and database names are not stored in the document.
+// Example:
+//
+//	doc := NewDocument("", "orders")
+//	docs, err := mongoDB.Query(doc, "status", "shipped")
+//	if err != nil {
+//		return err
+//	}
+//	for _, doc := range docs {
+//		fmt.Println(doc.(*Document).Fields["total"])
+//	}
+type Document struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	Fields bson.M             `bson:",inline"`
+
+	DatabaseName   string `bson:"-"`
+	CollectionName string `bson:"-"`
+}
+
+// NewDocument returns an empty Document of the given database and collection. An empty name means the
+// name configured on the MongoDB.
+func NewDocument(databaseName, collectionName string) *Document {
+	return &Document{Fields: bson.M{}, DatabaseName: databaseName, CollectionName: collectionName}
+}
+
+// GetCollectionName returns the collection of the Document.
+func (d *Document) GetCollectionName() string {
+	return d.CollectionName
+}
+
+// GetDatabaseName returns the database of the Document.
+func (d *Document) GetDatabaseName() string {
+	return d.DatabaseName
+}
+
+// GetURI returns an empty string, a Document always uses the URI of the MongoDB.
+func (d *Document) GetURI() string {
+	return ""
+}
+
+// GetID returns the _id of the Document.
+func (d *Document) GetID() primitive.ObjectID {
+	return d.ID
+}
+
+// SetID sets the _id of the Document.
+func (d *Document) SetID(id primitive.ObjectID) {
+	d.ID = id
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// The interfaces below are the part of the driver used by MongoDB. Their methods have the signatures of
+// the driver methods they stand for, with interfaces in place of the driver types, so a test can replace
+// the whole driver with WithClient. WrapClient adapts a *mongo.Client; the mongofake package provides an
+// in-memory implementation.
+
+//go:generate mockery --name MongoDatabase
+type IMongoDatabase interface {
+	Name() string
+	Collection(name string, opts ...*options.CollectionOptions) IMongoCollection
+	RunCommand(ctx context.Context, runCommand interface{}, opts ...*options.RunCmdOptions) IMongoSingleResult
+	ListCollectionNames(ctx context.Context, filter interface{}, opts ...*options.ListCollectionsOptions) ([]string, error)
+}
+
+//go:generate mockery --name MongoCollection
+type IMongoCollection interface {
+	Name() string
+	Database() IMongoDatabase
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) IMongoSingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (IMongoCursor, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	Indexes() IMongoIndexView
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (IMongoChangeStream, error)
+}
+
+//go:generate mockery --name MongoIndexView
+type IMongoIndexView interface {
+	CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error)
+	List(ctx context.Context, opts ...*options.ListIndexesOptions) (IMongoCursor, error)
+}
+
+// IMongoCursor is a *mongo.Cursor. Current is a method because interfaces cannot have fields.
+//
+//go:generate mockery --name MongoCursor
+type IMongoCursor interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Current() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+	All(ctx context.Context, results interface{}) error
+}
+
+//go:generate mockery --name MongoSingleResult
+type IMongoSingleResult interface {
+	Decode(v interface{}) error
+	DecodeBytes() (bson.Raw, error)
+	Err() error
+}
+
+//go:generate mockery --name MongoChangeStream
+type IMongoChangeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+	ResumeToken() bson.Raw
+}
+
+// WrapClient returns the IMongoClient of a driver client.
+func WrapClient(client *mongo.Client) IMongoClient {
+	return &mongoClient{client: client}
+}
+
+// mongoClient adapts a *mongo.Client to IMongoClient.
+type mongoClient struct {
+	client *mongo.Client
+}
+
+func (c *mongoClient) Connect(ctx context.Context) error {
+	return c.client.Connect(ctx)
+}
+
+func (c *mongoClient) Disconnect(ctx context.Context) error {
+	return c.client.Disconnect(ctx)
+}
+
+func (c *mongoClient) Database(name string, opts ...*options.DatabaseOptions) IMongoDatabase {
+	return &mongoDatabase{database: c.client.Database(name, opts...)}
+}
+
+func (c *mongoClient) Ping(ctx context.Context, rp *readpref.ReadPref) error {
+	return c.client.Ping(ctx, rp)
+}
+
+// mongoDatabase adapts a *mongo.Database to IMongoDatabase.
+type mongoDatabase struct {
+	database *mongo.Database
+}
+
+func (d *mongoDatabase) Name() string {
+	return d.database.Name()
+}
+
+func (d *mongoDatabase) Collection(name string, opts ...*options.CollectionOptions) IMongoCollection {
+	return &mongoCollection{collection: d.database.Collection(name, opts...), database: d}
+}
+
+func (d *mongoDatabase) RunCommand(ctx context.Context, runCommand interface{}, opts ...*options.RunCmdOptions) IMongoSingleResult {
+	return d.database.RunCommand(ctx, runCommand, opts...)
+}
+
+func (d *mongoDatabase) ListCollectionNames(ctx context.Context, filter interface{}, opts ...*options.ListCollectionsOptions) ([]string, error) {
+	return d.database.ListCollectionNames(ctx, filter, opts...)
+}
+
+// mongoCollection adapts a *mongo.Collection to IMongoCollection.
+type mongoCollection struct {
+	collection *mongo.Collection
+	database   *mongoDatabase
+}
+
+func (c *mongoCollection) Name() string {
+	return c.collection.Name()
+}
+
+func (c *mongoCollection) Database() IMongoDatabase {
+	return c.database
+}
+
+func (c *mongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) IMongoSingleResult {
+	return c.collection.FindOne(ctx, filter, opts...)
+}
+
+func (c *mongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (IMongoCursor, error) {
+	cursor, err := c.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoCursor{cursor: cursor}, nil
+}
+
+func (c *mongoCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return c.collection.CountDocuments(ctx, filter, opts...)
+}
+
+func (c *mongoCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return c.collection.InsertOne(ctx, document, opts...)
+}
+
+func (c *mongoCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return c.collection.InsertMany(ctx, documents, opts...)
+}
+
+func (c *mongoCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.collection.UpdateOne(ctx, filter, update, opts...)
+}
+
+func (c *mongoCollection) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	return c.collection.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (c *mongoCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.collection.DeleteOne(ctx, filter, opts...)
+}
+
+func (c *mongoCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.collection.DeleteMany(ctx, filter, opts...)
+}
+
+func (c *mongoCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	return c.collection.BulkWrite(ctx, models, opts...)
+}
+
+func (c *mongoCollection) Indexes() IMongoIndexView {
+	return &mongoIndexView{indexes: c.collection.Indexes()}
+}
+
+func (c *mongoCollection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (IMongoChangeStream, error) {
+	stream, err := c.collection.Watch(ctx, pipeline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// mongoIndexView adapts a mongo.IndexView to IMongoIndexView.
+type mongoIndexView struct {
+	indexes mongo.IndexView
+}
+
+func (v *mongoIndexView) CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error) {
+	return v.indexes.CreateOne(ctx, model, opts...)
+}
+
+func (v *mongoIndexView) List(ctx context.Context, opts ...*options.ListIndexesOptions) (IMongoCursor, error) {
+	cursor, err := v.indexes.List(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoCursor{cursor: cursor}, nil
+}
+
+// mongoCursor adapts a *mongo.Cursor to IMongoCursor.
+type mongoCursor struct {
+	cursor *mongo.Cursor
+}
+
+func (c *mongoCursor) Next(ctx context.Context) bool {
+	return c.cursor.Next(ctx)
+}
+
+func (c *mongoCursor) Decode(val interface{}) error {
+	return c.cursor.Decode(val)
+}
+
+func (c *mongoCursor) Current() bson.Raw {
+	return c.cursor.Current
+}
+
+func (c *mongoCursor) Err() error {
+	return c.cursor.Err()
+}
+
+func (c *mongoCursor) Close(ctx context.Context) error {
+	return c.cursor.Close(ctx)
+}
+
+func (c *mongoCursor) All(ctx context.Context, results interface{}) error {
+	return c.cursor.All(ctx, results)
+}
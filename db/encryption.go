@@ -0,0 +1,404 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/chuxorg/chux-datastore/encryption"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// WithFieldEncryption is a functional option that encrypts the string fields tagged datastore:"encrypt" with
+// AES-GCM before Upsert and Update, and decrypts them after GetByID, Query and GetAll. Fields tagged
+// datastore:"encrypt,deterministic" always encrypt to the same value under a given key, so Query can match
+// them by equality; Query encrypts the value it is given for such fields.
+//
+// Example:
+//
+//	type Customer struct {
+//		ID    primitive.ObjectID `bson:"_id,omitempty"`
+//		Name  string             `bson:"name" datastore:"encrypt"`
+//		Email string             `bson:"email" datastore:"encrypt,deterministic"`
+//	}
+//
+//	ring, err := encryption.NewKeyRing("k1", map[string][]byte{"k1": key})
+//	mongoDB := New(
+//		WithFieldEncryption(ring),
+//	)
+//	customers, err := mongoDB.Query(&Customer{}, "email", "jane@example.com")
+func WithFieldEncryption(provider encryption.IKeyProvider) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.encryptor = encryption.New(provider)
+	}
+}
+
+// encryptedField is a struct field tagged datastore:"encrypt".
+type encryptedField struct {
+	index         []int
+	path          string
+	deterministic bool
+}
+
+// encryptedFieldSet holds the encrypted fields of a struct type, or the reason the type cannot be encrypted.
+type encryptedFieldSet struct {
+	fields []encryptedField
+	err    error
+}
+
+// encryptedFieldCache caches the encryptedFieldSet of each document type.
+var encryptedFieldCache sync.Map
+
+// encryptedFields returns the encrypted fields of the struct type of doc.
+func encryptedFields(doc interface{}) ([]encryptedField, error) {
+	t := reflect.TypeOf(doc)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	if cached, ok := encryptedFieldCache.Load(t); ok {
+		set := cached.(encryptedFieldSet)
+		return set.fields, set.err
+	}
+	set := encryptedFieldSet{}
+	set.err = collectEncryptedFields(t, nil, "", &set.fields, map[reflect.Type]bool{})
+	encryptedFieldCache.Store(t, set)
+	return set.fields, set.err
+}
+
+func collectEncryptedFields(t reflect.Type, index []int, prefix string, fields *[]encryptedField, visiting map[reflect.Type]bool) error {
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, inline, skip := bsonFieldName(field)
+		if skip {
+			continue
+		}
+		path := name
+		if inline {
+			path = strings.TrimSuffix(prefix, ".")
+		} else if len(prefix) > 0 {
+			path = prefix + name
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		if tag, ok := field.Tag.Lookup("datastore"); ok {
+			options := strings.Split(tag, ",")
+			if options[0] == "encrypt" {
+				if field.Type.Kind() != reflect.String {
+					return fmt.Errorf("%s.%s is tagged datastore:\"encrypt\" but only string fields can be encrypted", t.Name(), field.Name)
+				}
+				deterministic := len(options) > 1 && options[1] == "deterministic"
+				*fields = append(*fields, encryptedField{index: fieldIndex, path: path, deterministic: deterministic})
+				continue
+			}
+		}
+
+		nested := field.Type
+		if nested.Kind() == reflect.Ptr {
+			nested = nested.Elem()
+		}
+		switch nested.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			// the elements of a container have no field index, their tagged fields would be written in plaintext
+			elem := nested.Elem()
+			if elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			if elem.Kind() != reflect.Struct {
+				continue
+			}
+			var elemFields []encryptedField
+			if err := collectEncryptedFields(elem, nil, "", &elemFields, visiting); err != nil {
+				return err
+			}
+			if len(elemFields) > 0 {
+				return fmt.Errorf("%s.%s holds %s values with fields tagged datastore:\"encrypt\" in a %s, which cannot be encrypted", t.Name(), field.Name, elem.Name(), nested.Kind())
+			}
+		case reflect.Struct:
+			nestedPrefix := path + "."
+			if inline {
+				nestedPrefix = prefix
+			}
+			if err := collectEncryptedFields(nested, fieldIndex, nestedPrefix, fields, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bsonFieldName returns the name the bson codec gives a struct field, and whether it is inlined or skipped.
+func bsonFieldName(field reflect.StructField) (name string, inline bool, skip bool) {
+	tag := field.Tag.Get("bson")
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	for _, option := range parts[1:] {
+		inline = inline || option == "inline"
+	}
+	if len(name) == 0 {
+		name = strings.ToLower(field.Name)
+	}
+	return name, inline, false
+}
+
+// fieldValue returns the settable string field of doc, or false when a nil pointer is on its path.
+func fieldValue(doc interface{}, index []int) (reflect.Value, bool) {
+	v := reflect.ValueOf(doc)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	f, err := v.FieldByIndexErr(index)
+	if err != nil || !f.CanSet() {
+		return reflect.Value{}, false
+	}
+	return f, true
+}
+
+// encryptFields encrypts the tagged fields of doc in place. The returned function puts the plaintext back;
+// it can be called more than once. Every non-empty value is encrypted, even one that looks like a
+// ciphertext: a field holds plaintext until this call encrypts it. Without WithFieldEncryption it does
+// nothing.
+func (m *MongoDB) encryptFields(ctx context.Context, doc IMongoDocument) (restore func(), err error) {
+	restore = func() {}
+	if m.encryptor == nil {
+		return restore, nil
+	}
+	fields, err := encryptedFields(doc)
+	if err != nil || len(fields) == 0 {
+		return restore, err
+	}
+
+	type original struct {
+		value     reflect.Value
+		plaintext string
+	}
+	var originals []original
+	restore = func() {
+		for _, o := range originals {
+			o.value.SetString(o.plaintext)
+		}
+		originals = nil
+	}
+	for _, field := range fields {
+		value, ok := fieldValue(doc, field.index)
+		if !ok {
+			continue
+		}
+		plaintext := value.String()
+		if len(plaintext) == 0 {
+			continue
+		}
+		ciphertext, err := m.encryptor.Encrypt(ctx, plaintext, field.deterministic)
+		if err != nil {
+			restore()
+			return func() {}, fmt.Errorf("encrypting %s: %w", field.path, err)
+		}
+		originals = append(originals, original{value: value, plaintext: plaintext})
+		value.SetString(ciphertext)
+	}
+	return restore, nil
+}
+
+// decryptFields decrypts the tagged fields of doc in place. Values that are not encrypted, such as
+// documents written before encryption was enabled, are left as they are.
+func (m *MongoDB) decryptFields(ctx context.Context, doc IMongoDocument) error {
+	if m.encryptor == nil {
+		return nil
+	}
+	fields, err := encryptedFields(doc)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		value, ok := fieldValue(doc, field.index)
+		if !ok || !encryption.IsEncrypted(value.String()) {
+			continue
+		}
+		plaintext, err := m.encryptor.Decrypt(ctx, value.String())
+		if err != nil {
+			return fmt.Errorf("decrypting %s: %w", field.path, err)
+		}
+		value.SetString(plaintext)
+	}
+	return nil
+}
+
+// encryptFilter replaces the values of encrypted fields in a query filter by their ciphertexts. Only
+// deterministic fields can be queried, and only by equality with a string.
+func (m *MongoDB) encryptFilter(ctx context.Context, doc IMongoDocument, filter bson.M) error {
+	if m.encryptor == nil {
+		return nil
+	}
+	fields, err := encryptedFields(doc)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		value, ok := filter[field.path]
+		if !ok {
+			continue
+		}
+		if !field.deterministic {
+			return fmt.Errorf("%s is encrypted with a random nonce and cannot be queried; tag it datastore:\"encrypt,deterministic\"", field.path)
+		}
+		plaintext, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s is encrypted and can only be queried by equality with a string, got %T", field.path, value)
+		}
+		if len(plaintext) == 0 {
+			// empty strings are stored as they are, see encryptFields
+			continue
+		}
+		ciphertexts, err := m.encryptor.EncryptForQuery(ctx, plaintext)
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", field.path, err)
+		}
+		if len(ciphertexts) == 1 {
+			filter[field.path] = ciphertexts[0]
+		} else {
+			filter[field.path] = bson.M{"$in": ciphertexts}
+		}
+	}
+	return nil
+}
+
+// encryptSet encrypts the values of a $set document that target encrypted fields of doc. As in
+// encryptFields, the values are plaintext.
+func (m *MongoDB) encryptSet(ctx context.Context, doc IMongoDocument, set bson.D) error {
+	if m.encryptor == nil {
+		return nil
+	}
+	fields, err := encryptedFields(doc)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	for i, e := range set {
+		for _, field := range fields {
+			if strings.HasPrefix(field.path, e.Key+".") {
+				// the whole subdocument holding the field is set
+				value, err := m.encryptSubdocument(ctx, e.Value, strings.Split(strings.TrimPrefix(field.path, e.Key+"."), "."), field)
+				if err != nil {
+					return err
+				}
+				set[i].Value = value
+				e.Value = value
+				continue
+			}
+			if field.path != e.Key {
+				continue
+			}
+			plaintext, ok := e.Value.(string)
+			if raw, isRaw := e.Value.(bson.RawValue); isRaw {
+				plaintext, ok = raw.StringValueOK()
+			}
+			if !ok {
+				return fmt.Errorf("%s is encrypted and can only be set to a string, got %T", field.path, e.Value)
+			}
+			if len(plaintext) == 0 {
+				continue
+			}
+			ciphertext, err := m.encryptor.Encrypt(ctx, plaintext, field.deterministic)
+			if err != nil {
+				return fmt.Errorf("encrypting %s: %w", field.path, err)
+			}
+			set[i].Value = ciphertext
+		}
+	}
+	return nil
+}
+
+// encryptSubdocument returns value, the subdocument of a $set, as a bson.D with the string at the path parts
+// encrypted for field. A nil value or a subdocument without the field is returned as it is.
+func (m *MongoDB) encryptSubdocument(ctx context.Context, value interface{}, parts []string, field encryptedField) (interface{}, error) {
+	d, ok := subdocument(value)
+	if !ok {
+		return value, nil
+	}
+	for i, e := range d {
+		if e.Key != parts[0] {
+			continue
+		}
+		if len(parts) > 1 {
+			nested, err := m.encryptSubdocument(ctx, e.Value, parts[1:], field)
+			if err != nil {
+				return nil, err
+			}
+			d[i].Value = nested
+			return d, nil
+		}
+		plaintext, ok := e.Value.(string)
+		if !ok {
+			if e.Value == nil {
+				return d, nil
+			}
+			return nil, fmt.Errorf("%s is encrypted and can only be set to a string, got %T", field.path, e.Value)
+		}
+		if len(plaintext) == 0 {
+			return d, nil
+		}
+		ciphertext, err := m.encryptor.Encrypt(ctx, plaintext, field.deterministic)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting %s: %w", field.path, err)
+		}
+		d[i].Value = ciphertext
+		return d, nil
+	}
+	return d, nil
+}
+
+// subdocument converts a struct, map, bson.D or embedded document bson.RawValue to a bson.D copy.
+func subdocument(value interface{}) (bson.D, bool) {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case bson.D:
+		data, _ = bson.Marshal(v)
+	case bson.RawValue:
+		if v.Type != bsontype.EmbeddedDocument {
+			return nil, false
+		}
+		data = v.Value
+	default:
+		rv := reflect.ValueOf(value)
+		for rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return nil, false
+			}
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map {
+			return nil, false
+		}
+		var err error
+		if data, err = bson.Marshal(value); err != nil {
+			return nil, false
+		}
+	}
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, false
+	}
+	return d, true
+}
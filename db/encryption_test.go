@@ -0,0 +1,343 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/encryption"
+	"github.com/chuxorg/chux-datastore/mongofake"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Patient is the document of the encryption tests.
+type Patient struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Name  string             `bson:"name" datastore:"encrypt"`
+	SSN   string             `bson:"ssn" datastore:"encrypt,deterministic"`
+	Notes string             `bson:"notes"`
+}
+
+func (p *Patient) GetCollectionName() string   { return "patients" }
+func (p *Patient) GetDatabaseName() string     { return "test" }
+func (p *Patient) GetURI() string              { return "" }
+func (p *Patient) GetID() primitive.ObjectID   { return p.ID }
+func (p *Patient) SetID(id primitive.ObjectID) { p.ID = id }
+
+func newKeyRing(t *testing.T) *encryption.KeyRing {
+	t.Helper()
+	ring, err := encryption.NewKeyRing("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestUpsertMatchesEncryptedFilterFieldsAfterKeyRotation(t *testing.T) {
+	ring := newKeyRing(t)
+	mongoDB := newFakeDB(db.WithFieldEncryption(ring))
+
+	if err := mongoDB.Upsert(&Patient{Name: "Jane", SSN: "123-45-6789", Notes: "first"}, "ssn"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mongoDB.Upsert(&Patient{Name: "Jane", SSN: "123-45-6789", Notes: "second"}, "ssn"); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := mongoDB.GetAll(&Patient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("got %d documents, want 1", len(docs))
+	}
+	if p := docs[0].(*Patient); p.Notes != "second" || p.SSN != "123-45-6789" {
+		t.Errorf("got %+v, want the second upsert", p)
+	}
+}
+
+func TestUpsertRejectsRandomEncryptedFilterFields(t *testing.T) {
+	mongoDB := newFakeDB(db.WithFieldEncryption(newKeyRing(t)))
+
+	err := mongoDB.Upsert(&Patient{Name: "Jane", SSN: "123-45-6789"}, "name")
+	if err == nil {
+		t.Fatal("Upsert() with a random encrypted filter field succeeded")
+	}
+	docs, err := mongoDB.GetAll(&Patient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("got %d documents, want none", len(docs))
+	}
+}
+
+// storedPatient reads the patients as they are stored, without decrypting them.
+type storedPatient struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Name  string             `bson:"name"`
+	SSN   string             `bson:"ssn"`
+	Notes string             `bson:"notes"`
+}
+
+func (p *storedPatient) GetCollectionName() string   { return "patients" }
+func (p *storedPatient) GetDatabaseName() string     { return "test" }
+func (p *storedPatient) GetURI() string              { return "" }
+func (p *storedPatient) GetID() primitive.ObjectID   { return p.ID }
+func (p *storedPatient) SetID(id primitive.ObjectID) { p.ID = id }
+
+func stored(t *testing.T, client *mongofake.Client, id primitive.ObjectID) *storedPatient {
+	t.Helper()
+	found, err := newFakeDB(db.WithClient(client)).GetByID(&storedPatient{}, id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found.(*storedPatient)
+}
+
+func TestEncryptedFieldsAreStoredEncryptedAndReadDecrypted(t *testing.T) {
+	client := mongofake.NewClient()
+	mongoDB := newFakeDB(db.WithClient(client), db.WithFieldEncryption(newKeyRing(t)))
+
+	patient := &Patient{Name: "Jane", SSN: "123-45-6789", Notes: "allergic"}
+	if err := mongoDB.Upsert(patient); err != nil {
+		t.Fatal(err)
+	}
+	if patient.Name != "Jane" || patient.SSN != "123-45-6789" {
+		t.Errorf("Upsert() left the document encrypted: %+v", patient)
+	}
+
+	raw := stored(t, client, patient.ID)
+	for field, value := range map[string]string{"name": raw.Name, "ssn": raw.SSN} {
+		if !strings.HasPrefix(value, encryption.Prefix) {
+			t.Errorf("%s is stored as %q, want a ciphertext", field, value)
+		}
+	}
+	if raw.Notes != "allergic" {
+		t.Errorf("notes is stored as %q, want the plaintext", raw.Notes)
+	}
+
+	found, err := mongoDB.GetByID(&Patient{}, patient.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := found.(*Patient); p.Name != "Jane" || p.SSN != "123-45-6789" {
+		t.Errorf("GetByID() = %+v, want the plaintext", p)
+	}
+}
+
+func TestEncryptedFieldsDecryptAfterKeyRotation(t *testing.T) {
+	ring := newKeyRing(t)
+	mongoDB := newFakeDB(db.WithFieldEncryption(ring))
+
+	if err := mongoDB.Upsert(&Patient{Name: "Jane", SSN: "111-11-1111"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mongoDB.Upsert(&Patient{Name: "John", SSN: "222-22-2222"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ssn  string
+		name string
+	}{
+		{ssn: "111-11-1111", name: "Jane"},
+		{ssn: "222-22-2222", name: "John"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ssn, func(t *testing.T) {
+			docs, err := mongoDB.Query(&Patient{}, "ssn", tt.ssn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != 1 {
+				t.Fatalf("Query() found %d documents, want 1", len(docs))
+			}
+			if p := docs[0].(*Patient); p.Name != tt.name {
+				t.Errorf("Query() = %+v, want %s", p, tt.name)
+			}
+		})
+	}
+}
+
+func TestPlaintextWithTheCiphertextPrefixIsEncrypted(t *testing.T) {
+	plaintext := encryption.Prefix + "not a ciphertext"
+	tests := []struct {
+		name  string
+		write func(*db.MongoDB, *Patient) error
+	}{
+		{
+			name: "Upsert",
+			write: func(mongoDB *db.MongoDB, p *Patient) error {
+				p.Name = plaintext
+				return mongoDB.Upsert(p)
+			},
+		},
+		{
+			name: "Update",
+			write: func(mongoDB *db.MongoDB, p *Patient) error {
+				p.Name = plaintext
+				return mongoDB.Update(p, p.ID.Hex())
+			},
+		},
+		{
+			name: "UpdateFields",
+			write: func(mongoDB *db.MongoDB, p *Patient) error {
+				_, err := mongoDB.UpdateFields(&Patient{}, p.ID.Hex(), db.NewUpdate().Set("name", plaintext))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongofake.NewClient()
+			mongoDB := newFakeDB(db.WithClient(client), db.WithFieldEncryption(newKeyRing(t)))
+			patient := &Patient{Name: "Jane"}
+			if err := mongoDB.Upsert(patient); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.write(mongoDB, patient); err != nil {
+				t.Fatal(err)
+			}
+			if raw := stored(t, client, patient.ID); raw.Name == plaintext {
+				t.Errorf("name is stored as the plaintext %q", raw.Name)
+			}
+			found, err := mongoDB.GetByID(&Patient{}, patient.ID.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := found.(*Patient); p.Name != plaintext {
+				t.Errorf("GetByID() name = %q, want %q", p.Name, plaintext)
+			}
+		})
+	}
+}
+
+// Contact is a subdocument with an encrypted field.
+type Contact struct {
+	Email string `bson:"email" datastore:"encrypt"`
+	Phone string `bson:"phone"`
+}
+
+// Customer is a tracked document with an encrypted field in a subdocument.
+type Customer struct {
+	db.ChangeTracker `bson:"-"`
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	Name             string             `bson:"name"`
+	Contact          *Contact           `bson:"contact,omitempty"`
+}
+
+func (c *Customer) GetCollectionName() string   { return "customers" }
+func (c *Customer) GetDatabaseName() string     { return "test" }
+func (c *Customer) GetURI() string              { return "" }
+func (c *Customer) GetID() primitive.ObjectID   { return c.ID }
+func (c *Customer) SetID(id primitive.ObjectID) { c.ID = id }
+
+// storedEmail returns the contact email of a customer as it is stored.
+func storedEmail(t *testing.T, client *mongofake.Client, id primitive.ObjectID) string {
+	t.Helper()
+	var raw struct {
+		Contact struct {
+			Email string `bson:"email"`
+		} `bson:"contact"`
+	}
+	err := client.Database("test").Collection("customers").FindOne(context.Background(), bson.M{"_id": id}).Decode(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw.Contact.Email
+}
+
+func TestSettingASubdocumentEncryptsItsFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(*db.MongoDB, *Customer) error
+	}{
+		{
+			name: "UpdateFields with a struct",
+			write: func(mongoDB *db.MongoDB, c *Customer) error {
+				_, err := mongoDB.UpdateFields(&Customer{}, c.ID.Hex(), db.NewUpdate().Set("contact", Contact{Email: "nested@x", Phone: "555"}))
+				return err
+			},
+		},
+		{
+			name: "UpdateFields with a bson.M",
+			write: func(mongoDB *db.MongoDB, c *Customer) error {
+				_, err := mongoDB.UpdateFields(&Customer{}, c.ID.Hex(), db.NewUpdate().Set("contact", bson.M{"email": "nested@x", "phone": "555"}))
+				return err
+			},
+		},
+		{
+			name: "tracked Update setting the subdocument",
+			write: func(mongoDB *db.MongoDB, c *Customer) error {
+				if _, err := mongoDB.GetByID(c, c.ID.Hex()); err != nil {
+					return err
+				}
+				c.Contact = &Contact{Email: "nested@x", Phone: "555"}
+				return mongoDB.Update(c, c.ID.Hex())
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongofake.NewClient()
+			mongoDB := newFakeDB(db.WithClient(client), db.WithFieldEncryption(newKeyRing(t)))
+			customer := &Customer{Name: "Jane"}
+			if err := mongoDB.Upsert(customer); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.write(mongoDB, customer); err != nil {
+				t.Fatal(err)
+			}
+			if email := storedEmail(t, client, customer.ID); !strings.HasPrefix(email, encryption.Prefix) {
+				t.Errorf("contact.email is stored as %q, want a ciphertext", email)
+			}
+			found, err := mongoDB.GetByID(&Customer{}, customer.ID.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := found.(*Customer); c.Contact == nil || c.Contact.Email != "nested@x" || c.Contact.Phone != "555" {
+				t.Errorf("GetByID() contact = %+v, want the plaintext", c.Contact)
+			}
+		})
+	}
+}
+
+// Account holds encrypted fields in a slice, which cannot be encrypted.
+type Account struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Contacts []Contact          `bson:"contacts"`
+}
+
+func (a *Account) GetCollectionName() string   { return "accounts" }
+func (a *Account) GetDatabaseName() string     { return "test" }
+func (a *Account) GetURI() string              { return "" }
+func (a *Account) GetID() primitive.ObjectID   { return a.ID }
+func (a *Account) SetID(id primitive.ObjectID) { a.ID = id }
+
+func TestEncryptedFieldsInAContainerAreRejected(t *testing.T) {
+	client := mongofake.NewClient()
+	mongoDB := newFakeDB(db.WithClient(client), db.WithFieldEncryption(newKeyRing(t)))
+
+	if err := mongoDB.Upsert(&Account{Contacts: []Contact{{Email: "slice@x"}}}); err == nil {
+		t.Error("Upsert() of encrypted fields in a slice succeeded")
+	}
+	n, err := client.Database("test").Collection("accounts").CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d documents were written, want none", n)
+	}
+}
@@ -0,0 +1,37 @@
+package db_test
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/mongofake"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newFakeDB returns a MongoDB on an empty in-memory fake, with the database "test", the collection
+// "people" and a logger that discards its output.
+func newFakeDB(options ...func(*db.MongoDB)) *db.MongoDB {
+	options = append([]func(*db.MongoDB){
+		db.WithClient(mongofake.NewClient()),
+		db.WithDatabaseName("test"),
+		db.WithCollectionName("people"),
+		db.WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	}, options...)
+	return db.New(options...)
+}
+
+// Person is the document of the tests.
+type Person struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Name     string             `bson:"name"`
+	Email    string             `bson:"email"`
+	Age      int                `bson:"age"`
+	TenantID string             `bson:"tenantId"`
+}
+
+func (p *Person) GetCollectionName() string   { return "people" }
+func (p *Person) GetDatabaseName() string     { return "test" }
+func (p *Person) GetURI() string              { return "" }
+func (p *Person) GetID() primitive.ObjectID   { return p.ID }
+func (p *Person) SetID(id primitive.ObjectID) { p.ID = id }
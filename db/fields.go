@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// bsonFieldIndex returns the index and type of the struct field of t whose bson name is path. Nested fields
+// use dotted paths such as "address.city"; fields of inline structs are found by their own name.
+func bsonFieldIndex(t reflect.Type, path string) ([]int, reflect.Type, error) {
+	var index []int
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, nil, fmt.Errorf("unknown field: %s", path)
+		}
+		fieldIndex, field, ok := findBSONField(t, name)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown field: %s", path)
+		}
+		index = append(index, fieldIndex...)
+		t = field.Type
+	}
+	return index, t, nil
+}
+
+// findBSONField returns the exported field of struct type t named name by the bson codec.
+func findBSONField(t reflect.Type, name string) ([]int, reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldName, inline, skip := bsonFieldName(field)
+		if skip {
+			continue
+		}
+		if inline {
+			inlined := field.Type
+			if inlined.Kind() == reflect.Ptr {
+				inlined = inlined.Elem()
+			}
+			if inlined.Kind() == reflect.Struct {
+				if index, found, ok := findBSONField(inlined, name); ok {
+					return append([]int{i}, index...), found, true
+				}
+			}
+			continue
+		}
+		if fieldName == name {
+			return []int{i}, field, true
+		}
+	}
+	return nil, reflect.StructField{}, false
+}
+
+// settableField returns the field of struct value v at index, allocating the nil pointers on its path.
+func settableField(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					v.Set(reflect.New(v.Type().Elem()))
+				}
+				v = v.Elem()
+			}
+		}
+		v = v.Field(x)
+	}
+	return v
+}
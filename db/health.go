@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"github.com/chuxorg/chux-datastore/redact"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// HealthStatus is the result of MongoDB.Health.
+type HealthStatus struct {
+	// Healthy is true when the server answered a ping.
+	Healthy bool `json:"healthy"`
+	// Ready is true when the primary is reachable and the circuit breaker, if any, is not open.
+	Ready bool `json:"ready"`
+	// PingLatency is the round trip time of the ping, in nanoseconds when marshaled to JSON.
+	PingLatency   time.Duration `json:"pingLatency"`
+	ServerVersion string        `json:"serverVersion,omitempty"`
+	// ReplicaSet is nil when the server is not a member of a replica set.
+	ReplicaSet       *ReplicaSetStatus `json:"replicaSet,omitempty"`
+	PrimaryReachable bool              `json:"primaryReachable"`
+	Pool             PoolStats         `json:"pool"`
+	// CircuitState is empty when no circuit breaker is configured.
+	CircuitState string    `json:"circuitState,omitempty"`
+	Errors       []string  `json:"errors,omitempty"`
+	CheckedAt    time.Time `json:"checkedAt"`
+}
+
+// ReplicaSetStatus is the replica set topology as seen by the server that answered the health check.
+type ReplicaSetStatus struct {
+	Name              string   `json:"name"`
+	Primary           string   `json:"primary,omitempty"`
+	Me                string   `json:"me,omitempty"`
+	Hosts             []string `json:"hosts,omitempty"`
+	IsWritablePrimary bool     `json:"isWritablePrimary"`
+	Secondary         bool     `json:"secondary"`
+}
+
+// PoolStats are the connection pool counters of the client, summed over all servers.
+type PoolStats struct {
+	Open           int64 `json:"open"`
+	InUse          int64 `json:"inUse"`
+	CheckOutFailed int64 `json:"checkOutFailed"`
+	Cleared        int64 `json:"cleared"`
+}
+
+// poolStats is updated from the driver's pool events.
+type poolStats struct {
+	open           int64
+	inUse          int64
+	checkOutFailed int64
+	cleared        int64
+}
+
+func (p *poolStats) event(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		atomic.AddInt64(&p.open, 1)
+	case event.ConnectionClosed:
+		atomic.AddInt64(&p.open, -1)
+	case event.GetSucceeded:
+		atomic.AddInt64(&p.inUse, 1)
+	case event.ConnectionReturned:
+		atomic.AddInt64(&p.inUse, -1)
+	case event.GetFailed:
+		atomic.AddInt64(&p.checkOutFailed, 1)
+	case event.PoolCleared:
+		atomic.AddInt64(&p.cleared, 1)
+	}
+}
+
+func (p *poolStats) snapshot() PoolStats {
+	return PoolStats{
+		Open:           atomic.LoadInt64(&p.open),
+		InUse:          atomic.LoadInt64(&p.inUse),
+		CheckOutFailed: atomic.LoadInt64(&p.checkOutFailed),
+		Cleared:        atomic.LoadInt64(&p.cleared),
+	}
+}
+
+// clientPoolMonitor returns the pool monitor of a new client. It keeps the client's pool statistics and,
+// when WithMetrics is used, the pool gauges up to date.
+func (m *MongoDB) clientPoolMonitor(pool *poolStats) *event.PoolMonitor {
+	observe := m.metrics.poolObserver()
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			pool.event(e)
+			observe(e)
+		},
+	}
+}
+
+// Ping checks that the server is reachable using the primary preferred read preference.
+func (m *MongoDB) Ping(ctx context.Context) error {
+	client, err := m.Client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := m.healthContext(ctx)
+	defer cancel()
+	if err := client.Ping(ctx, readpref.PrimaryPreferred()); err != nil {
+		m.Logger.ErrorContext(ctx, "MongoDB.Ping() Failed to ping the server", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Ping() Failed to ping the server. Check the inner error.", 1200, err)
+	}
+	return nil
+}
+
+// Health checks the server and returns a structured status with the ping latency, the server version,
+// the replica set state, whether the primary is reachable and the connection pool statistics.
+// Health is not subject to retries or the circuit breaker, so it always reports what the server says.
+// Example:
+//
+//	status := mongoDB.Health(ctx)
+//	if !status.Ready {
+//		log.Printf("datastore not ready: %v", status.Errors)
+//	}
+func (m *MongoDB) Health(ctx context.Context) HealthStatus {
+	logging := m.Logger
+	status := HealthStatus{CheckedAt: time.Now().UTC()}
+	if m.breaker != nil {
+		status.CircuitState = m.breaker.State().String()
+	}
+
+	// the pool statistics are only known for the driver client
+	client := m._client
+	if client == nil {
+		entry, err := m.connect()
+		if err != nil {
+			status.Errors = append(status.Errors, err.Error())
+			logging.ErrorContext(ctx, "MongoDB.Health() Failed to connect", "error", err)
+			return status
+		}
+		status.Pool = entry.pool.snapshot()
+		client = WrapClient(entry.client)
+	}
+
+	ctx, cancel := m.healthContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := client.Ping(ctx, readpref.PrimaryPreferred())
+	status.PingLatency = time.Since(start)
+	if err != nil {
+		status.Errors = append(status.Errors, "ping: "+redact.String(err.Error()))
+		logging.ErrorContext(ctx, "MongoDB.Health() Failed to ping the server", "error", err)
+		return status
+	}
+	status.Healthy = true
+
+	admin := client.Database("admin")
+	var buildInfo struct {
+		Version string `bson:"version"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&buildInfo); err != nil {
+		status.Errors = append(status.Errors, "buildInfo: "+redact.String(err.Error()))
+	}
+	status.ServerVersion = buildInfo.Version
+
+	var hello struct {
+		SetName           string   `bson:"setName"`
+		Primary           string   `bson:"primary"`
+		Me                string   `bson:"me"`
+		Hosts             []string `bson:"hosts"`
+		IsWritablePrimary bool     `bson:"isWritablePrimary"`
+		IsMaster          bool     `bson:"ismaster"`
+		Secondary         bool     `bson:"secondary"`
+	}
+	err = admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		// servers older than 4.4.2 only know the legacy command
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	}
+	if err != nil {
+		status.Errors = append(status.Errors, "hello: "+redact.String(err.Error()))
+	} else if len(hello.SetName) > 0 {
+		status.ReplicaSet = &ReplicaSetStatus{
+			Name:              hello.SetName,
+			Primary:           hello.Primary,
+			Me:                hello.Me,
+			Hosts:             hello.Hosts,
+			IsWritablePrimary: hello.IsWritablePrimary || hello.IsMaster,
+			Secondary:         hello.Secondary,
+		}
+	}
+
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		status.Errors = append(status.Errors, "primary: "+redact.String(err.Error()))
+		logging.WarningContext(ctx, "MongoDB.Health() The primary is not reachable", "error", err)
+	} else {
+		status.PrimaryReachable = true
+	}
+
+	status.Ready = status.PrimaryReachable && status.CircuitState != CircuitOpen.String()
+	return status
+}
+
+// healthContext bounds a health check by the configured Timeout when ctx has no deadline of its own.
+func (m *MongoDB) healthContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = m.context()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+}
+
+// HealthHandler returns an http.Handler that can be mounted as a liveness probe such as /healthz.
+// It responds with the HealthStatus as JSON and status 200 when the server answers a ping, 503 otherwise.
+//
+// Example:
+//
+//	http.Handle("/healthz", mongoDB.HealthHandler())
+//	http.Handle("/readyz", mongoDB.ReadinessHandler())
+func (m *MongoDB) HealthHandler() http.Handler {
+	return m.healthHandler(func(s HealthStatus) bool { return s.Healthy })
+}
+
+// ReadinessHandler returns an http.Handler that can be mounted as a readiness probe such as /readyz.
+// It responds with the HealthStatus as JSON and status 200 when the primary is reachable and the circuit
+// breaker is not open, 503 otherwise.
+func (m *MongoDB) ReadinessHandler() http.Handler {
+	return m.healthHandler(func(s HealthStatus) bool { return s.Ready })
+}
+
+func (m *MongoDB) healthHandler(ok func(HealthStatus) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := m.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if ok(status) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
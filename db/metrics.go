@@ -0,0 +1,149 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/metrics"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// WithMetrics is a functional option that records operation and connection pool metrics in the given registry.
+// The following metrics are recorded:
+//
+//	chux_datastore_operations_total{operation,collection,status}        counter
+//	chux_datastore_operation_duration_seconds{operation,collection}     histogram
+//	chux_datastore_pool_connections{address}                            gauge
+//	chux_datastore_pool_connections_in_use{address}                     gauge
+//	chux_datastore_pool_max_connections{address}                        gauge
+//	chux_datastore_pool_events_total{address,event}                     counter
+//	chux_datastore_cache_requests_total{collection,result}              counter
+//
+// status is "ok" for a successful operation, otherwise one of "circuit_open", "not_found", "duplicate_key",
+// "timeout", "network" or "error". result is "hit" or "miss" for the lookups of WithCache. Several MongoDB
+// instances can share a registry.
+//
+// Example:
+//
+//	registry := metrics.NewRegistry()
+//	mongoDB := New(
+//		WithMetrics(registry),
+//	)
+//	http.Handle("/metrics", registry)
+func WithMetrics(registry *metrics.Registry) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.metrics = newDatastoreMetrics(registry)
+	}
+}
+
+// datastoreMetrics holds the metric families recorded by a MongoDB. A nil *datastoreMetrics records nothing.
+type datastoreMetrics struct {
+	operations      *metrics.CounterVec
+	latency         *metrics.HistogramVec
+	poolConnections *metrics.GaugeVec
+	poolInUse       *metrics.GaugeVec
+	poolMax         *metrics.GaugeVec
+	poolEvents      *metrics.CounterVec
+	cacheRequests   *metrics.CounterVec
+}
+
+func newDatastoreMetrics(registry *metrics.Registry) *datastoreMetrics {
+	return &datastoreMetrics{
+		operations: registry.NewCounterVec(
+			"chux_datastore_operations_total",
+			"Number of datastore operations by operation, collection and status.",
+			"operation", "collection", "status"),
+		latency: registry.NewHistogramVec(
+			"chux_datastore_operation_duration_seconds",
+			"Duration of datastore operations in seconds.",
+			metrics.DefaultBuckets,
+			"operation", "collection"),
+		poolConnections: registry.NewGaugeVec(
+			"chux_datastore_pool_connections",
+			"Number of open connections in the connection pool.",
+			"address"),
+		poolInUse: registry.NewGaugeVec(
+			"chux_datastore_pool_connections_in_use",
+			"Number of connections checked out of the connection pool.",
+			"address"),
+		poolMax: registry.NewGaugeVec(
+			"chux_datastore_pool_max_connections",
+			"Maximum size of the connection pool.",
+			"address"),
+		poolEvents: registry.NewCounterVec(
+			"chux_datastore_pool_events_total",
+			"Number of connection pool events by type.",
+			"address", "event"),
+		cacheRequests: registry.NewCounterVec(
+			"chux_datastore_cache_requests_total",
+			"Number of cache lookups by collection and result.",
+			"collection", "result"),
+	}
+}
+
+func (d *datastoreMetrics) observeOperation(op, collection string, duration time.Duration, err error) {
+	if d == nil {
+		return
+	}
+	d.operations.WithLabelValues(op, collection, errorClass(err)).Inc()
+	d.latency.WithLabelValues(op, collection).Observe(duration.Seconds())
+}
+
+func (d *datastoreMetrics) observeCache(collection string, hit bool) {
+	if d == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	d.cacheRequests.WithLabelValues(collection, result).Inc()
+}
+
+// poolObserver returns the function that keeps the pool gauges up to date with the pool events of one
+// client. Clients connected to the same server add to the gauges of the same address, so a client whose
+// pool is closed only takes its own connections off them.
+func (d *datastoreMetrics) poolObserver() func(e *event.PoolEvent) {
+	if d == nil {
+		return func(*event.PoolEvent) {}
+	}
+	type counts struct {
+		open  float64
+		inUse float64
+	}
+	var mu sync.Mutex
+	pools := map[string]*counts{}
+	return func(e *event.PoolEvent) {
+		d.poolEvents.WithLabelValues(e.Address, e.Type).Inc()
+		mu.Lock()
+		defer mu.Unlock()
+		pool, ok := pools[e.Address]
+		if !ok {
+			pool = &counts{}
+			pools[e.Address] = pool
+		}
+		switch e.Type {
+		case event.PoolCreated:
+			if e.PoolOptions != nil {
+				d.poolMax.WithLabelValues(e.Address).Set(float64(e.PoolOptions.MaxPoolSize))
+			}
+		case event.ConnectionCreated:
+			pool.open++
+			d.poolConnections.WithLabelValues(e.Address).Inc()
+		case event.ConnectionClosed:
+			pool.open--
+			d.poolConnections.WithLabelValues(e.Address).Dec()
+		case event.GetSucceeded:
+			pool.inUse++
+			d.poolInUse.WithLabelValues(e.Address).Inc()
+		case event.ConnectionReturned:
+			pool.inUse--
+			d.poolInUse.WithLabelValues(e.Address).Dec()
+		case event.PoolClosedEvent:
+			d.poolConnections.WithLabelValues(e.Address).Add(-pool.open)
+			d.poolInUse.WithLabelValues(e.Address).Add(-pool.inUse)
+			delete(pools, e.Address)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/metrics"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func TestPoolGaugesOfClientsSharingAnAddress(t *testing.T) {
+	d := newDatastoreMetrics(metrics.NewRegistry())
+	first, second := d.poolObserver(), d.poolObserver()
+	const address = "db:27017"
+
+	events := []struct {
+		observe func(*event.PoolEvent)
+		typ     string
+	}{
+		{first, event.ConnectionCreated},
+		{first, event.ConnectionCreated},
+		{first, event.GetSucceeded},
+		{second, event.ConnectionCreated},
+		{second, event.GetSucceeded},
+		{second, event.GetSucceeded},
+		{second, event.ConnectionReturned},
+		{first, event.PoolClosedEvent},
+	}
+	for _, e := range events {
+		e.observe(&event.PoolEvent{Type: e.typ, Address: address})
+	}
+
+	if got := d.poolConnections.WithLabelValues(address).Value(); got != 1 {
+		t.Errorf("pool connections = %v, want the 1 of the open client", got)
+	}
+	if got := d.poolInUse.WithLabelValues(address).Value(); got != 1 {
+		t.Errorf("pool connections in use = %v, want the 1 of the open client", got)
+	}
+
+	second(&event.PoolEvent{Type: event.PoolClosedEvent, Address: address})
+	if got := d.poolConnections.WithLabelValues(address).Value(); got != 0 {
+		t.Errorf("pool connections = %v after every pool is closed, want 0", got)
+	}
+}
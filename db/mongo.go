@@ -4,14 +4,18 @@ package db
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"reflect"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/chuxorg/chux-datastore/encryption"
 	"github.com/chuxorg/chux-datastore/errors"
 	"github.com/chuxorg/chux-datastore/logging"
+	"github.com/chuxorg/chux-datastore/redact"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -52,7 +56,7 @@ type IMongoDocument interface {
 type IMongoClientMethods interface {
 	Connect(ctx context.Context) error
 	Disconnect(ctx context.Context) error
-	Database(name string) *mongo.Database
+	Database(name string, opts ...*options.DatabaseOptions) IMongoDatabase
 	Ping(ctx context.Context, rp *readpref.ReadPref) error
 }
 
@@ -61,15 +65,20 @@ type IMongoClient interface {
 	IMongoClientMethods
 }
 
+// IMongoDB is the document API of MongoDB. Code that depends on it rather than on *MongoDB can be given a
+// wrapper such as the recorder of the recorder package or the fault injector of the faults package.
+//
 //go:generate mockery --name MongoDB
 type IMongoDB interface {
-	Connect() (*mongo.Client, error)
-	Create(doc IMongoDocument, id string) error
-	Delete(doc IMongoDocument) error
-	GetByID(doc IMongoDocument, id string) error
+	Upsert(doc IMongoDocument, filterFields ...string) error
+	GetByID(doc IMongoDocument, id string) (interface{}, error)
+	Query(doc IMongoDocument, queries ...interface{}) ([]IMongoDocument, error)
 	GetAll(doc IMongoDocument) ([]IMongoDocument, error)
 	Update(doc IMongoDocument, id string) error
-	CreateIndicies(fieldNames ...interface{}) (bool, error)
+	UpdateFields(doc IMongoDocument, id string, update *UpdateBuilder) (*UpdateResult, error)
+	Delete(doc IMongoDocument, id string) error
+	DeleteAll(doc IMongoDocument) (int64, error)
+	CreateIndices(doc IMongoDocument, fieldNames ...string) (bool, error)
 }
 
 // The MongoDB struct is used to store the MongoDB configuration
@@ -81,10 +90,51 @@ type MongoDB struct {
 	Timeout        float64
 	_client        IMongoClient
 	Logger         *logging.Logger
+	ctx            context.Context
+	// commandMonitor records commands for WithCommandMonitoring
+	commandMonitor *commandMonitor
+	// commandMonitors are the driver monitors added with WithCommandMonitor
+	commandMonitors []*event.CommandMonitor
+	// metrics records operation and pool metrics for WithMetrics
+	metrics *datastoreMetrics
+	// tracer starts operation and command spans for WithTracerProvider
+	tracer *datastoreTracer
+	// retryPolicy is set by WithRetryPolicy. The zero value does not retry.
+	retryPolicy RetryPolicy
+	// breaker is set by WithCircuitBreaker
+	breaker *CircuitBreaker
+	// settings are the client options set by WithMaxPoolSize, WithTLS and the other client options
+	settings clientSettings
+	// concerns are the defaults set by WithReadPreference, WithReadConcern and WithWriteConcern
+	concerns concerns
+	// callConcerns are set by WithCallOptions
+	callConcerns concerns
+	// changeHooks receive the change sets of tracked documents
+	changeHooks []ChangeHook
+	// encryptor encrypts the fields tagged datastore:"encrypt" for WithFieldEncryption
+	encryptor *encryption.Encryptor
+	// tenancy is set by WithTenantDatabases or WithTenantField
+	tenancy *tenancy
+	// tenantResolver is set by WithTenantResolver
+	tenantResolver ITenantResolver
+	// cache is set by WithCache
+	cache *documentCache
+	// flights merges concurrent identical reads for WithRequestCoalescing
+	flights *flightGroup
 }
 
-// The _client variable is used to store the MongoDB client
-var _client *mongo.Client
+// The _clients map is used to store the MongoDB clients. A client is shared by every MongoDB
+// with the same client configuration. See clientKey.
+var (
+	_clients   = map[string]*clientEntry{}
+	_clientsMu sync.Mutex
+)
+
+// clientEntry is a cached client together with the statistics of its connection pool.
+type clientEntry struct {
+	client *mongo.Client
+	pool   *poolStats
+}
 
 // The New func constructs the MongoDB struct with the given options.
 // Example:
@@ -105,6 +155,18 @@ func New(options ...func(*MongoDB)) *MongoDB {
 	return mdb
 }
 
+// WithLogger is a functional option that sets the Logger used by MongoDB. It still takes a logging.Logger
+// by value, so existing callers keep compiling. A slog.Handler is set with WithLogHandler, and zap and
+// zerolog loggers with the NewLogger functions of the zapadapter and zerologadapter packages.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithLogger(*logging.NewJSONLogger(os.Stdout, logging.LogLevelInfo)),
+//	)
+//	mongoDB := New(
+//		WithLogger(*zapadapter.NewLogger(z)),
+//	)
 func WithLogger(logger logging.Logger) func(*MongoDB) {
 
 	return func(s *MongoDB) {
@@ -112,6 +174,21 @@ func WithLogger(logger logging.Logger) func(*MongoDB) {
 	}
 }
 
+// WithLogHandler is a functional option that sets a Logger writing to the given slog.Handler.
+// The zapadapter and zerologadapter packages provide handlers for zap and zerolog loggers.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithLogHandler(slog.NewJSONHandler(os.Stderr, nil)),
+//	)
+func WithLogHandler(handler slog.Handler) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.Logger = logging.New(handler)
+	}
+}
+
 // WithURI is a functional option that sets the MongoDB URI.
 //
 // Example:
@@ -169,13 +246,54 @@ func WithCollectionName(collectionName string) func(*MongoDB) {
 	}
 }
 
+// WithContext returns a shallow copy of the MongoDB that uses ctx as the parent context
+// of every operation. Fields stored in ctx with logging.ContextWithFields or
+// logging.ContextWithRequestID are added to the log records of those operations.
+// Example:
+//
+//	ctx = logging.ContextWithRequestID(ctx, requestID)
+//	docs, err := mongoDB.WithContext(ctx).GetAll(&MyMongoDocument{})
+func (m *MongoDB) WithContext(ctx context.Context) *MongoDB {
+	c := *m
+	c.ctx = ctx
+	return &c
+}
+
+// context returns the parent context set by WithContext, or context.Background().
+func (m *MongoDB) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
 // The GetID() method is used to return the ID of the MongoDB struct.
 func (m *MongoDB) GetID() primitive.ObjectID {
-	m.Logger.Debug("MongoDB.GetID() Getting MongoDB ID '%s'", m.ID)
+	m.Logger.DebugContext(m.context(), "MongoDB.GetID() Getting MongoDB ID", "id", m.ID)
 	return m.ID
 }
 
+// WithClient is a functional option that makes MongoDB use client instead of connecting to a server with
+// the driver. Use it in tests with the in-memory client of the mongofake package, or with a mock. The client
+// is used as it is: MongoDB neither connects nor disconnects it, and the client options, command monitoring
+// and pool statistics do not apply to it.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithClient(mongofake.NewClient()),
+//		WithDatabaseName("test"),
+//	)
+func WithClient(client IMongoClient) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s._client = client
+	}
+}
+
 // The Connect func is used to connect to the MongoDB server. It returns a mongo.Client and an error.
+// With WithClient there is no driver client, so Connect fails unless the client was made by WrapClient;
+// use Client instead.
 // Example:
 //
 //	mongoDB, err := Connect()
@@ -183,61 +301,125 @@ func (m *MongoDB) GetID() primitive.ObjectID {
 //		return err
 //	}
 func (m *MongoDB) Connect() (*mongo.Client, error) {
-	logging := m.Logger
-	logging.Debug("MongoDB.Connect() Connecting to MongoDB")
-	if _client != nil {
-		// Client has already been created. Return it
-		logging.Debug("MongoDB.Connect() Client has been created, returning _client")
-		return _client, nil
+	if m._client != nil {
+		if wrapped, ok := m._client.(*mongoClient); ok {
+			return wrapped.client, nil
+		}
+		m.Logger.ErrorContext(m.context(), "MongoDB.Connect() The client set by WithClient is not a driver client")
+		return nil, errors.NewChuxDataStoreError("MongoDB.Connect() The client set by WithClient is not a driver client, use Client()", 1001, nil)
+	}
+	entry, err := m.connect()
+	if err != nil {
+		return nil, err
 	}
+	return entry.client, nil
+}
+
+// Client returns the client used by MongoDB: the client set by WithClient, or the driver client that
+// Connect returns.
+func (m *MongoDB) Client() (IMongoClient, error) {
+	if m._client != nil {
+		return m._client, nil
+	}
+	entry, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+	return WrapClient(entry.client), nil
+}
+
+// connect returns the cached client for the MongoDB's configuration, creating and connecting it when needed.
+func (m *MongoDB) connect() (*clientEntry, error) {
+	logging := m.Logger
+	logging.DebugContext(m.context(), "MongoDB.Connect() Connecting to MongoDB")
 
 	timeoutDuration := time.Duration(m.Timeout) * time.Second
 	if m.Timeout == 0 {
-		logging.Debug("MongoDB.Connect() Timeout is not set, using default value of 30")
+		logging.DebugContext(m.context(), "MongoDB.Connect() Timeout is not set, using default value", "timeout", 30)
 		m.Timeout = 30
 		timeoutDuration = 30 * time.Second // default value
 	}
 
-	var err error
 	var uri string
 	// Check the URI
 	if len(m.URI) == 0 {
 		// Set the uri to a default value
-		logging.Debug("MongoDB.Connect() URI is not set. Using default mongodb://localhost:27017")
+		logging.DebugContext(m.context(), "MongoDB.Connect() URI is not set. Using default", "uri", "mongodb://localhost:27017")
 		uri = "mongodb://localhost:27017"
 	} else {
-		masked := fmt.Sprintf(m.URI, "*****", "*****")
-		logging.Debug("MongoDB.Connect() URI is set. Using: '%s'", masked)
+		logging.DebugContext(m.context(), "MongoDB.Connect() URI is set", "uri", redact.URI(m.URI))
 		// Set the uri to the value passed in
 		uri = m.URI
 	}
 
-	logging.Debug("MongoDB.Connect() Setting client options")
+	key := m.clientKey(uri, timeoutDuration)
+	_clientsMu.Lock()
+	defer _clientsMu.Unlock()
+	if entry, ok := _clients[key]; ok {
+		// Client has already been created. Return it
+		logging.DebugContext(m.context(), "MongoDB.Connect() Client has been created, returning cached client")
+		return entry, nil
+	}
+
+	logging.DebugContext(m.context(), "MongoDB.Connect() Setting client options")
 	clientOptions := options.Client().
 		ApplyURI(uri).
 		SetConnectTimeout(timeoutDuration).        // Increase connection timeout
 		SetServerSelectionTimeout(timeoutDuration) // Increase server selection timeout
+	if monitor := m.clientCommandMonitor(); monitor != nil {
+		clientOptions.SetMonitor(monitor)
+	}
+	err := m.settings.validate()
+	if err == nil {
+		err = m.settings.apply(clientOptions)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("MongoDB.Connect() Invalid client settings for %s. Check the inner error for details", redact.URI(uri))
+		logging.ErrorContext(m.context(), msg, "error", err)
+		return nil, errors.NewChuxDataStoreError(msg, 1020, err)
+	}
+	pool := &poolStats{}
+	clientOptions.SetPoolMonitor(m.clientPoolMonitor(pool))
 
-	_client, err = mongo.NewClient(clientOptions)
+	client, err := mongo.NewClient(clientOptions)
 	if err != nil {
-		uri := fmt.Sprintf(m.URI, "*****", "*****")
-		msg := fmt.Sprintf("MongoDB.Connect() Did not create mongo client for %s. Check the inner error for details", uri)
-		logging.Error(msg)
+		msg := fmt.Sprintf("MongoDB.Connect() Did not create mongo client for %s. Check the inner error for details", redact.URI(uri))
+		logging.ErrorContext(m.context(), msg, "error", err)
 		return nil, errors.NewChuxDataStoreError(msg, 1000, err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration) // Increase context timeout
+	ctx, cancel := context.WithTimeout(m.context(), timeoutDuration) // Increase context timeout
 	defer cancel()
 
-	err = _client.Connect(ctx)
+	err = client.Connect(ctx)
 	if err != nil {
-		uri := fmt.Sprintf(m.URI, "*****", "*****")
-		msg := fmt.Sprintf("MongoDB.Connect() Did not connect to mongo client %s. Check the inner error for details", uri)
-		logging.Error(msg, err)
+		msg := fmt.Sprintf("MongoDB.Connect() Did not connect to mongo client %s. Check the inner error for details", redact.URI(uri))
+		logging.ErrorContext(ctx, msg, "error", err)
 		return nil, errors.NewChuxDataStoreError(msg, 1001, err)
 	}
 
-	return _client, nil
+	entry := &clientEntry{client: client, pool: pool}
+	_clients[key] = entry
+	return entry, nil
+}
+
+// clientKey identifies the configuration a client is created with. MongoDB instances that
+// attach their own monitors get their own client so that the monitors only see their commands.
+func (m *MongoDB) clientKey(uri string, timeout time.Duration) string {
+	key := fmt.Sprintf("%s|%s", uri, timeout) + m.settings.key()
+	if m.commandMonitor != nil {
+		key += fmt.Sprintf("|%p", m.commandMonitor)
+	}
+	for _, monitor := range m.commandMonitors {
+		key += fmt.Sprintf("|%p", monitor)
+	}
+	if m.metrics != nil {
+		key += fmt.Sprintf("|%p", m.metrics)
+	}
+	if m.tracer != nil {
+		key += fmt.Sprintf("|%p", m.tracer)
+	}
+	return key
 }
 
 // Creates a Mongo Document in the configured Mongo DB if the document does not exist.
@@ -263,8 +445,15 @@ func (m *MongoDB) Connect() (*mongo.Client, error) {
 //			FirstName: "John",
 //			LastName:  "Doe",
 //		})
+//
 // Add the 'fields' variadic parameter
 func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
+	return m.do(opUpsert, doc, func(ctx context.Context) error {
+		return m.upsert(ctx, doc, filterFields...)
+	})
+}
+
+func (m *MongoDB) upsert(ctx context.Context, doc IMongoDocument, filterFields ...string) error {
 
 	logging := m.Logger
 
@@ -272,7 +461,7 @@ func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
 	collection, err := m.getCollection(doc)
 	if err != nil {
 		msg := "MongoDB.Connect() Did not get mongo collection. Check the inner error for details."
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, msg, "error", err)
 		return errors.NewChuxDataStoreError(msg, 1000, err)
 	}
 
@@ -280,10 +469,16 @@ func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
 	if m.Timeout == 0 {
 		m.Timeout = 30 // default value
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout)*time.Second)
-	logging.Debug("MongoDB.Upsert() Upserting document with timeout of %d seconds", m.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.Timeout)*time.Second)
+	logging.DebugContext(ctx, "MongoDB.Upsert() Upserting document", "timeout", m.Timeout)
 	defer cancel()
 
+	// In a shared collection the document must belong to the tenant of the operation
+	if err := m.scopeDocument(ctx, doc); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Upsert() The document is not in the tenant", "error", err)
+		return err
+	}
+
 	// Get the document ID
 	id := doc.GetID()
 
@@ -298,20 +493,38 @@ func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
 			fieldValue, err := m.GetFieldValue(doc, field)
 			if err != nil {
 				msg := fmt.Sprintf("MongoDB.Upsert() Error getting field value for field '%s': %s", field, err)
-				logging.Error(msg, err)
-			
+				logging.ErrorContext(ctx, msg, "field", field, "error", err)
+
 				//return errors.NewChuxDataStoreError(msg, 1003, err)
 			}
 			filter[field] = fieldValue
 		}
 	}
 
+	// Encrypted filter fields match the ciphertexts of every key, so a document written before a key
+	// rotation is still found. Fields encrypted with a random nonce can never match and are rejected.
+	if err := m.encryptFilter(ctx, doc, filter); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Upsert() Invalid encrypted filter field", "fields", filterFields, "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Upsert() Invalid encrypted filter field: %s", err), 1042, err)
+	}
+	restore, err := m.encryptFields(ctx, doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Upsert() Failed to encrypt the document", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Upsert() Failed to encrypt the document. Check the inner error.", 1040, err)
+	}
+	defer restore()
+
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return err
+	}
+	setStatement(ctx, filter)
+
 	// Check if document exists
 	var result bson.M
 	err = collection.FindOne(ctx, filter).Decode(&result)
 	if err != nil && err != mongo.ErrNoDocuments {
 		msg := fmt.Sprintf("MongoDB.Upsert() Error checking if document exists: %s", err)
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, msg, "error", err)
 		return errors.NewChuxDataStoreError(msg, 1004, err)
 	}
 
@@ -319,6 +532,10 @@ func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
 	if err == mongo.ErrNoDocuments && id == primitive.NilObjectID {
 		id = primitive.NewObjectID()
 		doc.SetID(id)
+		// the filter must match the new _id, an upsert cannot change the _id it inserts
+		if _, ok := filter["_id"]; ok {
+			filter["_id"] = id
+		}
 	}
 
 	// Upsert operation
@@ -328,45 +545,87 @@ func (m *MongoDB) Upsert(doc IMongoDocument, filterFields ...string) error {
 		bson.M{"$set": doc},
 		options.Update().SetUpsert(true),
 	)
+	m.invalidate(ctx, collection, id, existingID(result))
 	if err != nil {
 		msg := fmt.Sprintf("MongoDB.Upsert() Error upserting document: %s", err)
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, msg, "error", err)
 		return errors.NewChuxDataStoreError(msg, 1005, err)
 	}
+	restore()
+	m.snapshot(ctx, doc)
 
 	return nil
 }
 
 // Returns a Mongo Document by its ID from the configured Mongo DB
 func (m *MongoDB) GetByID(doc IMongoDocument, id string) (interface{}, error) {
+	var result interface{}
+	err := m.do(opGetByID, doc, func(ctx context.Context) (err error) {
+		result, err = m.getByID(ctx, doc, id)
+		return err
+	})
+	return result, err
+}
+
+func (m *MongoDB) getByID(ctx context.Context, doc IMongoDocument, id string) (interface{}, error) {
 	logging := m.Logger
-	logging.Debug("MongoDB.GetByID() Connecting to Mongo")
+	logging.DebugContext(ctx, "MongoDB.GetByID() Connecting to Mongo")
 
-	client, err := m.Connect()
+	collection, err := m.getCollection(doc)
 	if err != nil {
 		msg := fmt.Sprintf("MongoDB.GetByID() An error occurred connection to Mongo '%s'", err)
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, msg, "error", err)
 		return nil, errors.NewChuxDataStoreError(msg, 1003, err)
 	}
 
-	collection := client.Database(doc.GetDatabaseName()).Collection(doc.GetCollectionName())
-	logging.Debug("MongoDB.GetByID() Getting document with ID '%s' from Database '%s' in Collection '%s'", id, doc.GetDatabaseName(), doc.GetCollectionName())
+	logging.DebugContext(ctx, "MongoDB.GetByID() Getting document", "id", id, "database", doc.GetDatabaseName(), "collection", doc.GetCollectionName())
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		msg := fmt.Sprintf("MongoDB.GetByID() Failed to Get ObjectIDFromHex '%s'", err)
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, msg, "id", id, "error", err)
 		return nil, errors.NewChuxDataStoreError(msg, 1003, err)
 	}
 
-	err = collection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(doc)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			logging.Error("MongoDB.GetByID() Document not found '%s'", err)
-			return nil, errors.NewChuxDataStoreError("Document not found.", 1003, err)
+	filter := bson.M{"_id": objectID}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return nil, err
+	}
+	setStatement(ctx, filter)
+
+	// Read through the cache when it is enabled for the document type
+	var raw bson.Raw
+	_, cached := m.cacheTTL(doc)
+	key := m.idCacheKey(ctx, collection, objectID)
+	if cached {
+		raw, _ = m.cacheGet(ctx, doc, key)
+	}
+	if raw == nil {
+		// Concurrent reads of the same document share one FindOne when WithRequestCoalescing is set
+		found, err := m.coalesce(ctx, key, func(ctx context.Context) (interface{}, error) {
+			return collection.FindOne(ctx, filter).DecodeBytes()
+		})
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				logging.ErrorContext(ctx, "MongoDB.GetByID() Document not found", "id", id, "error", err)
+				return nil, errors.NewChuxDataStoreError("Document not found.", 1003, err)
+			}
+			logging.ErrorContext(ctx, "MongoDB.GetByID() Failed to FindOne", "id", id, "error", err)
+			return nil, errors.NewChuxDataStoreError("GetByID failed. Check the inner error.", 1003, err)
+		}
+		raw = found.(bson.Raw)
+		if cached {
+			m.cacheSet(ctx, doc, key, raw)
 		}
-		logging.Error("MongoDB.GetByID() Failed to FindOne '%s'", err)
-		return nil, errors.NewChuxDataStoreError("GetByID failed. Check the inner error.", 1003, err)
 	}
+	if err := bson.Unmarshal(raw, doc); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.GetByID() Failed to decode document", "id", id, "error", err)
+		return nil, errors.NewChuxDataStoreError("GetByID failed to decode the document. Check the inner error.", 1003, err)
+	}
+	if err := m.decryptFields(ctx, doc); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.GetByID() Failed to decrypt the document", "id", id, "error", err)
+		return nil, errors.NewChuxDataStoreError("MongoDB.GetByID() Failed to decrypt the document. Check the inner error.", 1041, err)
+	}
+	m.snapshot(ctx, doc)
 	return doc, nil
 }
 
@@ -382,27 +641,33 @@ func (m *MongoDB) GetByID(doc IMongoDocument, id string) (interface{}, error) {
 //		fmt.Println(doc)
 //	}
 func (m *MongoDB) Query(doc IMongoDocument, queries ...interface{}) ([]IMongoDocument, error) {
+	var docs []IMongoDocument
+	err := m.do(opQuery, doc, func(ctx context.Context) (err error) {
+		docs, err = m.query(ctx, doc, queries...)
+		return err
+	})
+	return docs, err
+}
+
+func (m *MongoDB) query(ctx context.Context, doc IMongoDocument, queries ...interface{}) ([]IMongoDocument, error) {
 	logging := m.Logger
-	logging.Debug("MongoDB.Query() Connecting to Mongo")
+	logging.DebugContext(ctx, "MongoDB.Query() Connecting to Mongo")
 
 	// prepare an empty slice to return in case there are no results
 	emptySlice := make([]IMongoDocument, 0)
 	// Check if the number of arguments is even (key-value pairs)
 	if len(queries)%2 != 0 {
-		logging.Error("MongoDB.Query() requires an even number of arguments for key-value pairs.")
+		logging.ErrorContext(ctx, "MongoDB.Query() requires an even number of arguments for key-value pairs.", "arguments", len(queries))
 		return nil, errors.NewChuxDataStoreError("Query() requires an even number of arguments for key-value pairs.", 1006, nil)
 	}
 
-	// Connect to the MongoDB client
-	client, err := m.Connect()
+	// Get the collection from the specified database and collection names
+	collection, err := m.getCollection(doc)
 	if err != nil {
-		logging.Error("MongoDB.Query() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.Query() error occurred connecting to Mongo", "error", err)
 		return nil, errors.NewChuxDataStoreError("Query() error occurred connecting to Mongo", 1006, err)
 	}
-
-	// Get the collection from the specified database and collection names
-	collection := client.Database(doc.GetDatabaseName()).Collection(doc.GetCollectionName())
-	logging.Info("MongoDB.Query() Getting documents from Database '%s' in Collection '%s'", doc.GetDatabaseName(), doc.GetCollectionName())
+	logging.InfoContext(ctx, "MongoDB.Query() Getting documents", "database", doc.GetDatabaseName(), "collection", doc.GetCollectionName())
 	// Initialize the filter bson.M (a map) for MongoDB filtering
 	filter := bson.M{}
 
@@ -411,50 +676,91 @@ func (m *MongoDB) Query(doc IMongoDocument, queries ...interface{}) ([]IMongoDoc
 		// Cast the key to a string and check if the casting was successful
 		key, ok := queries[i].(string)
 		if !ok {
-			logging.Error("MongoDB.Query() expects keys to be of type string.")
+			logging.ErrorContext(ctx, "MongoDB.Query() expects keys to be of type string.", "key", queries[i])
 			return nil, errors.NewChuxDataStoreError("Query() expects keys to be of type string.", 1006, nil)
 		}
 		// Add the key-value pair to the filter map
 		filter[key] = queries[i+1]
 	}
 
-	// Execute the Find operation on the collection with the filter
-	cursor, err := collection.Find(context.Background(), filter)
-	logging.Info("MongoDB.Query() Executing Find in Collection with filters '%s'", filter)
+	// The tenant is added last so that a query argument cannot replace it
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return nil, err
+	}
+
+	if err := m.encryptFilter(ctx, doc, filter); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Query() Failed to encrypt the query", "error", err)
+		return nil, errors.NewChuxDataStoreError(fmt.Sprintf("Query() Failed to encrypt the query: %s", err), 1042, err)
+	}
+
+	setStatement(ctx, filter)
+
+	// Read through the cache when it is enabled for the document type
+	raws, cached, key, err := m.queryFromCache(ctx, doc, collection, filter)
 	if err != nil {
-		// The query returned no results
-		logging.Info("MongoDB.Query() No documents found '%s'", err)
-		return emptySlice, nil
+		logging.WarningContext(ctx, "MongoDB.Query() Could not read the cache, querying Mongo", "error", err)
 	}
+	if raws == nil {
+		// Concurrent identical queries share one Find when WithRequestCoalescing is set
+		found, err := m.coalesce(ctx, key, func(ctx context.Context) (interface{}, error) {
+			// Execute the Find operation on the collection with the filter
+			cursor, err := collection.Find(ctx, filter)
+			logging.InfoContext(ctx, "MongoDB.Query() Executing Find in Collection", "filter", filter)
+			if err != nil {
+				logging.ErrorContext(ctx, "MongoDB.Query() Failed to find documents", "error", err)
+				return nil, errors.NewChuxDataStoreError("Query() Failed to find documents. Check the inner error.", 1006, err)
+			}
 
-	// Close the cursor when the function is done
-	defer cursor.Close(context.Background())
+			// Close the cursor when the function is done
+			defer cursor.Close(ctx)
+
+			// Copy every document, the cursor reuses its buffer
+			raws := []bson.Raw{}
+			for cursor.Next(ctx) {
+				raws = append(raws, append(bson.Raw(nil), cursor.Current()...))
+			}
+
+			// Check for errors in the cursor
+			if err := cursor.Err(); err != nil {
+				logging.ErrorContext(ctx, "MongoDB.Query() Cursor error", "error", err)
+				return nil, errors.NewChuxDataStoreError("Query() Cursor error. Check the inner error.", 1006, err)
+			}
+			return raws, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		raws = found.([]bson.Raw)
+		if cached {
+			if value, err := bson.Marshal(cachedQuery{Docs: raws}); err == nil {
+				m.cacheSet(ctx, doc, key, value)
+			}
+		}
+	}
 
 	// Initialize a slice to store the decoded documents
 	var docs []IMongoDocument
 
-	// Loop through the cursor while there are more documents to fetch
-	for cursor.Next(context.Background()) {
+	for _, raw := range raws {
 		// Create a new document instance based on the type of the provided doc
 		newDoc := reflect.New(reflect.TypeOf(doc).Elem()).Interface().(IMongoDocument)
 
-		// Decode the document from the cursor into the new document instance
-		err := cursor.Decode(newDoc)
+		// Decode the document into the new document instance
+		err := bson.Unmarshal(raw, newDoc)
 		if err != nil {
-			logging.Error("MongoDB.Query() Failed to decode document '%s'", err)
+			logging.ErrorContext(ctx, "MongoDB.Query() Failed to decode document", "error", err)
 			return nil, errors.NewChuxDataStoreError("Query() Failed to decode document. Check the inner error.", 1006, err)
 		}
+		if err := m.decryptFields(ctx, newDoc); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.Query() Failed to decrypt document", "error", err)
+			return nil, errors.NewChuxDataStoreError("Query() Failed to decrypt document. Check the inner error.", 1041, err)
+		}
+		m.snapshot(ctx, newDoc)
 
 		// Append the new document to the docs slice
 		docs = append(docs, newDoc)
 	}
 
-	// Check for errors in the cursor
-	if err := cursor.Err(); err != nil {
-		logging.Error("MongoDB.Query() Cursor error '%s'", err)
-		return nil, errors.NewChuxDataStoreError("Query() Cursor error. Check the inner error.", 1006, err)
-	}
-
 	// If no documents were found, return an error
 	if len(docs) == 0 {
 		return emptySlice, nil
@@ -476,42 +782,59 @@ func (m *MongoDB) Query(doc IMongoDocument, queries ...interface{}) ([]IMongoDoc
 //		fmt.Println(doc)
 //	}
 func (m *MongoDB) GetAll(doc IMongoDocument) ([]IMongoDocument, error) {
+	var docs []IMongoDocument
+	err := m.do(opGetAll, doc, func(ctx context.Context) (err error) {
+		docs, err = m.getAll(ctx, doc)
+		return err
+	})
+	return docs, err
+}
+
+func (m *MongoDB) getAll(ctx context.Context, doc IMongoDocument) ([]IMongoDocument, error) {
 	logging := m.Logger
-	logging.Debug("MongoDB.GetAll() Connecting to Mongo")
-	client, err := m.Connect()
+	logging.DebugContext(ctx, "MongoDB.GetAll() Connecting to Mongo")
+	collection, err := m.getCollection(doc)
 	if err != nil {
-		logging.Error("MongoDB.GetAll() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.GetAll() error occurred connecting to Mongo", "error", err)
 		return nil, errors.NewChuxDataStoreError("MongoDB.GetAll() error occurred connecting to Mongo", 1004, err)
 	}
 
-	collection := client.Database(doc.GetDatabaseName()).Collection(doc.GetCollectionName())
-
-	cursor, err := collection.Find(context.Background(), bson.M{})
+	filter := bson.M{}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return nil, err
+	}
+	setStatement(ctx, filter)
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
-		logging.Error("MongoDB.GetAll() Failed to find documents '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.GetAll() Failed to find documents", "error", err)
 		return nil, errors.NewChuxDataStoreError("MongoDB.GetAll() Failed to find documents. Check the inner error.", 1004, err)
 	}
 
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
 	var docs []IMongoDocument
-	for cursor.Next(context.Background()) {
+	for cursor.Next(ctx) {
 		newDoc := reflect.New(reflect.TypeOf(doc).Elem()).Interface().(IMongoDocument)
 		err := cursor.Decode(newDoc)
 		if err != nil {
-			logging.Error("MongoDB.GetAll() Failed to decode document '%s'", err)
+			logging.ErrorContext(ctx, "MongoDB.GetAll() Failed to decode document", "error", err)
 			return nil, errors.NewChuxDataStoreError("MongoDB.GetAll() Failed to decode document. Check the inner error.", 1004, err)
 		}
+		if err := m.decryptFields(ctx, newDoc); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.GetAll() Failed to decrypt document", "error", err)
+			return nil, errors.NewChuxDataStoreError("MongoDB.GetAll() Failed to decrypt document. Check the inner error.", 1041, err)
+		}
+		m.snapshot(ctx, newDoc)
 		docs = append(docs, newDoc)
 	}
 
 	if err := cursor.Err(); err != nil {
-		logging.Error("MongoDB.GetAll() Cursor error '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.GetAll() Cursor error", "error", err)
 		return nil, errors.NewChuxDataStoreError("MongoDB.GetAll() Cursor error. Check the inner error.", 1004, err)
 	}
 
 	if len(docs) == 0 {
-		logging.Info("MongoDB.GetAll() No documents found.")
+		logging.InfoContext(ctx, "MongoDB.GetAll() No documents found.", "database", doc.GetDatabaseName(), "collection", doc.GetCollectionName())
 	}
 
 	return docs, nil
@@ -530,31 +853,82 @@ func (m *MongoDB) GetAll(doc IMongoDocument) ([]IMongoDocument, error) {
 //		LastName:  "Doe",
 //	}, "5e9b9b9b9b9b9b9b9b9b9b9b")
 func (m *MongoDB) Update(doc IMongoDocument, id string) error {
+	return m.do(opUpdate, doc, func(ctx context.Context) error {
+		return m.update(ctx, doc, id)
+	})
+}
+
+func (m *MongoDB) update(ctx context.Context, doc IMongoDocument, id string) error {
 	logging := m.Logger
-	logging.Debug("MongoDB.Update() Connecting to Mongo")
+	logging.DebugContext(ctx, "MongoDB.Update() Connecting to Mongo")
 
-	client, err := m.Connect()
+	collection, err := m.getCollection(doc)
 
 	if err != nil {
-		logging.Error("MongoDB.Update() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.Update() error occurred connecting to Mongo", "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Update() error occurred connecting to Mongo", 1004, err)
 	}
 
-	collection := client.Database(doc.GetDatabaseName()).Collection(doc.GetCollectionName())
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		logging.Error("MongoDB.Update() Failed to Get ObjectIDFromHex '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.Update() Failed to Get ObjectIDFromHex", "id", id, "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Update() Failed to Get ObjectIDFromHex. Check the inner error.", 1004, err)
 	}
-	update := bson.M{
+	if err := m.scopeDocument(ctx, doc); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Update() The document is not in the tenant", "id", id, "error", err)
+		return err
+	}
+	var update interface{} = bson.M{
 		"$set": doc,
 	}
-	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": objectID}, update)
+	// A tracked document with a snapshot only sends the fields that changed since it was loaded
+	changes, tracked, err := m.Changes(doc)
 	if err != nil {
-		logging.Error("MongoDB.Update() Failed to Update '%s'", err)
+		logging.WarningContext(ctx, "MongoDB.Update() Could not compute the changes, updating every field", "id", id, "error", err)
+		tracked = false
+	}
+	restore := func() {}
+	if tracked {
+		if changes.IsEmpty() {
+			logging.DebugContext(ctx, "MongoDB.Update() Document has no changes", "id", id)
+			return nil
+		}
+		changes.ID = objectID
+		// the update is built after encrypting, so that it holds the ciphertexts
+		if err = m.encryptSet(ctx, doc, changes.Set); err == nil {
+			builder := changes.Update()
+			if err := builder.Err(); err != nil {
+				logging.ErrorContext(ctx, "MongoDB.Update() Invalid change set", "id", id, "error", err)
+				return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Update() Invalid change set: %s", err), 1004, err)
+			}
+			update = builder.Document()
+		}
+		logging.DebugContext(ctx, "MongoDB.Update() Updating changed fields", "id", id, "fields", changes.Fields())
+	} else {
+		restore, err = m.encryptFields(ctx, doc)
+	}
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Update() Failed to encrypt the document", "id", id, "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Update() Failed to encrypt the document. Check the inner error.", 1040, err)
+	}
+	defer restore()
+	filter := bson.M{"_id": objectID}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return err
+	}
+	setStatement(ctx, filter)
+	result, err := collection.UpdateOne(ctx, filter, update)
+	m.invalidate(ctx, collection, objectID)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Update() Failed to Update", "id", id, "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Update() Failed to Update. Check the inner error.", 1004, err)
 	}
-	logging.Info("MongoDB.Update() Updated ", result.ModifiedCount, " Document(s)")
+	logging.InfoContext(ctx, "MongoDB.Update() Updated document(s)", "id", id, "matched", result.MatchedCount, "modified", result.ModifiedCount)
+	restore()
+	m.snapshot(ctx, doc)
+	if tracked {
+		m.publishChanges(ctx, changes)
+	}
 
 	return nil
 }
@@ -572,31 +946,81 @@ func (m *MongoDB) Update(doc IMongoDocument, id string) error {
 //		LastName:  "Doe",
 //	}, "5e9b9b9b9b9b9b9b9b9b9b9b")
 func (m *MongoDB) Delete(doc IMongoDocument, id string) error {
+	return m.do(opDelete, doc, func(ctx context.Context) error {
+		return m.delete(ctx, doc, id)
+	})
+}
+
+func (m *MongoDB) delete(ctx context.Context, doc IMongoDocument, id string) error {
 	logging := m.Logger
-	logging.Debug("MongoDB.Delete() Connecting to Mongo")
+	logging.DebugContext(ctx, "MongoDB.Delete() Connecting to Mongo")
 
 	collection, err := m.getCollection(doc)
 
 	if err != nil {
-		logging.Error("MongoDB.Delete() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.Delete() error occurred connecting to Mongo", "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Delete() error occurred connecting to Mongo", 1004, err)
 	}
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		logging.Error("MongoDB.Delete() Failed to Get ObjectIDFromHex.", err)
+		logging.ErrorContext(ctx, "MongoDB.Delete() Failed to Get ObjectIDFromHex.", "id", id, "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Delete() Failed to Get ObjectIDFromHex. Check the inner error.", 1005, err)
 	}
-	result, err := collection.DeleteOne(context.Background(), bson.M{"_id": objectID})
+	filter := bson.M{"_id": objectID}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return err
+	}
+	setStatement(ctx, filter)
+	result, err := collection.DeleteOne(ctx, filter)
+	m.invalidate(ctx, collection, objectID)
 	if err != nil {
-		msg := "MongoDB.Delete() did not delete ObjecID: v% from collection: %v"
-		logging.Error(msg, err)
+		logging.ErrorContext(ctx, "MongoDB.Delete() did not delete document", "id", id, "collection", collection.Name(), "error", err)
 		return errors.NewChuxDataStoreError("MongoDB.Delete() Failed to Delete. Check the inner error.", 1005, err)
 	}
-	fmt.Println("Deleted ", result.DeletedCount, " Document(s)")
+	logging.InfoContext(ctx, "MongoDB.Delete() Deleted document(s)", "id", id, "deleted", result.DeletedCount)
 
 	return nil
 }
 
+// DeleteAll deletes every document of the collection of doc and returns how many were deleted. With
+// WithTenantField only the documents of the tenant of the operation are deleted.
+// Example:
+//
+//	deleted, err := mongoDB.DeleteAll(&MyMongoDocument{})
+func (m *MongoDB) DeleteAll(doc IMongoDocument) (int64, error) {
+	var deleted int64
+	err := m.do(opDeleteAll, doc, func(ctx context.Context) (err error) {
+		deleted, err = m.deleteAll(ctx, doc)
+		return err
+	})
+	return deleted, err
+}
+
+func (m *MongoDB) deleteAll(ctx context.Context, doc IMongoDocument) (int64, error) {
+	logging := m.Logger
+	logging.DebugContext(ctx, "MongoDB.DeleteAll() Connecting to Mongo")
+
+	collection, err := m.getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.DeleteAll() error occurred connecting to Mongo", "error", err)
+		return 0, errors.NewChuxDataStoreError("MongoDB.DeleteAll() error occurred connecting to Mongo", 1004, err)
+	}
+	filter := bson.M{}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return 0, err
+	}
+	setStatement(ctx, filter)
+	result, err := collection.DeleteMany(ctx, filter)
+	m.invalidateCollection(ctx, collection)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.DeleteAll() did not delete the documents", "collection", collection.Name(), "error", err)
+		return 0, errors.NewChuxDataStoreError("MongoDB.DeleteAll() Failed to Delete. Check the inner error.", 1005, err)
+	}
+	logging.InfoContext(ctx, "MongoDB.DeleteAll() Deleted document(s)", "collection", collection.Name(), "deleted", result.DeletedCount)
+
+	return result.DeletedCount, nil
+}
+
 // Returns a collection and db name from the IMongoDocument interface
 // or the configured values if the interface is not implemented
 func (m *MongoDB) getDBAndCollectionName(doc IMongoDocument) (string, string, error) {
@@ -605,7 +1029,7 @@ func (m *MongoDB) getDBAndCollectionName(doc IMongoDocument) (string, string, er
 	// the struct that implements it will have the option of overriding the configured collection and database name
 	// with their implementation of the interface methods. This allows for a single struct to be used for multiple collections
 	// Its a point of extensibility that is not needed by all use cases.
-	logging.Debug("MongoDB.getDBAndCollectionName() Getting DB and Collection Name")
+	logging.DebugContext(m.context(), "MongoDB.getDBAndCollectionName() Getting DB and Collection Name")
 	var dbName string
 	var collectionName string
 	if len(doc.GetCollectionName()) > 0 {
@@ -620,30 +1044,37 @@ func (m *MongoDB) getDBAndCollectionName(doc IMongoDocument) (string, string, er
 	}
 
 	if len(collectionName) == 0 || len(dbName) == 0 {
-		logging.Warning("MongoDB.getDBAndCollectionName() Either no collection '%s' or database '%s' was found.", collectionName, dbName)
+		logging.WarningContext(m.context(), "MongoDB.getDBAndCollectionName() Either no collection or database was found.", "collection", collectionName, "database", dbName)
 		return "", "", nil
 	}
 
+	// With database per tenant, the tenant of the operation picks the database
+	dbName, err := m.tenantDatabase(m.context(), dbName)
+	if err != nil {
+		logging.ErrorContext(m.context(), "MongoDB.getDBAndCollectionName() Failed to get the database of the tenant", "error", err)
+		return "", "", err
+	}
+
 	return collectionName, dbName, nil
 }
 
 // Returns the MongoDB collection from the IMongoDocument interface
-func (m *MongoDB) getCollection(doc IMongoDocument) (*mongo.Collection, error) {
+func (m *MongoDB) getCollection(doc IMongoDocument) (IMongoCollection, error) {
 	logging := m.Logger
-	logging.Debug("MongoDB.getCollection() Connecting to Mongo")
-	client, err := m.Connect()
+	logging.DebugContext(m.context(), "MongoDB.getCollection() Connecting to Mongo")
+	client, err := m.Client()
 	if err != nil {
-		logging.Error("MongoDB.getCollection() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(m.context(), "MongoDB.getCollection() error occurred connecting to Mongo", "error", err)
 		return nil, errors.NewChuxDataStoreError("MongoDB.getCollection() error occurred connecting to Mongo", 1004, err)
 	}
 	collectionName, dbName, err := m.getDBAndCollectionName(doc)
 	if err != nil {
-		logging.Error("MongoDB.getCollection() error occurred getting the collection name and database name from the IMongoDocument interface '%s'", err)
+		logging.ErrorContext(m.context(), "MongoDB.getCollection() error occurred getting the collection name and database name from the IMongoDocument interface", "error", err)
 		return nil, errors.NewChuxDataStoreError("MongoDB.getCollection() error occurred getting the collection name and database name from the IMongoDocument interface", 1004, err)
 	}
-	collection := client.Database(dbName).Collection(collectionName)
+	collection := client.Database(dbName).Collection(collectionName, m.concernsFor(doc).collectionOptions())
 	if collection == nil {
-		logging.Error("MongoDB.getCollection() Unable to get the collection: %s from database: %s", collectionName, dbName)
+		logging.ErrorContext(m.context(), "MongoDB.getCollection() Unable to get the collection", "collection", collectionName, "database", dbName)
 		return nil, errors.NewChuxDataStoreError(fmt.Sprintf("Unable to get the collection: %s from database: %s Check the inner error for details", collectionName, dbName), 1000, nil)
 	}
 	return collection, nil
@@ -651,21 +1082,22 @@ func (m *MongoDB) getCollection(doc IMongoDocument) (*mongo.Collection, error) {
 
 func (m *MongoDB) CreateIndices(doc IMongoDocument, fieldNames ...string) (bool, error) {
 	logging := m.Logger
-	logging.Debug("MongoDB.CreateIndices() Connecting to Mongo")
+	ctx := m.context()
+	logging.DebugContext(ctx, "MongoDB.CreateIndices() Connecting to Mongo")
 
-	client, err := m.Connect()
+	client, err := m.Client()
 	if err != nil {
-		logging.Error("MongoDB.CreateIndices() error occurred connecting to Mongo '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.CreateIndices() error occurred connecting to Mongo", "error", err)
 		return false, errors.NewChuxDataStoreError("MongoDB.CreateIndices() error occurred connecting to Mongo", 1004, err)
 	}
 	collectionName, dbName, err := m.getDBAndCollectionName(doc)
 	if err != nil {
-		logging.Error("MongoDB.CreateIndices() error occurred getting the collection name and database name from the IMongoDocument interface '%s'", err)
+		logging.ErrorContext(ctx, "MongoDB.CreateIndices() error occurred getting the collection name and database name from the IMongoDocument interface", "error", err)
 		return false, errors.NewChuxDataStoreError("Unable to get the collection name and database name from the IMongoDocument interface. Check the inner error for details", 1004, err)
 	}
 	collection := client.Database(dbName).Collection(collectionName)
 	if collection == nil {
-		logging.Error("MongoDB.CreateIndices() Unable to get the collection: %s from database: %s", collectionName, dbName)
+		logging.ErrorContext(ctx, "MongoDB.CreateIndices() Unable to get the collection", "collection", collectionName, "database", dbName)
 		return false, errors.NewChuxDataStoreError(fmt.Sprintf("Unable to get the collection: %s from database: %s Check the inner error for details", collectionName, dbName), 1000, nil)
 	}
 	for _, fieldName := range fieldNames {
@@ -676,9 +1108,9 @@ func (m *MongoDB) CreateIndices(doc IMongoDocument, fieldNames ...string) (bool,
 			},
 			Options: options.Index().SetUnique(true),
 		}
-		_, err := indexView.CreateOne(context.Background(), indexModel)
+		_, err := indexView.CreateOne(ctx, indexModel)
 		if err != nil {
-			logging.Error("MongoDB.CreateIndices() Unable to create the indicies: %s on collection: %s", fieldNames, collectionName)
+			logging.ErrorContext(ctx, "MongoDB.CreateIndices() Unable to create the indicies", "fields", fieldNames, "collection", collectionName, "error", err)
 			return false, errors.NewChuxDataStoreError(fmt.Sprintf("Unable to create the indicies: %s on collection: %s Check the inner error for details", fieldNames, collectionName), 1000, nil)
 		}
 	}
@@ -686,34 +1118,29 @@ func (m *MongoDB) CreateIndices(doc IMongoDocument, fieldNames ...string) (bool,
 }
 
 // Returns the value of a field in a document using reflection
-// GetFieldValue method receives a field name and returns its value.
+// GetFieldValue method receives a field name and returns its value. The field name is the bson name of the
+// field; nested fields use dotted paths such as "address.city". A nil pointer on the path gives nil.
 func (m *MongoDB) GetFieldValue(doc IMongoDocument, field string) (interface{}, error) {
-    // Get the value of the document structure
-    val := reflect.ValueOf(doc)
-
-    // Check if the document value is a pointer, and if so, get the underlying value
-    if val.Kind() == reflect.Ptr {
-        val = val.Elem()
-    }
-
-    // Get the type of the document structure
-    typ := val.Type()
-
-    // Find the struct field that has a bson tag matching the provided field name
-    for i := 0; i < typ.NumField(); i++ {
-        bsonTag := typ.Field(i).Tag.Get("bson")
-        if strings.Split(bsonTag, ",")[0] == field {
-            // Get the field value
-            fieldValue := val.Field(i)
-            if !fieldValue.IsValid() {
-                return nil, fmt.Errorf("unknown field: %s", field)
-            }
-
-            // Return the field value as an interface
-            return fieldValue.Interface(), nil
-        }
-    }
-
-    // Return an error if no matching field is found
-    return nil, fmt.Errorf("unknown field: %s", field)
+	// Get the value of the document structure
+	val := reflect.ValueOf(doc)
+
+	// Check if the document value is a pointer, and if so, get the underlying value
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+
+	// Find the struct field that has a bson tag matching the provided field name
+	index, _, err := bsonFieldIndex(val.Type(), field)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the field value
+	fieldValue, err := val.FieldByIndexErr(index)
+	if err != nil {
+		return nil, nil
+	}
+
+	// Return the field value as an interface
+	return fieldValue.Interface(), nil
 }
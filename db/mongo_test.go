@@ -0,0 +1,63 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Product is a tracked document whose attributes are stored as a subdocument.
+type Product struct {
+	db.ChangeTracker `bson:"-"`
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	Name             string             `bson:"name"`
+	Attributes       map[string]string  `bson:"attributes"`
+}
+
+func (p *Product) GetCollectionName() string   { return "products" }
+func (p *Product) GetDatabaseName() string     { return "test" }
+func (p *Product) GetURI() string              { return "" }
+func (p *Product) GetID() primitive.ObjectID   { return p.ID }
+func (p *Product) SetID(id primitive.ObjectID) { p.ID = id }
+
+func TestUpdateOfATrackedDocument(t *testing.T) {
+	mongoDB := newFakeDB()
+	product := &Product{Name: "Lamp", Attributes: map[string]string{"color": "red", "size": "S"}}
+	if err := mongoDB.Upsert(product); err != nil {
+		t.Fatal(err)
+	}
+	found, err := mongoDB.GetByID(&Product{}, product.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := found.(*Product)
+
+	loaded.Attributes["color"] = "blue"
+	delete(loaded.Attributes, "size")
+	changes, tracked, err := mongoDB.Changes(loaded)
+	if err != nil || !tracked {
+		t.Fatalf("Changes() = %v, %v, want a change set", tracked, err)
+	}
+	if got := changes.Fields(); len(got) != 2 || got[0] != "attributes.color" || got[1] != "attributes.size" {
+		t.Errorf("Changes() changed %v, want [attributes.color attributes.size]", got)
+	}
+	if err := mongoDB.Update(loaded, loaded.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	found, err = mongoDB.GetByID(&Product{}, product.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := found.(*Product).Attributes; len(got) != 1 || got["color"] != "blue" {
+		t.Errorf("attributes after Update() = %v, want only the color blue", got)
+	}
+
+	// a key with a dot names a path inside another changed field, which MongoDB rejects
+	loaded = found.(*Product)
+	loaded.Attributes["color"] = "green"
+	loaded.Attributes["color.shade"] = "dark"
+	if err := mongoDB.Update(loaded, loaded.ID.Hex()); err == nil {
+		t.Error("Update() with conflicting changed fields succeeded")
+	}
+}
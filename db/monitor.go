@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// CommandEvent describes a single command that the driver sent to the server on behalf of the library.
+type CommandEvent struct {
+	RequestID    int64
+	ConnectionID string
+	Database     string
+	Collection   string
+	Command      string
+	// Filter is the query of the command as relaxed Extended JSON with every value replaced by "?".
+	// It shows the shape of the query without exposing the data in it.
+	Filter   string
+	Started  time.Time
+	Duration time.Duration
+	// Failure is the error reported by the server. It is empty when the command succeeded.
+	Failure string
+	// Slow is true when Duration is at or above the slow command threshold.
+	Slow bool
+}
+
+// Succeeded reports whether the command completed without an error.
+func (e CommandEvent) Succeeded() bool {
+	return len(e.Failure) == 0
+}
+
+// ICommandSink receives every command recorded by the command monitor. It can be used to keep an audit
+// trail of the commands issued by the library. RecordCommand is called from the driver's goroutines and
+// must be safe for concurrent use.
+type ICommandSink interface {
+	RecordCommand(ctx context.Context, e CommandEvent)
+}
+
+// CommandSinkFunc adapts a function to the ICommandSink interface.
+type CommandSinkFunc func(ctx context.Context, e CommandEvent)
+
+// RecordCommand calls f(ctx, e).
+func (f CommandSinkFunc) RecordCommand(ctx context.Context, e CommandEvent) {
+	f(ctx, e)
+}
+
+// WithCommandMonitoring is a functional option that records every command the driver issues.
+// Commands that take slowThreshold or longer are logged as warnings through the Logger; all other
+// commands are logged at debug level. A slowThreshold of 0 disables slow command warnings.
+// Every command is also passed to the given sinks.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithCommandMonitoring(250*time.Millisecond, CommandSinkFunc(func(ctx context.Context, e CommandEvent) {
+//			audit.Write(e)
+//		})),
+//	)
+//
+// The MongoDB client is created with the monitor attached, so a MongoDB with command monitoring
+// does not share its client with other MongoDB instances. Create it once and reuse it.
+func WithCommandMonitoring(slowThreshold time.Duration, sinks ...ICommandSink) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.commandMonitor = &commandMonitor{
+			mdb:           s,
+			slowThreshold: slowThreshold,
+			sinks:         sinks,
+		}
+	}
+}
+
+// WithCommandMonitor is a functional option that attaches a driver event.CommandMonitor to the client.
+// It can be combined with WithCommandMonitoring; every monitor receives every event.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithCommandMonitor(&event.CommandMonitor{
+//			Started: func(ctx context.Context, e *event.CommandStartedEvent) { ... },
+//		}),
+//	)
+func WithCommandMonitor(monitor *event.CommandMonitor) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.commandMonitors = append(s.commandMonitors, monitor)
+	}
+}
+
+// commandMonitor turns driver command events into CommandEvents.
+type commandMonitor struct {
+	mdb           *MongoDB
+	slowThreshold time.Duration
+	sinks         []ICommandSink
+	// inflight holds the started CommandEvent for each request ID until the command finishes
+	inflight sync.Map
+}
+
+func (c *commandMonitor) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started:   c.started,
+		Succeeded: c.succeeded,
+		Failed:    c.failed,
+	}
+}
+
+func (c *commandMonitor) started(ctx context.Context, e *event.CommandStartedEvent) {
+	c.inflight.Store(e.RequestID, CommandEvent{
+		RequestID:    e.RequestID,
+		ConnectionID: e.ConnectionID,
+		Database:     e.DatabaseName,
+		Collection:   commandCollection(e.CommandName, e.Command),
+		Command:      e.CommandName,
+		Filter:       redactedFilter(e.CommandName, e.Command),
+		Started:      time.Now(),
+	})
+}
+
+func (c *commandMonitor) succeeded(ctx context.Context, e *event.CommandSucceededEvent) {
+	c.finished(ctx, &e.CommandFinishedEvent, "")
+}
+
+func (c *commandMonitor) failed(ctx context.Context, e *event.CommandFailedEvent) {
+	c.finished(ctx, &e.CommandFinishedEvent, e.Failure)
+}
+
+func (c *commandMonitor) finished(ctx context.Context, e *event.CommandFinishedEvent, failure string) {
+	value, ok := c.inflight.LoadAndDelete(e.RequestID)
+	if !ok {
+		return
+	}
+	ce := value.(CommandEvent)
+	ce.Duration = time.Duration(e.DurationNanos)
+	ce.Failure = failure
+	ce.Slow = c.slowThreshold > 0 && ce.Duration >= c.slowThreshold
+
+	c.log(ctx, ce)
+	for _, sink := range c.sinks {
+		sink.RecordCommand(ctx, ce)
+	}
+}
+
+func (c *commandMonitor) log(ctx context.Context, ce CommandEvent) {
+	var logger *logging.Logger
+	if c.mdb != nil {
+		logger = c.mdb.Logger
+	}
+	args := []any{
+		"command", ce.Command,
+		"database", ce.Database,
+		"collection", ce.Collection,
+		"duration", ce.Duration,
+		"filter", ce.Filter,
+	}
+	if !ce.Succeeded() {
+		args = append(args, "failure", ce.Failure)
+	}
+	if ce.Slow {
+		logger.WarningContext(ctx, "MongoDB command exceeded the slow command threshold", append(args, "threshold", c.slowThreshold)...)
+		return
+	}
+	logger.DebugContext(ctx, "MongoDB command finished", args...)
+}
+
+// clientCommandMonitor combines the monitors configured on the MongoDB into the one monitor the driver accepts.
+// It returns nil when no monitor is configured.
+func (m *MongoDB) clientCommandMonitor() *event.CommandMonitor {
+	monitors := make([]*event.CommandMonitor, 0, len(m.commandMonitors)+2)
+	if m.commandMonitor != nil {
+		monitors = append(monitors, m.commandMonitor.monitor())
+	}
+	if m.tracer != nil {
+		monitors = append(monitors, m.tracer.commandMonitor())
+	}
+	monitors = append(monitors, m.commandMonitors...)
+	switch len(monitors) {
+	case 0:
+		return nil
+	case 1:
+		return monitors[0]
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Started != nil {
+					monitor.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, monitor := range monitors {
+				if monitor.Succeeded != nil {
+					monitor.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Failed != nil {
+					monitor.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
+
+// commandCollection returns the collection a command operates on. For most commands it is the value
+// of the command name key; getMore names it in the "collection" field.
+func commandCollection(commandName string, command bson.Raw) string {
+	if commandName == "getMore" {
+		collection, _ := command.Lookup("collection").StringValueOK()
+		return collection
+	}
+	collection, _ := command.Lookup(commandName).StringValueOK()
+	return collection
+}
+
+// filterFields lists, per command, where the query lives in the command document.
+var filterFields = map[string][]string{
+	"find":          {"filter"},
+	"count":         {"query"},
+	"distinct":      {"query"},
+	"findAndModify": {"query"},
+	"aggregate":     {"pipeline"},
+	"update":        {"updates", "q"},
+	"delete":        {"deletes", "q"},
+}
+
+// redactedFilter returns the query of a command as relaxed Extended JSON with every value masked.
+func redactedFilter(commandName string, command bson.Raw) string {
+	path, ok := filterFields[commandName]
+	if !ok || len(command) == 0 {
+		return ""
+	}
+	value, err := command.LookupErr(path[0])
+	if err != nil {
+		return ""
+	}
+	var filter interface{}
+	if len(path) > 1 {
+		// update and delete carry a list of statements; collect the query of each one
+		statements, ok := value.ArrayOK()
+		if !ok {
+			return ""
+		}
+		values, _ := statements.Values()
+		queries := bson.A{}
+		for _, statement := range values {
+			if doc, ok := statement.DocumentOK(); ok {
+				queries = append(queries, maskValue(doc.Lookup(path[1])))
+			}
+		}
+		filter = queries
+	} else {
+		filter = maskValue(value)
+	}
+	return extJSON(filter)
+}
+
+// extJSON returns value as relaxed Extended JSON. The value does not have to be a document.
+func extJSON(value interface{}) string {
+	out, err := bson.MarshalExtJSON(bson.M{"v": value}, false, false)
+	if err != nil {
+		return ""
+	}
+	// strip the {"v": ...} wrapper that MarshalExtJSON needs to marshal a non-document value
+	return string(out[len(`{"v":`) : len(out)-1])
+}
+
+// maskValue replaces every leaf value with "?" while keeping field names and operators.
+func maskValue(value bson.RawValue) interface{} {
+	if doc, ok := value.DocumentOK(); ok {
+		elements, _ := doc.Elements()
+		masked := make(bson.D, 0, len(elements))
+		for _, element := range elements {
+			masked = append(masked, bson.E{Key: element.Key(), Value: maskValue(element.Value())})
+		}
+		return masked
+	}
+	if array, ok := value.ArrayOK(); ok {
+		values, _ := array.Values()
+		masked := make(bson.A, 0, len(values))
+		for _, v := range values {
+			masked = append(masked, maskValue(v))
+		}
+		return masked
+	}
+	return "?"
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	stderrors "errors"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The names of the datastore operations as they appear in metrics.
+const (
+	opUpsert  = "upsert"
+	opGetByID = "getById"
+	opQuery   = "query"
+	opGetAll  = "getAll"
+	opUpdate  = "update"
+	opDelete  = "delete"
+
+	opUpdateFields = "updateFields"
+	opDeleteAll    = "deleteAll"
+	opExport       = "export"
+	opImport       = "import"
+)
+
+// do runs fn as the datastore operation op on the collection of doc. Every public operation goes
+// through do so that cross-cutting concerns such as metrics, tracing, the circuit breaker and retries are
+// applied the same way everywhere.
+func (m *MongoDB) do(op string, doc IMongoDocument, fn func(ctx context.Context) error) error {
+	return m.run(op, doc, func(ctx context.Context) error {
+		return m.retry(ctx, op, m.collectionName(doc), fn)
+	})
+}
+
+// doOnce is do without retries, for operations such as Import and Export that consume or produce a stream
+// and cannot be repeated.
+func (m *MongoDB) doOnce(op string, doc IMongoDocument, fn func(ctx context.Context) error) error {
+	return m.run(op, doc, fn)
+}
+
+// run applies metrics, tracing and the circuit breaker to fn.
+func (m *MongoDB) run(op string, doc IMongoDocument, fn func(ctx context.Context) error) error {
+	collection := m.collectionName(doc)
+	ctx, endSpan := m.tracer.startOperation(m.context(), op, m.databaseName(doc), collection)
+	start := time.Now()
+	err := m.guard(ctx, op, collection, fn)
+	m.metrics.observeOperation(op, collection, time.Since(start), err)
+	endSpan(err)
+	return err
+}
+
+// collectionName returns the collection of doc, or the configured collection when doc does not name one.
+func (m *MongoDB) collectionName(doc IMongoDocument) string {
+	if len(doc.GetCollectionName()) > 0 {
+		return doc.GetCollectionName()
+	}
+	return m.CollectionName
+}
+
+// databaseName returns the database of doc, or the configured database when doc does not name one.
+func (m *MongoDB) databaseName(doc IMongoDocument) string {
+	if len(doc.GetDatabaseName()) > 0 {
+		return doc.GetDatabaseName()
+	}
+	return m.DatabaseName
+}
+
+// errorClass sorts an operation error into a small set of classes suitable for a metric label.
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case stderrors.Is(err, errors.ErrCircuitOpen):
+		return "circuit_open"
+	case stderrors.Is(err, mongo.ErrNoDocuments):
+		return "not_found"
+	case mongo.IsDuplicateKeyError(err):
+		return "duplicate_key"
+	case stderrors.Is(err, context.DeadlineExceeded), stderrors.Is(err, context.Canceled), mongo.IsTimeout(err):
+		return "timeout"
+	case mongo.IsNetworkError(err):
+		return "network"
+	default:
+		return "error"
+	}
+}
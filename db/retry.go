@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	stderrors "errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy configures how operations that fail with a transient error, such as the errors returned
+// while a replica set elects a new primary, are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. A value of 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after every retry. Values below 1 are treated as 1.
+	Multiplier float64
+	// Jitter randomizes each backoff by up to the given fraction in either direction, for example 0.2 for ±20%.
+	Jitter float64
+	// Retryable decides whether an error is worth another attempt. IsRetryable is used when it is nil.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns a policy of 3 attempts with an exponential backoff starting at 100ms,
+// capped at 2s, with 20% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// WithRetryPolicy is a functional option that retries operations failing with a retryable error
+// according to the given policy. Retries never outlive the deadline of the context passed with WithContext:
+// when the next backoff would end after the deadline, the last error is returned.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithRetryPolicy(DefaultRetryPolicy()),
+//	)
+func WithRetryPolicy(policy RetryPolicy) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.retryPolicy = policy
+	}
+}
+
+// retryableLabels are the driver error labels that mark an error as transient.
+var retryableLabels = []string{
+	"RetryableWriteError",
+	"TransientTransactionError",
+	"NetworkError",
+	"NetworkTimeoutError",
+}
+
+// retryableCodes are the server error codes returned while a replica set changes its primary or a node
+// is shutting down or unreachable.
+var retryableCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsRetryable reports whether err is a transient error that is likely to succeed when the operation is
+// tried again: a network error, a server selection timeout, or a server error carrying a retryable label
+// or code. Errors caused by the caller's context being canceled or past its deadline are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || stderrors.Is(err, context.Canceled) || stderrors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	if stderrors.As(err, &labeled) {
+		for _, label := range retryableLabels {
+			if labeled.HasErrorLabel(label) {
+				return true
+			}
+		}
+	}
+	var serverErr mongo.ServerError
+	if stderrors.As(err, &serverErr) {
+		for _, code := range retryableCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	// a timeout that is not the caller's deadline, such as a server selection timeout during an election
+	return mongo.IsTimeout(err)
+}
+
+// retry runs fn until it succeeds, fails with an error that is not retryable, the policy runs out
+// of attempts or the context expires.
+func (m *MongoDB) retry(ctx context.Context, op, collection string, fn func(ctx context.Context) error) error {
+	policy := m.retryPolicy
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	attempt := 1
+	for {
+		err := fn(ctx)
+		if err == nil {
+			if attempt > 1 {
+				m.Logger.InfoContext(ctx, "MongoDB operation succeeded after retrying", "operation", op, "collection", collection, "attempts", attempt)
+			}
+			return nil
+		}
+		if attempt >= policy.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				m.Logger.ErrorContext(ctx, "MongoDB operation failed after retrying", "operation", op, "collection", collection, "attempts", attempt, "error", err)
+			}
+			return err
+		}
+		backoff := policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			m.Logger.WarningContext(ctx, "MongoDB operation not retried, the context deadline would be exceeded", "operation", op, "collection", collection, "attempts", attempt, "error", err)
+			return err
+		}
+		m.Logger.WarningContext(ctx, "MongoDB operation failed, retrying", "operation", op, "collection", collection, "attempt", attempt, "maxAttempts", policy.MaxAttempts, "backoff", backoff, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		attempt++
+	}
+}
+
+// backoff returns the wait after the given failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := math.Max(p.Multiplier, 1)
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 {
+		backoff = math.Min(backoff, float64(p.MaxBackoff))
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		backoff *= 1 - jitter + 2*jitter*rand.Float64()
+	}
+	return time.Duration(backoff)
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 100 * time.Millisecond},
+		{attempt: 2, want: 200 * time.Millisecond},
+		{attempt: 3, want: 400 * time.Millisecond},
+		{attempt: 4, want: 800 * time.Millisecond},
+		{attempt: 5, want: time.Second},
+		{attempt: 10, want: time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+
+	policy.Multiplier = 0.5
+	if got := policy.backoff(3); got != 100*time.Millisecond {
+		t.Errorf("backoff(3) with a multiplier below 1 = %v, want the initial 100ms", got)
+	}
+
+	policy.Multiplier = 2
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := policy.backoff(2); got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Fatalf("backoff(2) with 20%% jitter = %v, want between 160ms and 240ms", got)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "deadline exceeded", err: fmt.Errorf("find: %w", context.DeadlineExceeded), want: false},
+		{name: "network error", err: mongo.CommandError{Labels: []string{"NetworkError"}}, want: true},
+		{name: "retryable write label", err: mongo.CommandError{Code: 2, Labels: []string{"RetryableWriteError"}}, want: true},
+		{name: "transient transaction label", err: mongo.CommandError{Labels: []string{"TransientTransactionError"}}, want: true},
+		{name: "primary stepped down", err: mongo.CommandError{Code: 189}, want: true},
+		{name: "not writable primary in a write error", err: mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 10107}}}, want: true},
+		{name: "server timeout", err: mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"}, want: true},
+		{name: "wrapped retryable code", err: fmt.Errorf("update: %w", mongo.CommandError{Code: 11602}), want: true},
+		{name: "duplicate key", err: mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}, want: false},
+		{name: "bad value", err: mongo.CommandError{Code: 2, Name: "BadValue"}, want: false},
+		{name: "no documents", err: mongo.ErrNoDocuments, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	networkError := mongo.CommandError{Code: 6, Labels: []string{"NetworkError"}}
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		timeout  time.Duration
+		failures int
+		err      error
+		wantErr  bool
+		attempts int
+	}{
+		{
+			name:     "succeeds after a transient error",
+			policy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			failures: 2,
+			err:      networkError,
+			attempts: 3,
+		},
+		{
+			name:     "runs out of attempts",
+			policy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			failures: 5,
+			err:      networkError,
+			wantErr:  true,
+			attempts: 3,
+		},
+		{
+			name:     "does not retry a permanent error",
+			policy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			failures: 1,
+			err:      mongo.CommandError{Code: 2, Name: "BadValue"},
+			wantErr:  true,
+			attempts: 1,
+		},
+		{
+			name:     "stops when the backoff would end after the deadline",
+			policy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute},
+			timeout:  time.Second,
+			failures: 1,
+			err:      networkError,
+			wantErr:  true,
+			attempts: 1,
+		},
+		{
+			name:     "uses the classifier of the policy",
+			policy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Retryable: func(error) bool { return true }},
+			failures: 1,
+			err:      mongo.CommandError{Code: 2, Name: "BadValue"},
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(WithRetryPolicy(tt.policy), WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			attempts := 0
+			start := time.Now()
+			err := m.retry(ctx, opGetByID, "people", func(ctx context.Context) error {
+				attempts++
+				if attempts <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("retry() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("retry() made %d attempts, want %d", attempts, tt.attempts)
+			}
+			if tt.timeout > 0 && time.Since(start) >= tt.timeout {
+				t.Errorf("retry() returned after %v, past the deadline", time.Since(start))
+			}
+		})
+	}
+}
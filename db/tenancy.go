@@ -0,0 +1,290 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultTenantField is the field that holds the tenant of a document in a shared collection.
+const DefaultTenantField = "tenantId"
+
+// DefaultTenantDatabaseTemplate names the database of a tenant after the configured database and the tenant.
+const DefaultTenantDatabaseTemplate = "{database}_{tenant}"
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx that carries the tenant. Operations of a MongoDB with tenancy
+// enabled read the tenant from the context passed to WithContext.
+// Example:
+//
+//	ctx = ContextWithTenant(ctx, "acme")
+//	docs, err := mongoDB.WithContext(ctx).GetAll(&Invoice{})
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored in ctx by ContextWithTenant.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && len(tenant) > 0
+}
+
+// ITenantResolver returns the tenant of an operation. Implement it to take the tenant from somewhere
+// else than ContextWithTenant, such as the claims of an authenticated request stored in the context.
+type ITenantResolver interface {
+	ResolveTenant(ctx context.Context) (string, error)
+}
+
+// TenantResolverFunc adapts a function to the ITenantResolver interface.
+type TenantResolverFunc func(ctx context.Context) (string, error)
+
+// ResolveTenant calls f(ctx).
+func (f TenantResolverFunc) ResolveTenant(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// contextTenantResolver is the default resolver. It reads the tenant set with ContextWithTenant.
+var contextTenantResolver = TenantResolverFunc(func(ctx context.Context) (string, error) {
+	tenant, _ := TenantFromContext(ctx)
+	return tenant, nil
+})
+
+// tenancy is the tenant isolation configured with WithTenantDatabases or WithTenantField.
+type tenancy struct {
+	// databaseTemplate is set for database per tenant
+	databaseTemplate string
+	// field is set for shared collections
+	field string
+}
+
+// WithTenantDatabases is a functional option that gives every tenant its own database. The database name
+// is the template with {tenant} replaced by the tenant and {database} by the document's or configured
+// database name. An empty template uses DefaultTenantDatabaseTemplate. Operations without a tenant fail.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithDatabaseName("billing"),
+//		WithTenantDatabases("{database}_{tenant}"),
+//	)
+func WithTenantDatabases(template string) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		if len(template) == 0 {
+			template = DefaultTenantDatabaseTemplate
+		}
+		s.tenancy = &tenancy{databaseTemplate: template}
+	}
+}
+
+// WithTenantField is a functional option that keeps every tenant in the same collections. The tenant is
+// stored in field, DefaultTenantField when empty, and added to the filter of GetByID, Query, GetAll, Upsert,
+// Update, UpdateFields and Delete, so an operation never sees or changes another tenant's documents.
+// Operations without a tenant fail.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithTenantField("tenantId"),
+//	)
+func WithTenantField(field string) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		if len(field) == 0 {
+			field = DefaultTenantField
+		}
+		s.tenancy = &tenancy{field: field}
+	}
+}
+
+// WithTenantResolver is a functional option that sets how the tenant of an operation is found.
+// It defaults to the tenant set with ContextWithTenant.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithTenantField(""),
+//		WithTenantResolver(TenantResolverFunc(func(ctx context.Context) (string, error) {
+//			return auth.ClaimsFrom(ctx).Organization, nil
+//		})),
+//	)
+func WithTenantResolver(resolver ITenantResolver) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.tenantResolver = resolver
+	}
+}
+
+// tenant returns the tenant of the current operation. It returns "" when tenancy is not enabled and
+// an error wrapping ErrTenantRequired when it is enabled but no tenant is found.
+func (m *MongoDB) tenant(ctx context.Context) (string, error) {
+	if m.tenancy == nil {
+		return "", nil
+	}
+	resolver := m.tenantResolver
+	if resolver == nil {
+		resolver = contextTenantResolver
+	}
+	tenant, err := resolver.ResolveTenant(ctx)
+	if err != nil {
+		return "", errors.NewChuxDataStoreError("MongoDB.tenant() Failed to resolve the tenant. Check the inner error.", 1050, err)
+	}
+	if len(tenant) == 0 {
+		return "", errors.NewChuxDataStoreError("MongoDB.tenant() The operation has no tenant", 1050, errors.ErrTenantRequired)
+	}
+	return tenant, nil
+}
+
+// tenantDatabase returns the database of the tenant for database per tenant, or dbName otherwise.
+func (m *MongoDB) tenantDatabase(ctx context.Context, dbName string) (string, error) {
+	if m.tenancy == nil || len(m.tenancy.databaseTemplate) == 0 {
+		return dbName, nil
+	}
+	tenant, err := m.tenant(ctx)
+	if err != nil {
+		return "", err
+	}
+	// a tenant must not be able to name a database of its choosing
+	if strings.ContainsAny(tenant, "/\\. \"$*<>:|?\x00") {
+		msg := fmt.Sprintf("MongoDB.tenantDatabase() The tenant %q contains characters that are not allowed in a database name", tenant)
+		return "", errors.NewChuxDataStoreError(msg, 1051, nil)
+	}
+	name := strings.NewReplacer("{tenant}", tenant, "{database}", dbName).Replace(m.tenancy.databaseTemplate)
+	if len(name) > 63 {
+		msg := fmt.Sprintf("MongoDB.tenantDatabase() The database name %q of the tenant is longer than 63 bytes", name)
+		return "", errors.NewChuxDataStoreError(msg, 1051, nil)
+	}
+	return name, nil
+}
+
+// scopeFilter adds the tenant to a filter of a shared collection.
+func (m *MongoDB) scopeFilter(ctx context.Context, filter bson.M) error {
+	if m.tenancy == nil || len(m.tenancy.field) == 0 {
+		return nil
+	}
+	tenant, err := m.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	filter[m.tenancy.field] = tenant
+	return nil
+}
+
+// tenantFilter restricts a bson.M or bson.D filter, or nil for every document, to the tenant of a shared
+// collection.
+func (m *MongoDB) tenantFilter(ctx context.Context, filter interface{}) (interface{}, error) {
+	scope := bson.M{}
+	if err := m.scopeFilter(ctx, scope); err != nil {
+		return nil, err
+	}
+	if filter == nil {
+		return scope, nil
+	}
+	if len(scope) == 0 {
+		return filter, nil
+	}
+	return bson.M{"$and": bson.A{filter, scope}}, nil
+}
+
+// scopeImportedDocument is scopeDocument for a document read by Import. As in scopeDocument, an empty
+// tenant, such as the zero value of a struct field, is set to the tenant of the operation.
+func (m *MongoDB) scopeImportedDocument(ctx context.Context, d bson.D) (bson.D, error) {
+	if m.tenancy == nil || len(m.tenancy.field) == 0 {
+		return d, nil
+	}
+	tenant, err := m.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Key != m.tenancy.field {
+			continue
+		}
+		if current, ok := e.Value.(string); ok && len(current) == 0 {
+			d[i].Value = tenant
+			return d, nil
+		}
+		if current, _ := e.Value.(string); current != tenant {
+			msg := fmt.Sprintf("MongoDB.scopeImportedDocument() The document belongs to tenant %v, not to %q", e.Value, tenant)
+			return nil, errors.NewChuxDataStoreError(msg, 1052, errors.ErrTenantMismatch)
+		}
+		return d, nil
+	}
+	return append(d, bson.E{Key: m.tenancy.field, Value: tenant}), nil
+}
+
+// scopeDocument sets the tenant field of a document that is about to be written to a shared collection.
+// A document that already belongs to another tenant is rejected. Documents without a tenant field get the
+// tenant from the upsert filter when they are inserted.
+func (m *MongoDB) scopeDocument(ctx context.Context, doc IMongoDocument) error {
+	if m.tenancy == nil || len(m.tenancy.field) == 0 {
+		return nil
+	}
+	tenant, err := m.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	value, ok := tenantFieldValue(doc, m.tenancy.field)
+	if !ok {
+		return nil
+	}
+	switch current := value.String(); current {
+	case tenant:
+	case "":
+		value.SetString(tenant)
+	default:
+		msg := fmt.Sprintf("MongoDB.scopeDocument() The document belongs to tenant %q, not to %q", current, tenant)
+		return errors.NewChuxDataStoreError(msg, 1052, errors.ErrTenantMismatch)
+	}
+	return nil
+}
+
+// scopeUpdate rejects an update that would move a document of a shared collection to another tenant.
+func (m *MongoDB) scopeUpdate(update bson.D) error {
+	if m.tenancy == nil || len(m.tenancy.field) == 0 {
+		return nil
+	}
+	for _, operator := range update {
+		fields, _ := operator.Value.(bson.D)
+		for _, e := range fields {
+			if e.Key == m.tenancy.field || strings.HasPrefix(e.Key, m.tenancy.field+".") {
+				msg := fmt.Sprintf("MongoDB.scopeUpdate() %s %s would change the tenant of the document", operator.Key, e.Key)
+				return errors.NewChuxDataStoreError(msg, 1052, errors.ErrTenantMismatch)
+			}
+		}
+	}
+	return nil
+}
+
+// tenantFieldValue returns the settable string field of doc whose bson name is field.
+func tenantFieldValue(doc IMongoDocument, field string) (reflect.Value, bool) {
+	v := reflect.ValueOf(doc)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		name, _, skip := bsonFieldName(t.Field(i))
+		if skip || name != field {
+			continue
+		}
+		if f := v.Field(i); f.Kind() == reflect.String && f.CanSet() {
+			return f, true
+		}
+	}
+	return reflect.Value{}, false
+}
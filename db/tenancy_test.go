@@ -0,0 +1,180 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	dserrors "github.com/chuxorg/chux-datastore/errors"
+	"github.com/chuxorg/chux-datastore/mongofake"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// forTenant returns mongoDB running its operations for tenant.
+func forTenant(mongoDB *db.MongoDB, tenant string) *db.MongoDB {
+	return mongoDB.WithContext(db.ContextWithTenant(context.Background(), tenant))
+}
+
+// names returns the names of people.
+func names(t *testing.T, people []db.IMongoDocument) []string {
+	t.Helper()
+	var names []string
+	for _, p := range people {
+		names = append(names, p.(*Person).Name)
+	}
+	return names
+}
+
+func TestTenantIsolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		option func(*db.MongoDB)
+	}{
+		{name: "shared collection", option: db.WithTenantField("")},
+		{name: "database per tenant", option: db.WithTenantDatabases("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongoDB := newFakeDB(tt.option)
+			acme, globex := forTenant(mongoDB, "acme"), forTenant(mongoDB, "globex")
+
+			jane := &Person{Name: "Jane"}
+			if err := acme.Upsert(jane); err != nil {
+				t.Fatal(err)
+			}
+			john := &Person{Name: "John"}
+			if err := globex.Upsert(john); err != nil {
+				t.Fatal(err)
+			}
+
+			people, err := acme.GetAll(&Person{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(t, people); len(got) != 1 || got[0] != "Jane" {
+				t.Errorf("GetAll() for acme = %v, want [Jane]", got)
+			}
+			people, err = acme.Query(&Person{}, "name", "John")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(people) != 0 {
+				t.Errorf("Query() for acme found %v of globex", names(t, people))
+			}
+			if _, err := acme.GetByID(&Person{}, john.ID.Hex()); err == nil {
+				t.Error("GetByID() for acme found the document of globex")
+			}
+
+			if err := acme.Delete(&Person{}, john.ID.Hex()); err != nil {
+				t.Fatal(err)
+			}
+			result, err := acme.UpdateFields(&Person{}, john.ID.Hex(), db.NewUpdate().Set("name", "Johnny"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.MatchedCount != 0 {
+				t.Errorf("UpdateFields() for acme matched %d documents of globex", result.MatchedCount)
+			}
+			found, err := globex.GetByID(&Person{}, john.ID.Hex())
+			if err != nil {
+				t.Fatalf("the document of globex is gone after a Delete for acme: %v", err)
+			}
+			if p := found.(*Person); p.Name != "John" {
+				t.Errorf("the document of globex was changed by acme to %+v", p)
+			}
+		})
+	}
+}
+
+func TestTenantFieldIsSetAndChecked(t *testing.T) {
+	client := mongofake.NewClient()
+	acme := forTenant(newFakeDB(db.WithClient(client), db.WithTenantField("")), "acme")
+
+	jane := &Person{Name: "Jane"}
+	if err := acme.Upsert(jane); err != nil {
+		t.Fatal(err)
+	}
+	if jane.TenantID != "acme" {
+		t.Errorf("Upsert() set the tenant to %q, want acme", jane.TenantID)
+	}
+	raw := bson.M{}
+	err := client.Database("test").Collection("people").FindOne(context.Background(), bson.M{"_id": jane.ID}).Decode(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[db.DefaultTenantField] != "acme" {
+		t.Errorf("the document is stored with the tenant %v, want acme", raw[db.DefaultTenantField])
+	}
+
+	tests := []struct {
+		name  string
+		write func() error
+	}{
+		{
+			name:  "Upsert of a document of another tenant",
+			write: func() error { return acme.Upsert(&Person{Name: "John", TenantID: "globex"}) },
+		},
+		{
+			name: "Update of a document of another tenant",
+			write: func() error {
+				return acme.Update(&Person{ID: jane.ID, Name: "Jane", TenantID: "globex"}, jane.ID.Hex())
+			},
+		},
+		{
+			name: "UpdateFields moving a document to another tenant",
+			write: func() error {
+				_, err := acme.UpdateFields(&Person{}, jane.ID.Hex(), db.NewUpdate().Set(db.DefaultTenantField, "globex"))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); !errors.Is(err, dserrors.ErrTenantMismatch) {
+				t.Errorf("got %v, want ErrTenantMismatch", err)
+			}
+		})
+	}
+}
+
+func TestOperationsWithoutTenantFail(t *testing.T) {
+	tests := []struct {
+		name   string
+		option func(*db.MongoDB)
+	}{
+		{name: "shared collection", option: db.WithTenantField("")},
+		{name: "database per tenant", option: db.WithTenantDatabases("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongoDB := newFakeDB(tt.option)
+			if err := mongoDB.Upsert(&Person{Name: "Jane"}); !errors.Is(err, dserrors.ErrTenantRequired) {
+				t.Errorf("Upsert() error = %v, want ErrTenantRequired", err)
+			}
+			if _, err := mongoDB.GetAll(&Person{}); !errors.Is(err, dserrors.ErrTenantRequired) {
+				t.Errorf("GetAll() error = %v, want ErrTenantRequired", err)
+			}
+		})
+	}
+}
+
+func TestTenantDatabaseName(t *testing.T) {
+	client := mongofake.NewClient()
+	mongoDB := newFakeDB(db.WithClient(client), db.WithTenantDatabases(""))
+	if err := forTenant(mongoDB, "acme").Upsert(&Person{Name: "Jane"}); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := client.Database("test_acme").ListCollectionNames(context.Background(), bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "people" {
+		t.Errorf("the database test_acme has the collections %v, want [people]", names)
+	}
+
+	if err := forTenant(mongoDB, "../admin").Upsert(&Person{Name: "Mallory"}); err == nil {
+		t.Error("Upsert() for a tenant naming another database succeeded")
+	}
+}
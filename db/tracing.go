@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans started by the library.
+const tracerName = "github.com/chuxorg/chux-datastore/db"
+
+// WithTracerProvider is a functional option that starts an OpenTelemetry span around every datastore
+// operation. Each span carries the db.system, db.name, db.mongodb.collection, db.operation and db.statement
+// attributes; the statement is the operation's filter with every value replaced by "?". The commands the
+// driver sends for an operation are recorded as child spans of the operation's span.
+//
+// Example:
+//
+//	mongoDB := New(
+//		WithTracerProvider(otel.GetTracerProvider()),
+//	)
+//
+// Pass the incoming request's context with WithContext so that the operation spans join its trace.
+func WithTracerProvider(provider trace.TracerProvider) func(*MongoDB) {
+
+	return func(s *MongoDB) {
+		s.tracer = &datastoreTracer{tracer: provider.Tracer(tracerName)}
+	}
+}
+
+// datastoreTracer starts the operation and command spans. A nil *datastoreTracer starts no spans.
+type datastoreTracer struct {
+	tracer trace.Tracer
+	// commands holds the span of each in-flight driver command by request ID
+	commands sync.Map
+}
+
+// startOperation starts the span of a datastore operation. The returned function ends the span and
+// records the operation's error on it.
+func (t *datastoreTracer) startOperation(ctx context.Context, op, database, collection string) (context.Context, func(error)) {
+	if t == nil {
+		return ctx, func(error) {}
+	}
+	ctx, span := t.tracer.Start(ctx, op+" "+collection,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", database),
+			attribute.String("db.mongodb.collection", collection),
+			attribute.String("db.operation", op),
+		))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// setStatement sets the sanitized filter of the running operation as the db.statement attribute of its span.
+func setStatement(ctx context.Context, filter interface{}) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(attribute.String("db.statement", redactedStatement(filter)))
+}
+
+// redactedStatement returns filter as relaxed Extended JSON with every value replaced by "?".
+func redactedStatement(filter interface{}) string {
+	raw, err := bson.Marshal(bson.M{"filter": filter})
+	if err != nil {
+		return ""
+	}
+	return extJSON(maskValue(bson.Raw(raw).Lookup("filter")))
+}
+
+// commandMonitor returns a driver command monitor that records every command as a child span of the
+// operation that issued it.
+func (t *datastoreTracer) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			_, span := t.tracer.Start(ctx, e.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("db.system", "mongodb"),
+					attribute.String("db.name", e.DatabaseName),
+					attribute.String("db.mongodb.collection", commandCollection(e.CommandName, e.Command)),
+					attribute.String("db.operation", e.CommandName),
+					attribute.String("db.statement", redactedFilter(e.CommandName, e.Command)),
+					attribute.String("db.mongodb.connection_id", e.ConnectionID),
+				))
+			t.commands.Store(e.RequestID, span)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			if span, ok := t.commands.LoadAndDelete(e.RequestID); ok {
+				span.(trace.Span).End()
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			if span, ok := t.commands.LoadAndDelete(e.RequestID); ok {
+				span.(trace.Span).SetStatus(codes.Error, e.Failure)
+				span.(trace.Span).End()
+			}
+		},
+	}
+}
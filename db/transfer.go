@@ -0,0 +1,542 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Format is the file format read by Import and written by Export.
+type Format string
+
+const (
+	// FormatExtJSON is a JSON array of documents in relaxed Extended JSON, which keeps numbers and dates readable.
+	FormatExtJSON Format = "json"
+	// FormatCanonicalExtJSON is a JSON array of documents in canonical Extended JSON, which keeps every BSON type.
+	FormatCanonicalExtJSON Format = "json-canonical"
+	// FormatNDJSON is one document per line in relaxed Extended JSON, as written by mongoexport.
+	FormatNDJSON Format = "ndjson"
+	// FormatBSON is a sequence of BSON documents, as written by mongodump.
+	FormatBSON Format = "bson"
+)
+
+// ParseFormat returns the Format named s.
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(strings.ToLower(s)); format {
+	case FormatExtJSON, FormatCanonicalExtJSON, FormatNDJSON, FormatBSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected one of json, json-canonical, ndjson or bson", s)
+}
+
+// ImportMode decides what Import does with a document that is already in the collection.
+type ImportMode string
+
+const (
+	// ImportInsert inserts every document. A document whose _id is already in the collection fails the import.
+	ImportInsert ImportMode = "insert"
+	// ImportUpsert sets the fields of the document with the same key fields, see TransferKeyFields,
+	// or inserts the document when there is none.
+	ImportUpsert ImportMode = "upsert"
+	// ImportReplace replaces the document with the same _id, or inserts the document when there is none.
+	ImportReplace ImportMode = "replace"
+)
+
+// ParseImportMode returns the ImportMode named s.
+func ParseImportMode(s string) (ImportMode, error) {
+	switch mode := ImportMode(strings.ToLower(s)); mode {
+	case ImportInsert, ImportUpsert, ImportReplace:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown import mode %q, expected one of insert, upsert or replace", s)
+}
+
+// DefaultTransferBatchSize is the number of documents Import writes, and Export reads, per round trip.
+const DefaultTransferBatchSize = 1000
+
+// maxBSONDocumentSize is the largest document accepted in a BSON dump: the 16MiB limit of the server plus
+// the headroom mongodump allows for.
+const maxBSONDocumentSize = 16*1024*1024 + 16*1024
+
+// TransferResult counts the documents handled by Import or Export.
+type TransferResult struct {
+	// Documents is the number of documents read by Import or written by Export.
+	Documents int64
+	// Inserted is the number of documents inserted by ImportInsert.
+	Inserted int64
+	// Matched and Modified are the number of existing documents found and changed by ImportUpsert and ImportReplace.
+	Matched  int64
+	Modified int64
+	// Upserted is the number of documents inserted by ImportUpsert and ImportReplace.
+	Upserted int64
+}
+
+// TransferProgressFunc is called with the running totals of Import after every batch, and of Export after
+// every batch of documents written.
+type TransferProgressFunc func(progress TransferResult)
+
+// TransferOption changes how Import, Export, ImportCSV and ExportCSV work.
+type TransferOption func(*transferOptions)
+
+type transferOptions struct {
+	batchSize int
+	keyFields []string
+	columns   []string
+	progress  TransferProgressFunc
+}
+
+// TransferBatchSize sets the number of documents written or read per round trip. The default is
+// DefaultTransferBatchSize.
+func TransferBatchSize(size int) TransferOption {
+	return func(o *transferOptions) {
+		if size > 0 {
+			o.batchSize = size
+		}
+	}
+}
+
+// TransferKeyFields sets the fields ImportUpsert matches existing documents on. Nested fields use dotted
+// paths. The default is _id.
+func TransferKeyFields(fields ...string) TransferOption {
+	return func(o *transferOptions) {
+		o.keyFields = fields
+	}
+}
+
+// TransferColumns sets the columns written by ExportCSV, as bson field names in the order of the header.
+func TransferColumns(columns ...string) TransferOption {
+	return func(o *transferOptions) {
+		o.columns = columns
+	}
+}
+
+// TransferProgress sets a function that follows the progress of Import or Export.
+func TransferProgress(progress TransferProgressFunc) TransferOption {
+	return func(o *transferOptions) {
+		o.progress = progress
+	}
+}
+
+func newTransferOptions(opts []TransferOption) transferOptions {
+	o := transferOptions{batchSize: DefaultTransferBatchSize, keyFields: []string{"_id"}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o transferOptions) report(result *TransferResult) {
+	if o.progress != nil {
+		o.progress(*result)
+	}
+}
+
+// Export streams the documents of the collection of doc that match filter to w. filter is a bson.M or
+// bson.D query; nil exports every document. Documents are written as they are stored, so fields encrypted
+// with WithFieldEncryption stay encrypted. The export is bounded by the context of WithContext rather than
+// the Timeout. The result holds the documents written so far, also when an error is returned.
+// Example:
+//
+//	f, err := os.Create("orders.ndjson")
+//	...
+//	result, err := mongoDB.Export(&Order{}, bson.M{"status": "shipped"}, f, FormatNDJSON)
+func (m *MongoDB) Export(doc IMongoDocument, filter interface{}, w io.Writer, format Format, opts ...TransferOption) (*TransferResult, error) {
+	result := &TransferResult{}
+	err := m.doOnce(opExport, doc, func(ctx context.Context) error {
+		return m.export(ctx, doc, filter, w, format, newTransferOptions(opts), result)
+	})
+	return result, err
+}
+
+func (m *MongoDB) export(ctx context.Context, doc IMongoDocument, filter interface{}, w io.Writer, format Format, o transferOptions, result *TransferResult) error {
+	logging := m.Logger
+
+	writer, err := newDocumentWriter(w, format)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Export() Invalid format", "format", format, "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Export() Invalid format: %s", err), 1060, err)
+	}
+	collection, err := m.getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Export() error occurred connecting to Mongo", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Export() error occurred connecting to Mongo", 1060, err)
+	}
+	filter, err = m.tenantFilter(ctx, filter)
+	if err != nil {
+		return err
+	}
+	setStatement(ctx, filter)
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetBatchSize(int32(o.batchSize)))
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Export() Failed to find documents", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Export() Failed to find documents. Check the inner error.", 1060, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		if err := writer.write(cursor.Current()); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.Export() Failed to write document", "document", result.Documents+1, "error", err)
+			return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Export() Failed to write document %d. Check the inner error.", result.Documents+1), 1060, err)
+		}
+		result.Documents++
+		if result.Documents%int64(o.batchSize) == 0 {
+			o.report(result)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Export() Cursor error", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Export() Cursor error. Check the inner error.", 1060, err)
+	}
+	if err := writer.close(); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Export() Failed to write the export", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.Export() Failed to write the export. Check the inner error.", 1060, err)
+	}
+	o.report(result)
+	logging.InfoContext(ctx, "MongoDB.Export() Exported documents", "collection", collection.Name(), "format", format, "documents", result.Documents)
+
+	return nil
+}
+
+// Import streams documents from r into the collection of doc, writing them in batches. With tenancy by
+// field, documents without a tenant get the tenant of the operation and documents of another tenant fail
+// the import. Documents are written as they are read, so values of encrypted fields must already be encrypted,
+// as in an Export of the collection. The import stops at the first document that cannot be read or written;
+// earlier batches stay written and are counted in the result, which is also returned with the error.
+// Example:
+//
+//	f, err := os.Open("orders.ndjson")
+//	...
+//	result, err := mongoDB.Import(&Order{}, f, FormatNDJSON, ImportUpsert,
+//		TransferKeyFields("orderNumber"),
+//		TransferProgress(func(p TransferResult) { log.Printf("%d documents", p.Documents) }))
+func (m *MongoDB) Import(doc IMongoDocument, r io.Reader, format Format, mode ImportMode, opts ...TransferOption) (*TransferResult, error) {
+	result := &TransferResult{}
+	err := m.doOnce(opImport, doc, func(ctx context.Context) error {
+		return m.importDocuments(ctx, doc, r, format, mode, newTransferOptions(opts), result)
+	})
+	return result, err
+}
+
+func (m *MongoDB) importDocuments(ctx context.Context, doc IMongoDocument, r io.Reader, format Format, mode ImportMode, o transferOptions, result *TransferResult) error {
+	logging := m.Logger
+
+	if _, err := ParseImportMode(string(mode)); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Import() Invalid mode", "mode", mode, "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Import() Invalid mode: %s", err), 1060, err)
+	}
+	next, err := newDocumentReader(r, format)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.Import() Invalid format", "format", format, "error", err)
+		return errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.Import() Invalid format: %s", err), 1060, err)
+	}
+	return m.load(ctx, "MongoDB.Import()", doc, mode, o, result, next)
+}
+
+// load writes the documents returned by next, until it returns io.EOF, to the collection of doc in batches.
+// method names the public method in logs and errors.
+func (m *MongoDB) load(ctx context.Context, method string, doc IMongoDocument, mode ImportMode, o transferOptions, result *TransferResult, next func() (bson.D, error)) error {
+	logging := m.Logger
+
+	collection, err := m.getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, method+" error occurred connecting to Mongo", "error", err)
+		return errors.NewChuxDataStoreError(method+" error occurred connecting to Mongo", 1060, err)
+	}
+	// Cached documents and queries of the collection may all be stale once documents are imported
+	defer m.invalidateCollection(ctx, collection)
+
+	batch := make([]bson.D, 0, o.batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := m.writeBatch(ctx, collection, mode, o.keyFields, batch, result)
+		if err != nil {
+			first := result.Documents - int64(len(batch)) + 1
+			logging.ErrorContext(ctx, method+" Failed to write documents", "from", first, "to", result.Documents, "error", err)
+			return errors.NewChuxDataStoreError(fmt.Sprintf("%s Failed to write documents %d to %d: %s", method, first, result.Documents, err), 1060, err)
+		}
+		batch = batch[:0]
+		o.report(result)
+		return nil
+	}
+
+	for {
+		d, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.ErrorContext(ctx, method+" Failed to read document", "document", result.Documents+1, "error", err)
+			return errors.NewChuxDataStoreError(fmt.Sprintf("%s Failed to read document %d: %s", method, result.Documents+1, err), 1060, err)
+		}
+		if d, err = m.scopeImportedDocument(ctx, d); err != nil {
+			logging.ErrorContext(ctx, method+" The document is not in the tenant", "document", result.Documents+1, "error", err)
+			return err
+		}
+		result.Documents++
+		batch = append(batch, d)
+		if len(batch) >= o.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	logging.InfoContext(ctx, method+" Imported documents", "collection", collection.Name(), "mode", mode, "documents", result.Documents,
+		"inserted", result.Inserted, "matched", result.Matched, "modified", result.Modified, "upserted", result.Upserted)
+
+	return nil
+}
+
+// writeBatch writes a batch of imported documents and adds the counts to result.
+func (m *MongoDB) writeBatch(ctx context.Context, collection IMongoCollection, mode ImportMode, keyFields []string, batch []bson.D, result *TransferResult) error {
+	// the default is not stored in m, which can be shared by concurrent operations
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 // default value
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+	defer cancel()
+
+	if mode == ImportInsert {
+		docs := make([]interface{}, len(batch))
+		for i, d := range batch {
+			docs[i] = d
+		}
+		res, err := collection.InsertMany(ctx, docs)
+		if res != nil {
+			result.Inserted += int64(len(res.InsertedIDs))
+		}
+		return err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(batch))
+	for i, d := range batch {
+		if mode == ImportReplace {
+			id, ok := lookupPath(d, "_id")
+			if !ok {
+				id = primitive.NewObjectID()
+				d = append(bson.D{{Key: "_id", Value: id}}, d...)
+			}
+			filter := bson.M{"_id": id}
+			if err := m.scopeFilter(ctx, filter); err != nil {
+				return err
+			}
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(d).SetUpsert(true))
+			continue
+		}
+
+		filter := bson.M{}
+		for _, field := range keyFields {
+			value, ok := lookupPath(d, field)
+			if !ok {
+				return fmt.Errorf("document %d has no key field %s", result.Documents-int64(len(batch))+int64(i)+1, field)
+			}
+			filter[field] = value
+		}
+		if err := m.scopeFilter(ctx, filter); err != nil {
+			return err
+		}
+		set := make(bson.D, 0, len(d))
+		update := bson.D{}
+		for _, e := range d {
+			if e.Key == "_id" {
+				update = append(update, bson.E{Key: "$setOnInsert", Value: bson.D{e}})
+				continue
+			}
+			set = append(set, e)
+		}
+		if len(set) > 0 {
+			update = append(bson.D{{Key: "$set", Value: set}}, update...)
+		}
+		if len(update) == 0 {
+			update = bson.D{{Key: "$setOnInsert", Value: bson.D{}}}
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+	res, err := collection.BulkWrite(ctx, models)
+	if res != nil {
+		result.Matched += res.MatchedCount
+		result.Modified += res.ModifiedCount
+		result.Upserted += res.UpsertedCount
+	}
+	return err
+}
+
+// lookupPath returns the value of a dotted path in d.
+func lookupPath(d bson.D, path string) (interface{}, bool) {
+	// the documents of a CSV upsert hold their fields by dotted path
+	for _, e := range d {
+		if e.Key == path {
+			return e.Value, true
+		}
+	}
+	key, rest, nested := strings.Cut(path, ".")
+	for _, e := range d {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return e.Value, true
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			return lookupPath(sub, rest)
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// documentWriter writes documents in a Format.
+type documentWriter struct {
+	w      *bufio.Writer
+	format Format
+	count  int64
+}
+
+func newDocumentWriter(w io.Writer, format Format) (*documentWriter, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	return &documentWriter{w: bufio.NewWriter(w), format: format}, nil
+}
+
+func (d *documentWriter) write(raw bson.Raw) error {
+	d.count++
+	if d.format == FormatBSON {
+		_, err := d.w.Write(raw)
+		return err
+	}
+	data, err := bson.MarshalExtJSON(raw, d.format == FormatCanonicalExtJSON, false)
+	if err != nil {
+		return err
+	}
+	switch {
+	case d.format == FormatNDJSON:
+	case d.count == 1:
+		d.w.WriteString("[\n")
+	default:
+		d.w.WriteString(",\n")
+	}
+	d.w.Write(data)
+	if d.format == FormatNDJSON {
+		d.w.WriteByte('\n')
+	}
+	return nil
+}
+
+// close ends the JSON array, if any, and flushes the buffer.
+func (d *documentWriter) close() error {
+	switch {
+	case d.format == FormatBSON, d.format == FormatNDJSON:
+	case d.count == 0:
+		d.w.WriteString("[]\n")
+	default:
+		d.w.WriteString("\n]\n")
+	}
+	return d.w.Flush()
+}
+
+// newDocumentReader returns a function that reads the next document from r, or io.EOF after the last one.
+// The JSON formats accept a JSON array of documents as well as documents one after the other, so that
+// FormatExtJSON, FormatCanonicalExtJSON and FormatNDJSON can all read the output of mongoexport.
+func newDocumentReader(r io.Reader, format Format) (func() (bson.D, error), error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	if format == FormatBSON {
+		return func() (bson.D, error) {
+			return readBSONDocument(br)
+		}, nil
+	}
+
+	array, err := startsWithArray(br)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(br)
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return func() (bson.D, error) {
+		if array && !decoder.More() {
+			if _, err := decoder.Token(); err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			return nil, err
+		}
+		var d bson.D
+		if err := bson.UnmarshalExtJSON(data, false, &d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}, nil
+}
+
+// startsWithArray reports whether the first character of br that is not white space opens a JSON array.
+func startsWithArray(br *bufio.Reader) (bool, error) {
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '[', br.UnreadByte()
+	}
+}
+
+// readBSONDocument reads the next document of a BSON dump.
+func readBSONDocument(br *bufio.Reader) (bson.D, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated document length: %w", err)
+		}
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(header[:]))
+	if length < 5 || length > maxBSONDocumentSize {
+		return nil, fmt.Errorf("invalid document length %d", length)
+	}
+	raw := make(bson.Raw, length)
+	copy(raw, header[:])
+	if _, err := io.ReadFull(br, raw[4:]); err != nil {
+		return nil, fmt.Errorf("truncated document: %w", io.ErrUnexpectedEOF)
+	}
+	if err := raw.Validate(); err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
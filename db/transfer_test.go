@@ -0,0 +1,46 @@
+package db_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	formats := []db.Format{db.FormatExtJSON, db.FormatCanonicalExtJSON, db.FormatNDJSON, db.FormatBSON}
+	for _, format := range formats {
+		t.Run(string(format), func(t *testing.T) {
+			source := newFakeDB()
+			for _, p := range []*Person{{Name: "Jane", Age: 34}, {Name: "John", Age: 41}} {
+				if err := source.Upsert(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var buf bytes.Buffer
+			exported, err := source.Export(&Person{}, nil, &buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := newFakeDB()
+			imported, err := target.Import(&Person{}, &buf, format, db.ImportInsert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exported.Documents != 2 || imported.Inserted != 2 {
+				t.Errorf("exported %d and inserted %d documents, want 2 and 2", exported.Documents, imported.Inserted)
+			}
+			if target.Timeout != 0 {
+				t.Errorf("Import() changed the Timeout of the shared MongoDB to %v", target.Timeout)
+			}
+			people, err := target.Query(&Person{}, "name", "John")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(people) != 1 || people[0].(*Person).Age != 41 {
+				t.Errorf("Query() after Import() = %+v, want John", people)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UpdateBuilder builds an update document from update operators, so that only the named fields are
+// written instead of the whole struct. Field names are the bson names and can use dotted paths and the
+// positional operators $, $[] and $[<identifier>].
+// Example:
+//
+//	update := NewUpdate().
+//		Set("status", "shipped").
+//		Inc("version", 1).
+//		Push("history", event).
+//		CurrentDate("updatedAt")
+type UpdateBuilder struct {
+	operators    []string
+	fields       map[string]bson.D
+	paths        map[string]string
+	arrayFilters []interface{}
+	err          error
+}
+
+// UpdateResult holds the number of documents matched and modified by UpdateFields.
+type UpdateResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+}
+
+// NewUpdate returns an empty UpdateBuilder.
+func NewUpdate() *UpdateBuilder {
+	return &UpdateBuilder{
+		fields: map[string]bson.D{},
+		paths:  map[string]string{},
+	}
+}
+
+// Set sets field to value.
+func (u *UpdateBuilder) Set(field string, value interface{}) *UpdateBuilder {
+	return u.add("$set", field, value)
+}
+
+// Unset removes the fields from the document.
+func (u *UpdateBuilder) Unset(fields ...string) *UpdateBuilder {
+	for _, field := range fields {
+		u.add("$unset", field, "")
+	}
+	return u
+}
+
+// Inc adds amount to field. Use a negative amount to decrement.
+func (u *UpdateBuilder) Inc(field string, amount interface{}) *UpdateBuilder {
+	return u.add("$inc", field, amount)
+}
+
+// Push appends the values to the array field.
+func (u *UpdateBuilder) Push(field string, values ...interface{}) *UpdateBuilder {
+	return u.add("$push", field, each(values))
+}
+
+// Pull removes from the array field every element that equals condition or, when condition is a
+// query document such as bson.M{"$lt": 5}, every element that matches it.
+func (u *UpdateBuilder) Pull(field string, condition interface{}) *UpdateBuilder {
+	return u.add("$pull", field, condition)
+}
+
+// AddToSet adds the values to the array field unless they are already present.
+func (u *UpdateBuilder) AddToSet(field string, values ...interface{}) *UpdateBuilder {
+	return u.add("$addToSet", field, each(values))
+}
+
+// Min sets field to value if value is less than the current value.
+func (u *UpdateBuilder) Min(field string, value interface{}) *UpdateBuilder {
+	return u.add("$min", field, value)
+}
+
+// Max sets field to value if value is greater than the current value.
+func (u *UpdateBuilder) Max(field string, value interface{}) *UpdateBuilder {
+	return u.add("$max", field, value)
+}
+
+// CurrentDate sets the fields to the current date on the server.
+func (u *UpdateBuilder) CurrentDate(fields ...string) *UpdateBuilder {
+	for _, field := range fields {
+		u.add("$currentDate", field, true)
+	}
+	return u
+}
+
+// ArrayFilters adds the filters that select the array elements updated through $[<identifier>].
+// Example:
+//
+//	update := NewUpdate().
+//		Set("items.$[item].status", "backordered").
+//		ArrayFilters(bson.M{"item.sku": "A-100"})
+func (u *UpdateBuilder) ArrayFilters(filters ...interface{}) *UpdateBuilder {
+	u.arrayFilters = append(u.arrayFilters, filters...)
+	return u
+}
+
+// Document returns the update document, with the operators in the order they were first used.
+func (u *UpdateBuilder) Document() bson.D {
+	update := make(bson.D, 0, len(u.operators))
+	for _, operator := range u.operators {
+		update = append(update, bson.E{Key: operator, Value: u.fields[operator]})
+	}
+	return update
+}
+
+// Err returns the first error found while building the update, such as two operators on the same field.
+func (u *UpdateBuilder) Err() error {
+	if u.err == nil && len(u.operators) == 0 {
+		return fmt.Errorf("the update is empty")
+	}
+	return u.err
+}
+
+// add records field under operator. MongoDB rejects an update that touches the same path, or a path and
+// one of its parents, twice, so the conflict is reported here with the field names instead.
+func (u *UpdateBuilder) add(operator, field string, value interface{}) *UpdateBuilder {
+	if u.err != nil {
+		return u
+	}
+	switch {
+	case len(field) == 0:
+		u.err = fmt.Errorf("%s: the field name is empty", operator)
+		return u
+	case field == "_id" || strings.HasPrefix(field, "_id."):
+		u.err = fmt.Errorf("%s: the _id field cannot be updated", operator)
+		return u
+	case emptyEach(value):
+		u.err = fmt.Errorf("%s %s: no values were given", operator, field)
+		return u
+	}
+	for path, previous := range u.paths {
+		if path == field || strings.HasPrefix(field, path+".") || strings.HasPrefix(path, field+".") {
+			u.err = fmt.Errorf("%s %s conflicts with %s %s", operator, field, previous, path)
+			return u
+		}
+	}
+	if _, ok := u.fields[operator]; !ok {
+		u.operators = append(u.operators, operator)
+	}
+	u.fields[operator] = append(u.fields[operator], bson.E{Key: field, Value: value})
+	u.paths[field] = operator
+	return u
+}
+
+// each returns a single value as it is and several values wrapped in $each, as $push and $addToSet expect.
+func each(values []interface{}) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return bson.M{"$each": values}
+}
+
+// emptyEach reports whether value is the $each of no values, which would be sent as {$each: null}.
+func emptyEach(value interface{}) bool {
+	m, ok := value.(bson.M)
+	if !ok {
+		return false
+	}
+	values, ok := m["$each"].([]interface{})
+	return ok && len(values) == 0
+}
+
+// repeatable reports whether applying the update twice leaves the document as applying it once. $inc and
+// $push add to the document every time they run and $addToSet can add a value another writer removed in
+// between, so an update using them must not be retried after its reply was lost.
+func (u *UpdateBuilder) repeatable() bool {
+	for _, operator := range u.operators {
+		switch operator {
+		case "$inc", "$push", "$addToSet":
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateFields applies update to the document with the given id and reports how many documents were matched
+// and modified. Unlike Update, it only writes the fields named in the update, so concurrent edits of other
+// fields are kept. doc is only used to find the collection; it is not modified. An update using Inc, Push or
+// AddToSet is not retried by the RetryPolicy, since a network error can hide that it was applied; the
+// retryable writes of the driver still retry it safely.
+// Example:
+//
+//	result, err := mongoDB.UpdateFields(&Order{}, "5e9b9b9b9b9b9b9b9b9b9b9b",
+//		NewUpdate().Set("status", "shipped").CurrentDate("shippedAt"))
+//	if err != nil {
+//		return err
+//	}
+//	if result.MatchedCount == 0 {
+//		return ErrOrderNotFound
+//	}
+func (m *MongoDB) UpdateFields(doc IMongoDocument, id string, update *UpdateBuilder) (*UpdateResult, error) {
+	var result *UpdateResult
+	do := m.do
+	if update != nil && !update.repeatable() {
+		do = m.doOnce
+	}
+	err := do(opUpdateFields, doc, func(ctx context.Context) (err error) {
+		result, err = m.updateFields(ctx, doc, id, update)
+		return err
+	})
+	return result, err
+}
+
+func (m *MongoDB) updateFields(ctx context.Context, doc IMongoDocument, id string, update *UpdateBuilder) (*UpdateResult, error) {
+	logging := m.Logger
+
+	if update == nil {
+		update = NewUpdate()
+	}
+	if err := update.Err(); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.UpdateFields() Invalid update", "id", id, "error", err)
+		return nil, errors.NewChuxDataStoreError(fmt.Sprintf("MongoDB.UpdateFields() Invalid update: %s", err), 1030, err)
+	}
+
+	collection, err := m.getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.UpdateFields() error occurred connecting to Mongo", "error", err)
+		return nil, errors.NewChuxDataStoreError("MongoDB.UpdateFields() error occurred connecting to Mongo", 1031, err)
+	}
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.UpdateFields() Failed to Get ObjectIDFromHex", "id", id, "error", err)
+		return nil, errors.NewChuxDataStoreError("MongoDB.UpdateFields() Failed to Get ObjectIDFromHex. Check the inner error.", 1031, err)
+	}
+
+	// the default is not stored in m, which can be shared by concurrent operations
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 // default value
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+	defer cancel()
+
+	opts := options.Update()
+	if len(update.arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: update.arrayFilters})
+	}
+	document := update.Document()
+	for i, operator := range document {
+		if operator.Key != "$set" {
+			continue
+		}
+		// copy the $set fields so that encrypting them leaves the builder as it was
+		set := append(bson.D(nil), operator.Value.(bson.D)...)
+		if err := m.encryptSet(ctx, doc, set); err != nil {
+			logging.ErrorContext(ctx, "MongoDB.UpdateFields() Failed to encrypt the update", "id", id, "error", err)
+			return nil, errors.NewChuxDataStoreError("MongoDB.UpdateFields() Failed to encrypt the update. Check the inner error.", 1040, err)
+		}
+		document[i].Value = set
+	}
+	if err := m.scopeUpdate(document); err != nil {
+		logging.ErrorContext(ctx, "MongoDB.UpdateFields() Invalid update", "id", id, "error", err)
+		return nil, err
+	}
+	filter := bson.M{"_id": objectID}
+	if err := m.scopeFilter(ctx, filter); err != nil {
+		return nil, err
+	}
+	setStatement(ctx, filter)
+	res, err := collection.UpdateOne(ctx, filter, document, opts)
+	m.invalidate(ctx, collection, objectID)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.UpdateFields() Failed to Update", "id", id, "error", err)
+		return nil, errors.NewChuxDataStoreError("MongoDB.UpdateFields() Failed to Update. Check the inner error.", 1031, err)
+	}
+	logging.InfoContext(ctx, "MongoDB.UpdateFields() Updated document(s)", "id", id, "matched", res.MatchedCount, "modified", res.ModifiedCount)
+
+	return &UpdateResult{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount}, nil
+}
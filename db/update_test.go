@@ -0,0 +1,188 @@
+package db_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/mongofake"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestUpdateBuilder(t *testing.T) {
+	tests := []struct {
+		name   string
+		update *db.UpdateBuilder
+		want   bson.D
+	}{
+		{
+			name:   "set and inc",
+			update: db.NewUpdate().Set("name", "Jane").Inc("age", 1).Set("email", "jane@example.com"),
+			want: bson.D{
+				{Key: "$set", Value: bson.D{{Key: "name", Value: "Jane"}, {Key: "email", Value: "jane@example.com"}}},
+				{Key: "$inc", Value: bson.D{{Key: "age", Value: 1}}},
+			},
+		},
+		{
+			name:   "push one value",
+			update: db.NewUpdate().Push("tags", "ops"),
+			want:   bson.D{{Key: "$push", Value: bson.D{{Key: "tags", Value: "ops"}}}},
+		},
+		{
+			name:   "add several values to a set",
+			update: db.NewUpdate().AddToSet("tags", "ops", "dev"),
+			want:   bson.D{{Key: "$addToSet", Value: bson.D{{Key: "tags", Value: bson.M{"$each": []interface{}{"ops", "dev"}}}}}},
+		},
+		{
+			name:   "unset",
+			update: db.NewUpdate().Unset("email", "age"),
+			want:   bson.D{{Key: "$unset", Value: bson.D{{Key: "email", Value: ""}, {Key: "age", Value: ""}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.update.Err(); err != nil {
+				t.Fatalf("Err() = %v", err)
+			}
+			if got := tt.update.Document(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Document() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update *db.UpdateBuilder
+	}{
+		{name: "empty", update: db.NewUpdate()},
+		{name: "empty field name", update: db.NewUpdate().Set("", 1)},
+		{name: "_id", update: db.NewUpdate().Set("_id", 1)},
+		{name: "same field twice", update: db.NewUpdate().Set("age", 1).Inc("age", 1)},
+		{name: "field and its parent", update: db.NewUpdate().Set("address.city", "Lisbon").Unset("address")},
+		{name: "push no values", update: db.NewUpdate().Push("tags")},
+		{name: "add no values to a set", update: db.NewUpdate().AddToSet("tags")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.update.Err(); err == nil {
+				t.Errorf("Err() = nil, want an error for %v", tt.update.Document())
+			}
+		})
+	}
+}
+
+func TestUpdateFields(t *testing.T) {
+	client := mongofake.NewClient()
+	jane := &Person{Name: "Jane", Email: "jane@example.com", Age: 34}
+	if err := newFakeDB(db.WithClient(client)).Upsert(jane); err != nil {
+		t.Fatal(err)
+	}
+
+	mongoDB := newFakeDB(db.WithClient(client))
+
+	result, err := mongoDB.UpdateFields(&Person{}, jane.ID.Hex(), db.NewUpdate().Set("name", "Janet").Inc("age", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchedCount != 1 || result.ModifiedCount != 1 {
+		t.Errorf("UpdateFields() = %+v, want one matched and modified document", result)
+	}
+	found, err := mongoDB.GetByID(&Person{}, jane.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := found.(*Person); p.Name != "Janet" || p.Age != 35 || p.Email != "jane@example.com" {
+		t.Errorf("GetByID() = %+v, want the name and age updated and the email kept", p)
+	}
+	if mongoDB.Timeout != 0 {
+		t.Errorf("UpdateFields() changed the Timeout of the shared MongoDB to %v", mongoDB.Timeout)
+	}
+
+	if _, err := mongoDB.UpdateFields(&Person{}, jane.ID.Hex(), db.NewUpdate().Push("tags")); err == nil {
+		t.Error("UpdateFields() with a Push of no values succeeded")
+	}
+}
+
+// lostReplyClient is a client whose first UpdateOne is applied but fails with a network error, as when the
+// connection drops before the reply arrives.
+type lostReplyClient struct {
+	db.IMongoClient
+	lost bool
+}
+
+func (c *lostReplyClient) Database(name string, opts ...*options.DatabaseOptions) db.IMongoDatabase {
+	return &lostReplyDatabase{IMongoDatabase: c.IMongoClient.Database(name, opts...), client: c}
+}
+
+type lostReplyDatabase struct {
+	db.IMongoDatabase
+	client *lostReplyClient
+}
+
+func (d *lostReplyDatabase) Collection(name string, opts ...*options.CollectionOptions) db.IMongoCollection {
+	return &lostReplyCollection{IMongoCollection: d.IMongoDatabase.Collection(name, opts...), client: d.client}
+}
+
+type lostReplyCollection struct {
+	db.IMongoCollection
+	client *lostReplyClient
+}
+
+func (c *lostReplyCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	result, err := c.IMongoCollection.UpdateOne(ctx, filter, update, opts...)
+	if err == nil && !c.client.lost {
+		c.client.lost = true
+		return nil, mongo.CommandError{Code: 6, Name: "HostUnreachable", Labels: []string{"NetworkError"}}
+	}
+	return result, err
+}
+
+func TestUpdateFieldsRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  *db.UpdateBuilder
+		wantErr bool
+		want    Person
+	}{
+		{
+			name:   "set is retried",
+			update: db.NewUpdate().Set("name", "Janet").Max("age", 40),
+			want:   Person{Name: "Janet", Age: 40},
+		},
+		{
+			name:    "inc is not retried",
+			update:  db.NewUpdate().Set("name", "Janet").Inc("age", 1),
+			wantErr: true,
+			want:    Person{Name: "Janet", Age: 35},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := mongofake.NewClient()
+			jane := &Person{Name: "Jane", Age: 34}
+			if err := newFakeDB(db.WithClient(fake)).Upsert(jane); err != nil {
+				t.Fatal(err)
+			}
+			policy := db.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+			mongoDB := newFakeDB(db.WithClient(&lostReplyClient{IMongoClient: fake}), db.WithRetryPolicy(policy))
+
+			_, err := mongoDB.UpdateFields(&Person{}, jane.ID.Hex(), tt.update)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateFields() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			found, err := mongoDB.GetByID(&Person{}, jane.ID.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := found.(*Person); p.Name != tt.want.Name || p.Age != tt.want.Age {
+				t.Errorf("GetByID() = %+v, want the name %s and the age %d", p, tt.want.Name, tt.want.Age)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cacheWatchBackoff paces the attempts to reopen a change stream that dropped.
+var cacheWatchBackoff = RetryPolicy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// cacheWatchPipeline keeps only the fields of a change event needed to evict documents. The _id of the
+// event is kept because it is the resume token.
+var cacheWatchPipeline = mongo.Pipeline{
+	{{Key: "$project", Value: bson.D{{Key: "operationType", Value: 1}, {Key: "documentKey", Value: 1}}}},
+}
+
+// cacheWatcher evicts the cached documents of a collection that are changed by any writer.
+type cacheWatcher struct {
+	m          *MongoDB
+	collection IMongoCollection
+	namespace  string
+	token      bson.Raw
+}
+
+// changeEvent is the part of a change event read by a cacheWatcher.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// WatchCache keeps the cache coherent across processes by subscribing to the change stream of the collection
+// of doc: a document inserted, updated, replaced or deleted by any writer is evicted together with the cached
+// queries of the collection, and dropping or renaming the collection evicts all of its entries. WatchCache
+// returns once the stream is open and keeps watching in the background until ctx is cancelled.
+//
+// When the stream drops it is reopened with a backoff, resuming after the last event seen. Until then cached
+// documents are only refreshed when their TTL expires. If the stream cannot be resumed, events may have been
+// missed, so every entry of the collection is evicted. Change streams need a replica set or a sharded cluster.
+// With WithTenantDatabases, watch the database of each tenant with a context that carries the tenant.
+// Example:
+//
+//	mongoDB := New(
+//		WithCache(cache.NewLRU(10000), 5*time.Minute),
+//	)
+//	if err := mongoDB.WatchCache(ctx, &Country{}); err != nil {
+//		return err
+//	}
+func (m *MongoDB) WatchCache(ctx context.Context, doc IMongoDocument) error {
+	logging := m.Logger
+
+	if m.cache == nil {
+		logging.ErrorContext(ctx, "MongoDB.WatchCache() There is no cache to watch, use WithCache")
+		return errors.NewChuxDataStoreError("MongoDB.WatchCache() There is no cache to watch, use WithCache", 1045, nil)
+	}
+	collection, err := m.WithContext(ctx).getCollection(doc)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.WatchCache() error occurred connecting to Mongo", "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.WatchCache() error occurred connecting to Mongo", 1045, err)
+	}
+	w := &cacheWatcher{m: m, collection: collection, namespace: cacheNamespace(collection)}
+	stream, err := w.open(ctx)
+	if err != nil {
+		logging.ErrorContext(ctx, "MongoDB.WatchCache() Failed to open the change stream", "collection", collection.Name(), "error", err)
+		return errors.NewChuxDataStoreError("MongoDB.WatchCache() Failed to open the change stream. Check the inner error.", 1045, err)
+	}
+	logging.InfoContext(ctx, "MongoDB.WatchCache() Watching the collection", "database", collection.Database().Name(), "collection", collection.Name())
+
+	go w.run(ctx, stream)
+	return nil
+}
+
+// open opens the change stream, resuming after the last event seen when there is one.
+func (w *cacheWatcher) open(ctx context.Context) (IMongoChangeStream, error) {
+	if w.token == nil {
+		return w.collection.Watch(ctx, cacheWatchPipeline)
+	}
+	stream, err := w.collection.Watch(ctx, cacheWatchPipeline, options.ChangeStream().SetResumeAfter(w.token))
+	if err == nil {
+		return stream, nil
+	}
+	// The stream cannot be resumed, for example because the oplog moved past the token or the collection
+	// was dropped. Start a new stream and evict what the missed events may have changed.
+	w.m.Logger.WarningContext(ctx, "MongoDB.WatchCache() Could not resume the change stream, evicting the collection", "collection", w.collection.Name(), "error", err)
+	w.token = nil
+	stream, err = w.collection.Watch(ctx, cacheWatchPipeline)
+	if err == nil {
+		w.m.cache.cache.DeletePrefix(ctx, w.namespace)
+	}
+	return stream, err
+}
+
+// run watches the stream and reopens it when it drops, until ctx is cancelled.
+func (w *cacheWatcher) run(ctx context.Context, stream IMongoChangeStream) {
+	logging := w.m.Logger
+	for {
+		w.watch(ctx, stream)
+		err := stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		logging.WarningContext(ctx, "MongoDB.WatchCache() The change stream dropped, cached documents expire after their TTL until it is reopened", "collection", w.collection.Name(), "error", err)
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cacheWatchBackoff.backoff(attempt)):
+			}
+			if stream, err = w.open(ctx); err == nil {
+				break
+			}
+			logging.WarningContext(ctx, "MongoDB.WatchCache() Failed to reopen the change stream", "collection", w.collection.Name(), "attempt", attempt, "error", err)
+		}
+		logging.InfoContext(ctx, "MongoDB.WatchCache() Reopened the change stream", "collection", w.collection.Name())
+	}
+}
+
+// watch evicts the documents named by the events of the stream until it ends.
+func (w *cacheWatcher) watch(ctx context.Context, stream IMongoChangeStream) {
+	for stream.Next(ctx) {
+		var e changeEvent
+		if err := stream.Decode(&e); err != nil {
+			w.m.Logger.WarningContext(ctx, "MongoDB.WatchCache() Could not decode a change event, evicting the collection", "collection", w.collection.Name(), "error", err)
+			w.m.cache.cache.DeletePrefix(ctx, w.namespace)
+		} else {
+			w.evict(ctx, e)
+		}
+		w.token = stream.ResumeToken()
+	}
+}
+
+// evict removes the cache entries a change event makes stale.
+func (w *cacheWatcher) evict(ctx context.Context, e changeEvent) {
+	switch e.OperationType {
+	case "insert", "update", "replace", "delete":
+		if id, ok := e.DocumentKey.ID.(primitive.ObjectID); ok {
+			w.m.invalidate(ctx, w.collection, id)
+			return
+		}
+	}
+	// drop, rename, dropDatabase and invalidate events, and documents whose _id is not an ObjectID
+	w.m.cache.cache.DeletePrefix(ctx, w.namespace)
+}
@@ -0,0 +1,280 @@
+// Package encryption encrypts string values with AES-GCM under keys supplied by a pluggable key provider.
+// It is used by the db package for struct fields tagged datastore:"encrypt".
+//
+// A ciphertext is a string that starts with Prefix and names the key it was encrypted with, so keys can be
+// rotated: new values are encrypted with the current key and old values are still decrypted with theirs.
+//
+// Values encrypted in deterministic mode always produce the same ciphertext for the same plaintext and key,
+// which keeps them equality-queryable at the cost of revealing which values are equal.
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Prefix starts every ciphertext produced by an Encryptor.
+const Prefix = "chuxenc:"
+
+const (
+	version           byte = 1
+	modeRandom        byte = 'r'
+	modeDeterministic byte = 'd'
+	nonceSize              = 12
+)
+
+// ErrUnknownKey is returned when a key provider does not know a key id.
+var ErrUnknownKey = errors.New("encryption: unknown key")
+
+// ErrInvalidCiphertext is returned when a value that starts with Prefix cannot be decoded or authenticated.
+var ErrInvalidCiphertext = errors.New("encryption: invalid ciphertext")
+
+// IKeyProvider supplies the keys used to encrypt and decrypt values. Keys are 16, 24 or 32 bytes long for
+// AES-128, AES-192 or AES-256. A provider backed by a KMS can fetch and cache keys in Key.
+type IKeyProvider interface {
+	// CurrentKeyID returns the id of the key new values are encrypted with.
+	CurrentKeyID(ctx context.Context) (string, error)
+	// Key returns the key with the given id, or an error wrapping ErrUnknownKey.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// IKeyLister can be implemented by an IKeyProvider to list every key that may still be in use. It lets
+// equality queries on deterministic fields match values encrypted with keys that have been rotated out.
+type IKeyLister interface {
+	KeyIDs(ctx context.Context) ([]string, error)
+}
+
+// KeyRing is an in-memory IKeyProvider and IKeyLister that supports rotation.
+// Example:
+//
+//	ring, err := encryption.NewKeyRing("2024-01", map[string][]byte{"2024-01": key})
+//	...
+//	// later, encrypt new values with a new key and keep decrypting the old ones
+//	err = ring.Rotate("2024-06", newKey)
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+	order   []string
+}
+
+// NewKeyRing returns a KeyRing holding keys whose current key is currentID.
+func NewKeyRing(currentID string, keys map[string][]byte) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[string][]byte{}}
+	for id, key := range keys {
+		if err := ring.add(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ring.keys[currentID]; !ok {
+		return nil, fmt.Errorf("%w %q: the current key is not in the key ring", ErrUnknownKey, currentID)
+	}
+	ring.current = currentID
+	return ring, nil
+}
+
+// Rotate adds key under id and makes it the current key. Existing keys are kept for decryption.
+func (r *KeyRing) Rotate(id string, key []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.add(id, key); err != nil {
+		return err
+	}
+	r.current = id
+	return nil
+}
+
+// add stores a key; the caller holds the lock or owns the ring.
+func (r *KeyRing) add(id string, key []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("encryption: key id must be 1 to 255 bytes long, got %d", len(id))
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("encryption: key %q must be 16, 24 or 32 bytes long, got %d", id, len(key))
+	}
+	if _, ok := r.keys[id]; !ok {
+		r.order = append(r.order, id)
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// CurrentKeyID implements IKeyProvider.
+func (r *KeyRing) CurrentKeyID(context.Context) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, nil
+}
+
+// Key implements IKeyProvider.
+func (r *KeyRing) Key(_ context.Context, id string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// KeyIDs implements IKeyLister. The current key comes first.
+func (r *KeyRing) KeyIDs(context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := []string{r.current}
+	for _, id := range r.order {
+		if id != r.current {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Encryptor encrypts and decrypts values with the keys of an IKeyProvider.
+type Encryptor struct {
+	provider IKeyProvider
+}
+
+// New returns an Encryptor that uses provider.
+func New(provider IKeyProvider) *Encryptor {
+	return &Encryptor{provider: provider}
+}
+
+// Encrypt encrypts plaintext with the current key. In deterministic mode the nonce is derived from the
+// plaintext, so equal values produce equal ciphertexts.
+func (e *Encryptor) Encrypt(ctx context.Context, plaintext string, deterministic bool) (string, error) {
+	id, err := e.provider.CurrentKeyID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return e.encryptWith(ctx, id, plaintext, deterministic)
+}
+
+// EncryptForQuery returns the deterministic ciphertexts of plaintext under every key the provider lists,
+// or under the current key when the provider does not implement IKeyLister. Matching any of them finds
+// the value whichever key it was written with.
+func (e *Encryptor) EncryptForQuery(ctx context.Context, plaintext string) ([]string, error) {
+	var ids []string
+	if lister, ok := e.provider.(IKeyLister); ok {
+		listed, err := lister.KeyIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = listed
+	} else {
+		id, err := e.provider.CurrentKeyID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = []string{id}
+	}
+	ciphertexts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		ciphertext, err := e.encryptWith(ctx, id, plaintext, true)
+		if err != nil {
+			return nil, err
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	return ciphertexts, nil
+}
+
+// Decrypt decrypts a value produced by Encrypt with the key it names.
+func (e *Encryptor) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	if !IsEncrypted(ciphertext) {
+		return "", ErrInvalidCiphertext
+	}
+	data, err := base64.RawURLEncoding.DecodeString(ciphertext[len(Prefix):])
+	if err != nil || len(data) < 3 || data[0] != version {
+		return "", ErrInvalidCiphertext
+	}
+	idLen := int(data[2])
+	if len(data) < 3+idLen+nonceSize {
+		return "", ErrInvalidCiphertext
+	}
+	header := data[:3+idLen]
+	id := string(header[3:])
+	nonce := data[len(header) : len(header)+nonceSize]
+	sealed := data[len(header)+nonceSize:]
+
+	key, err := e.provider.Key(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether value looks like a ciphertext produced by an Encryptor.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+func (e *Encryptor) encryptWith(ctx context.Context, id, plaintext string, deterministic bool) (string, error) {
+	if len(id) == 0 || len(id) > 255 {
+		return "", fmt.Errorf("encryption: key id must be 1 to 255 bytes long, got %d", len(id))
+	}
+	key, err := e.provider.Key(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	mode := modeRandom
+	if deterministic {
+		mode = modeDeterministic
+	}
+	// the header is authenticated, so the key id and mode cannot be swapped
+	header := append([]byte{version, mode, byte(len(id))}, id...)
+
+	nonce := make([]byte, nonceSize)
+	if deterministic {
+		mac := hmac.New(sha256.New, nonceKey(key))
+		mac.Write(header)
+		mac.Write([]byte(plaintext))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	data := append(header, nonce...)
+	data = aead.Seal(data, nonce, []byte(plaintext), header)
+	return Prefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// nonceKey derives the key of the HMAC that makes deterministic nonces, so the encryption key itself is
+// never used for two purposes.
+func nonceKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chux-datastore deterministic nonce"))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,5 +1,24 @@
 package errors
 
+import "github.com/chuxorg/chux-datastore/redact"
+
+// ErrCircuitOpen is wrapped by the ChuxDataStoreError that is returned
+// when an operation is rejected because the circuit breaker is open.
+// Use errors.Is to check for it:
+//
+//	if errors.Is(err, dserrors.ErrCircuitOpen) {
+//		// fail fast, the datastore is unavailable
+//	}
+var ErrCircuitOpen = NewChuxDataStoreError("circuit breaker is open", 1100, nil)
+
+// ErrTenantRequired is wrapped by the ChuxDataStoreError that is returned
+// when tenancy is enabled and an operation has no tenant.
+var ErrTenantRequired = NewChuxDataStoreError("tenant is required", 1050, nil)
+
+// ErrTenantMismatch is wrapped by the ChuxDataStoreError that is returned
+// when a write would put a document in another tenant.
+var ErrTenantMismatch = NewChuxDataStoreError("document belongs to another tenant", 1052, nil)
+
 // ChuxDataStoreError is a custom error type
 // that wraps an error and adds a message
 // to the error.
@@ -20,10 +39,12 @@ type ChuxDataStoreError struct {
 }
 
 // NewChuxParserError returns a new ChuxDataStoreError
+// Credentials in MongoDB connection strings found in the
+// message or in the wrapped error's message are masked.
 func NewChuxDataStoreError(message string, code int, err error) *ChuxDataStoreError {
 	return &ChuxDataStoreError{
-		Message: message,
-		Err:     err,
+		Message: redact.String(message),
+		Err:     redact.Error(err),
 		code:    code,
 	}
 }
@@ -32,6 +53,12 @@ func (e *ChuxDataStoreError) Error() string {
 	return e.Message
 }
 
+// Code returns the numeric code that identifies
+// where in chux-datastore the error occurred.
+func (e *ChuxDataStoreError) Code() int {
+	return e.code
+}
+
 // Unwrap returns the underlying error without
 // the message added by chux-parser.
 func (e *ChuxDataStoreError) Unwrap() error {
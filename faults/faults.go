@@ -0,0 +1,410 @@
+// Package faults injects errors, latency and partial failures into the operations of a db.IMongoDB, so that
+// the retry, fallback and error mapping code of a service can be tested without breaking a server. The
+// errors are ChuxDataStoreErrors with the codes the real operations return, wrapping the driver errors
+// that IsRetryable, mongo.IsTimeout, mongo.IsNetworkError and mongo.IsDuplicateKeyError recognise.
+//
+//	store := faults.New(mongoDB, faults.WithRules(
+//		faults.Fail(faults.NetworkError).On(faults.OpGetByID).WithProbability(0.3),
+//		faults.Fail(faults.DuplicateKey).On(faults.OpUpsert).In("orders").Times(1),
+//		faults.Latency(200*time.Millisecond).On(faults.OpQuery),
+//	))
+package faults
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The operations of db.IMongoDB, as rules name them.
+const (
+	OpUpsert        = "Upsert"
+	OpGetByID       = "GetByID"
+	OpQuery         = "Query"
+	OpGetAll        = "GetAll"
+	OpUpdate        = "Update"
+	OpUpdateFields  = "UpdateFields"
+	OpDelete        = "Delete"
+	OpDeleteAll     = "DeleteAll"
+	OpCreateIndices = "CreateIndices"
+)
+
+// codes are the ChuxDataStoreError codes the operations of db.MongoDB return when MongoDB fails.
+var codes = map[string]int{
+	OpUpsert:        1005,
+	OpGetByID:       1003,
+	OpQuery:         1006,
+	OpGetAll:        1004,
+	OpUpdate:        1004,
+	OpUpdateFields:  1031,
+	OpDelete:        1005,
+	OpDeleteAll:     1005,
+	OpCreateIndices: 1000,
+}
+
+// Fault returns the error injected into an operation.
+type Fault func(operation string) error
+
+var (
+	// Timeout fails the operation as when its context deadline passes.
+	Timeout Fault = func(operation string) error {
+		return injected(operation, "timeout", context.DeadlineExceeded)
+	}
+	// NetworkError fails the operation as when the connection to the server drops. It is retryable.
+	NetworkError Fault = func(operation string) error {
+		return injected(operation, "network error", mongo.CommandError{
+			Code:    6,
+			Name:    "HostUnreachable",
+			Message: "connection reset by peer",
+			Labels:  []string{"NetworkError"},
+		})
+	}
+	// PrimaryStepDown fails the operation as during a replica set election. It is retryable.
+	PrimaryStepDown Fault = func(operation string) error {
+		return injected(operation, "primary step down", mongo.CommandError{
+			Code:    10107,
+			Name:    "NotWritablePrimary",
+			Message: "not primary",
+			Labels:  []string{"RetryableWriteError"},
+		})
+	}
+	// DuplicateKey fails the operation with a duplicate key error on the _id index.
+	DuplicateKey Fault = func(operation string) error {
+		return injected(operation, "duplicate key", mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+			Code:    11000,
+			Message: "E11000 duplicate key error index: _id_",
+		}}})
+	}
+	// NotFound fails the operation as GetByID fails for a missing document.
+	NotFound Fault = func(operation string) error {
+		return errors.NewChuxDataStoreError("Document not found.", codes[operation], mongo.ErrNoDocuments)
+	}
+	// CircuitOpen fails the operation as when the circuit breaker is open.
+	CircuitOpen Fault = func(operation string) error {
+		return errors.ErrCircuitOpen
+	}
+)
+
+// Err returns a Fault failing with err. A ChuxDataStoreError is returned as it is; any other error is
+// wrapped in one with the code of the operation.
+func Err(err error) Fault {
+	return func(operation string) error {
+		if _, ok := err.(*errors.ChuxDataStoreError); ok {
+			return err
+		}
+		return injected(operation, "error", err)
+	}
+}
+
+// injected returns the ChuxDataStoreError of an injected fault.
+func injected(operation, name string, err error) error {
+	msg := fmt.Sprintf("MongoDB.%s() Injected %s. Check the inner error.", operation, name)
+	return errors.NewChuxDataStoreError(msg, codes[operation], err)
+}
+
+// Rule says which operations get a fault or latency, and how often.
+type Rule struct {
+	fault       Fault
+	latency     time.Duration
+	operations  map[string]bool
+	collections map[string]bool
+	probability float64
+	times       int
+	after       bool
+	injected    int
+}
+
+// Fail returns a Rule that fails every operation with fault.
+func Fail(fault Fault) *Rule {
+	return &Rule{fault: fault, probability: 1}
+}
+
+// Latency returns a Rule that delays every operation by d.
+func Latency(d time.Duration) *Rule {
+	return &Rule{latency: d, probability: 1}
+}
+
+// On limits the rule to the given operations, such as OpUpsert.
+func (r *Rule) On(operations ...string) *Rule {
+	r.operations = set(r.operations, operations)
+	return r
+}
+
+// In limits the rule to the operations on the given collections.
+func (r *Rule) In(collections ...string) *Rule {
+	r.collections = set(r.collections, collections)
+	return r
+}
+
+// WithProbability applies the rule to a matching operation with probability p, between 0 and 1.
+func (r *Rule) WithProbability(p float64) *Rule {
+	r.probability = p
+	return r
+}
+
+// WithLatency delays the operations the rule applies to by d, before the fault is returned.
+func (r *Rule) WithLatency(d time.Duration) *Rule {
+	r.latency = d
+	return r
+}
+
+// Times stops applying the rule after n operations. The default of 0 applies it to every operation.
+func (r *Rule) Times(n int) *Rule {
+	r.times = n
+	return r
+}
+
+// After runs the operation before the fault is returned, a partial failure: a write is applied, but the
+// caller sees an error, as when the acknowledgement of a write is lost.
+func (r *Rule) After() *Rule {
+	r.after = true
+	return r
+}
+
+func set(s map[string]bool, values []string) map[string]bool {
+	if s == nil {
+		s = map[string]bool{}
+	}
+	for _, v := range values {
+		s[v] = true
+	}
+	return s
+}
+
+// Option configures an Injector.
+type Option func(*Injector)
+
+// WithRules adds rules to the Injector.
+func WithRules(rules ...*Rule) Option {
+	return func(s *Injector) {
+		s.rules = append(s.rules, rules...)
+	}
+}
+
+// WithSeed seeds the random numbers of the rule probabilities, so that a test injects the same faults on
+// every run.
+func WithSeed(seed int64) Option {
+	return func(s *Injector) {
+		s.random = rand.New(rand.NewSource(seed))
+	}
+}
+
+// Injector is a db.IMongoDB that injects the faults of its rules into the operations of another. The rules
+// are tried in order: every matching rule adds its latency and the first matching rule with a fault fails
+// the operation. It is safe for concurrent use.
+type Injector struct {
+	next   db.IMongoDB
+	mu     sync.Mutex
+	rules  []*Rule
+	random *rand.Rand
+}
+
+// New returns an Injector running the operations of next.
+func New(next db.IMongoDB, options ...Option) *Injector {
+	i := &Injector{next: next}
+	for _, option := range options {
+		option(i)
+	}
+	if i.random == nil {
+		i.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return i
+}
+
+// Add adds rules after the existing ones.
+func (i *Injector) Add(rules ...*Rule) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = append(i.rules, rules...)
+}
+
+// Clear removes every rule, the operations run without faults.
+func (i *Injector) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = nil
+}
+
+// Injected returns how many operations the rule was applied to.
+func (i *Injector) Injected(r *Rule) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return r.injected
+}
+
+// inject applies the rules to an operation. It waits for their latency and returns the fault to return
+// before running the operation, or after it for a partial failure.
+func (i *Injector) inject(operation string, doc db.IMongoDocument) (before, after error) {
+	collection := doc.GetCollectionName()
+	if m, ok := i.next.(*db.MongoDB); ok && len(collection) == 0 {
+		collection = m.CollectionName
+	}
+
+	var latency time.Duration
+	var fault *Rule
+	i.mu.Lock()
+	for _, r := range i.rules {
+		if (r.operations != nil && !r.operations[operation]) ||
+			(r.collections != nil && !r.collections[collection]) ||
+			(r.times > 0 && r.injected >= r.times) ||
+			i.random.Float64() >= r.probability {
+			continue
+		}
+		r.injected++
+		latency += r.latency
+		if r.fault != nil {
+			fault = r
+			break
+		}
+	}
+	i.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fault == nil {
+		return nil, nil
+	}
+	if fault.after {
+		return nil, fault.fault(operation)
+	}
+	return fault.fault(operation), nil
+}
+
+// Upsert runs db.IMongoDB.Upsert with the faults of the rules.
+func (i *Injector) Upsert(doc db.IMongoDocument, filterFields ...string) error {
+	before, after := i.inject(OpUpsert, doc)
+	if before != nil {
+		return before
+	}
+	if err := i.next.Upsert(doc, filterFields...); err != nil {
+		return err
+	}
+	return after
+}
+
+// GetByID runs db.IMongoDB.GetByID with the faults of the rules.
+func (i *Injector) GetByID(doc db.IMongoDocument, id string) (interface{}, error) {
+	before, after := i.inject(OpGetByID, doc)
+	if before != nil {
+		return nil, before
+	}
+	found, err := i.next.GetByID(doc, id)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		return nil, after
+	}
+	return found, nil
+}
+
+// Query runs db.IMongoDB.Query with the faults of the rules.
+func (i *Injector) Query(doc db.IMongoDocument, queries ...interface{}) ([]db.IMongoDocument, error) {
+	before, after := i.inject(OpQuery, doc)
+	if before != nil {
+		return nil, before
+	}
+	docs, err := i.next.Query(doc, queries...)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		return nil, after
+	}
+	return docs, nil
+}
+
+// GetAll runs db.IMongoDB.GetAll with the faults of the rules.
+func (i *Injector) GetAll(doc db.IMongoDocument) ([]db.IMongoDocument, error) {
+	before, after := i.inject(OpGetAll, doc)
+	if before != nil {
+		return nil, before
+	}
+	docs, err := i.next.GetAll(doc)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		return nil, after
+	}
+	return docs, nil
+}
+
+// Update runs db.IMongoDB.Update with the faults of the rules.
+func (i *Injector) Update(doc db.IMongoDocument, id string) error {
+	before, after := i.inject(OpUpdate, doc)
+	if before != nil {
+		return before
+	}
+	if err := i.next.Update(doc, id); err != nil {
+		return err
+	}
+	return after
+}
+
+// UpdateFields runs db.IMongoDB.UpdateFields with the faults of the rules.
+func (i *Injector) UpdateFields(doc db.IMongoDocument, id string, update *db.UpdateBuilder) (*db.UpdateResult, error) {
+	before, after := i.inject(OpUpdateFields, doc)
+	if before != nil {
+		return nil, before
+	}
+	result, err := i.next.UpdateFields(doc, id, update)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		return nil, after
+	}
+	return result, nil
+}
+
+// Delete runs db.IMongoDB.Delete with the faults of the rules.
+func (i *Injector) Delete(doc db.IMongoDocument, id string) error {
+	before, after := i.inject(OpDelete, doc)
+	if before != nil {
+		return before
+	}
+	if err := i.next.Delete(doc, id); err != nil {
+		return err
+	}
+	return after
+}
+
+// DeleteAll runs db.IMongoDB.DeleteAll with the faults of the rules.
+func (i *Injector) DeleteAll(doc db.IMongoDocument) (int64, error) {
+	before, after := i.inject(OpDeleteAll, doc)
+	if before != nil {
+		return 0, before
+	}
+	deleted, err := i.next.DeleteAll(doc)
+	if err != nil {
+		return deleted, err
+	}
+	if after != nil {
+		return 0, after
+	}
+	return deleted, nil
+}
+
+// CreateIndices runs db.IMongoDB.CreateIndices with the faults of the rules.
+func (i *Injector) CreateIndices(doc db.IMongoDocument, fieldNames ...string) (bool, error) {
+	before, after := i.inject(OpCreateIndices, doc)
+	if before != nil {
+		return false, before
+	}
+	created, err := i.next.CreateIndices(doc, fieldNames...)
+	if err != nil {
+		return created, err
+	}
+	if after != nil {
+		return false, after
+	}
+	return created, nil
+}
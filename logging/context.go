@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey int
+
+const (
+	fieldsKey contextKey = iota
+)
+
+// RequestIDKey is the attribute key used for the request ID stored by ContextWithRequestID.
+const RequestIDKey = "requestId"
+
+// ContextWithFields returns a copy of ctx that carries the given key/value pairs. Every record
+// logged with that context through a Logger (or a handler wrapped by NewContextHandler) includes them.
+// Fields already stored in ctx are kept.
+// Example:
+//
+//	ctx = logging.ContextWithFields(ctx, "tenant", "acme", "user", userID)
+func ContextWithFields(ctx context.Context, args ...any) context.Context {
+	attrs := append(FieldsFromContext(ctx), argsToAttrs(args)...)
+	return context.WithValue(ctx, fieldsKey, attrs)
+}
+
+// ContextWithRequestID returns a copy of ctx that carries the given request ID.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return ContextWithFields(ctx, RequestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID stored by ContextWithRequestID, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	for _, attr := range FieldsFromContext(ctx) {
+		if attr.Key == RequestIDKey {
+			return attr.Value.String(), true
+		}
+	}
+	return "", false
+}
+
+// FieldsFromContext returns the fields stored in ctx by ContextWithFields.
+func FieldsFromContext(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(fieldsKey).([]slog.Attr)
+	// copy so that appending to the result never writes into a parent context's slice
+	return append([]slog.Attr(nil), attrs...)
+}
+
+// ContextHandler is a slog.Handler that adds the fields stored in the record's context
+// before passing it on to the wrapped handler.
+type ContextHandler struct {
+	next slog.Handler
+}
+
+// NewContextHandler wraps h so that context-scoped fields are added to every record.
+// Wrapping an already wrapped handler returns it unchanged.
+func NewContextHandler(h slog.Handler) slog.Handler {
+	if ch, ok := h.(*ContextHandler); ok {
+		return ch
+	}
+	return &ContextHandler{next: h}
+}
+
+func (h *ContextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs := FieldsFromContext(ctx); len(attrs) > 0 {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{next: h.next.WithGroup(name)}
+}
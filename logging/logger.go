@@ -1,10 +1,12 @@
 package logging
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -17,68 +19,208 @@ const (
 	LogLevelError
 )
 
+// Level returns the slog.Level that corresponds to the LogLevel.
+func (l LogLevel) Level() slog.Level {
+	switch l {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarning:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// Logger is a leveled, structured logger. Every logging method takes a message
+// followed by alternating key/value pairs (or slog.Attr values), the same way
+// log/slog does:
+//
+//	logger.Info("MongoDB.Update() Updated document(s)", "modified", result.ModifiedCount)
+//
+// The records are written to a slog.Handler, so any handler can be used as the
+// backend. See NewTextLogger, NewJSONLogger and New. Credentials in MongoDB
+// connection strings are masked before a record reaches the handler.
 type Logger struct {
-	*log.Logger
-	level LogLevel
+	handler slog.Handler
+	level   *slog.LevelVar
+	output  *syncWriter
 }
 
+// NewLogger returns a Logger that writes text records to stdout at the given level.
 func NewLogger(level LogLevel) *Logger {
+	return NewTextLogger(os.Stdout, level)
+}
+
+// NewTextLogger returns a Logger that writes key=value text records to w.
+func NewTextLogger(w io.Writer, level LogLevel) *Logger {
+	return newWriterLogger(w, level, func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewTextHandler(w, opts)
+	})
+}
+
+// NewJSONLogger returns a Logger that writes one JSON object per record to w.
+func NewJSONLogger(w io.Writer, level LogLevel) *Logger {
+	return newWriterLogger(w, level, func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewJSONHandler(w, opts)
+	})
+}
+
+// New returns a Logger that writes to the given handler. Filtering is left to the
+// handler; SetLogLevel can be used to raise the minimum level further.
+// Example:
+//
+//	logger := logging.New(slog.NewJSONHandler(os.Stderr, nil))
+func New(handler slog.Handler) *Logger {
+	level := &slog.LevelVar{}
+	level.Set(slog.LevelDebug)
 	return &Logger{
-		Logger: log.New(os.Stdout, "", 0),
-		level:  level,
+		handler: NewContextHandler(NewRedactHandler(handler)),
+		level:   level,
 	}
 }
 
-func (l *Logger) iso8601Formatter(prefix, format string, v ...interface{}) string {
-	now := time.Now().UTC().Format(time.RFC3339)
-	msg := fmt.Sprintf(format, v...)
-	return fmt.Sprintf("%s%s %s\n", prefix, now, msg)
+func newWriterLogger(w io.Writer, level LogLevel, build func(io.Writer, *slog.HandlerOptions) slog.Handler) *Logger {
+	levelVar := &slog.LevelVar{}
+	levelVar.Set(level.Level())
+	output := &syncWriter{w: w}
+	handler := build(output, &slog.HandlerOptions{Level: levelVar})
+	return &Logger{
+		handler: NewContextHandler(NewRedactHandler(handler)),
+		level:   levelVar,
+		output:  output,
+	}
 }
 
+// SetOutput changes the destination of a Logger created by NewLogger, NewTextLogger
+// or NewJSONLogger. It has no effect on a Logger created from a custom handler.
 func (l *Logger) SetOutput(w io.Writer) {
-	l.Logger.SetOutput(w)
+	if l == nil || l.output == nil {
+		return
+	}
+	l.output.set(w)
 }
 
+// SetLogLevel changes the minimum level that is logged.
 func (l *Logger) SetLogLevel(level LogLevel) {
-	l.level = level
-}
-
-func (l *Logger) Info(format string, v ...interface{}) {
 	if l == nil {
-		log.Printf("[INFO] "+format+"\n", v...)
 		return
 	}
-	if l.level <= LogLevelInfo {
-		l.Output(2, l.iso8601Formatter("[INFO] chux-datastore ", format, v...))
-	}
+	l.level.Set(level.Level())
 }
 
-func (l *Logger) Debug(format string, v ...interface{}) {
+// Handler returns the slog.Handler the Logger writes to.
+func (l *Logger) Handler() slog.Handler {
 	if l == nil {
-		log.Printf("[DEBUG] "+format+"\n", v...)
-		return
-	}
-	if l.level <= LogLevelDebug {
-		l.Output(2, l.iso8601Formatter("[DEBUG] chux-datastore ", format, v...))
+		return slog.Default().Handler()
 	}
+	return l.handler
 }
 
-func (l *Logger) Warning(format string, v ...interface{}) {
+// With returns a Logger that includes the given key/value pairs in every record.
+func (l *Logger) With(args ...any) *Logger {
 	if l == nil {
-		log.Printf("[WARNING] "+format+"\n", v...)
-		return
+		return New(slog.Default().Handler()).With(args...)
 	}
-	if l.level <= LogLevelWarning {
-		l.Output(2, l.iso8601Formatter("[WARNING] chux-datastore ", format, v...))
+	if len(args) == 0 {
+		return l
 	}
+	c := *l
+	c.handler = l.handler.WithAttrs(argsToAttrs(args))
+	return &c
 }
 
-func (l *Logger) Error(format string, v ...interface{}) {
-	if l == nil {
-		log.Printf("[ERROR] "+format+"\n", v...)
-		return
+func (l *Logger) Debug(msg string, args ...any) {
+	l.log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...any) {
+	l.log(context.Background(), slog.LevelInfo, msg, args...)
+}
+
+func (l *Logger) Warning(msg string, args ...any) {
+	l.log(context.Background(), slog.LevelWarn, msg, args...)
+}
+
+func (l *Logger) Error(msg string, args ...any) {
+	l.log(context.Background(), slog.LevelError, msg, args...)
+}
+
+// DebugContext logs at debug level and includes the fields stored in ctx.
+func (l *Logger) DebugContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, slog.LevelDebug, msg, args...)
+}
+
+// InfoContext logs at info level and includes the fields stored in ctx.
+func (l *Logger) InfoContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, slog.LevelInfo, msg, args...)
+}
+
+// WarningContext logs at warning level and includes the fields stored in ctx.
+func (l *Logger) WarningContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, slog.LevelWarn, msg, args...)
+}
+
+// ErrorContext logs at error level and includes the fields stored in ctx.
+func (l *Logger) ErrorContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, slog.LevelError, msg, args...)
+}
+
+func (l *Logger) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	if l.level <= LogLevelError {
-		l.Output(2, l.iso8601Formatter("[ERROR] chux-datastore ", format, v...))
+	handler := defaultHandler()
+	if l != nil {
+		if level < l.level.Level() {
+			return
+		}
+		handler = l.handler
 	}
+	if !handler.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	// skip runtime.Callers, log and the exported logging method
+	runtime.Callers(3, pcs[:])
+	record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	record.Add(args...)
+	_ = handler.Handle(ctx, record)
+}
+
+// defaultHandler is used when a method is called on a nil *Logger, so that
+// a MongoDB without a configured logger still reports through slog.Default().
+func defaultHandler() slog.Handler {
+	return NewContextHandler(NewRedactHandler(slog.Default().Handler()))
+}
+
+// argsToAttrs converts alternating key/value pairs into attributes the same way slog.Record.Add does.
+func argsToAttrs(args []any) []slog.Attr {
+	record := slog.NewRecord(time.Time{}, slog.LevelInfo, "", 0)
+	record.Add(args...)
+	attrs := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+// syncWriter lets SetOutput swap the destination of a handler that has already been built.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *syncWriter) set(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
 }
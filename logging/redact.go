@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/chuxorg/chux-datastore/redact"
+)
+
+// RedactHandler is a slog.Handler that masks credentials in MongoDB connection strings found in the
+// message and attribute values of a record before passing it on to the wrapped handler.
+// Every Logger writes through a RedactHandler.
+type RedactHandler struct {
+	next slog.Handler
+}
+
+// NewRedactHandler wraps h so that connection string credentials never reach it.
+// Wrapping an already wrapped handler returns it unchanged.
+func NewRedactHandler(h slog.Handler) slog.Handler {
+	if rh, ok := h.(*RedactHandler); ok {
+		return rh
+	}
+	return &RedactHandler{next: h}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, redact.String(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return &RedactHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redact.String(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, a := range group {
+			redacted[i] = redactAttr(a)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.Any(attr.Key, redact.Error(err))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,139 @@
+// Package zapadapter lets a zap logger be used as the backend of a logging.Logger.
+package zapadapter
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+
+	"github.com/chuxorg/chux-datastore/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Handler is a slog.Handler that writes records to a zapcore.Core.
+type Handler struct {
+	core   zapcore.Core
+	name   string
+	groups []string
+}
+
+// NewHandler returns a slog.Handler that writes to the given zap logger.
+// Example:
+//
+//	z, _ := zap.NewProduction()
+//	mongoDB := db.New(db.WithLogHandler(zapadapter.NewHandler(z)))
+func NewHandler(logger *zap.Logger) *Handler {
+	return &Handler{core: logger.Core(), name: logger.Name()}
+}
+
+// NewLogger returns a logging.Logger that writes to the given zap logger.
+func NewLogger(logger *zap.Logger) *logging.Logger {
+	return logging.New(NewHandler(logger))
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.core.Enabled(zapLevel(level))
+}
+
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	entry := zapcore.Entry{
+		Level:      zapLevel(record.Level),
+		Time:       record.Time,
+		LoggerName: h.name,
+		Message:    record.Message,
+	}
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		entry.Caller = zapcore.NewEntryCaller(frame.PC, frame.File, frame.Line, true)
+	}
+	checked := h.core.Check(entry, nil)
+	if checked == nil {
+		return nil
+	}
+	fields := make([]zapcore.Field, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = append(fields, zapField(attr))
+		return true
+	})
+	checked.Write(h.nest(fields)...)
+	return nil
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]zapcore.Field, 0, len(attrs))
+	for _, attr := range attrs {
+		fields = append(fields, zapField(attr))
+	}
+	return &Handler{core: h.core.With(h.nest(fields)), name: h.name}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.groups = append(append([]string(nil), h.groups...), name)
+	return &c
+}
+
+// nest places fields inside the open groups as zap namespaces.
+func (h *Handler) nest(fields []zapcore.Field) []zapcore.Field {
+	if len(h.groups) == 0 {
+		return fields
+	}
+	nested := make([]zapcore.Field, 0, len(h.groups)+len(fields))
+	for _, group := range h.groups {
+		nested = append(nested, zap.Namespace(group))
+	}
+	return append(nested, fields...)
+}
+
+func zapLevel(level slog.Level) zapcore.Level {
+	switch {
+	case level >= slog.LevelError:
+		return zapcore.ErrorLevel
+	case level >= slog.LevelWarn:
+		return zapcore.WarnLevel
+	case level >= slog.LevelInfo:
+		return zapcore.InfoLevel
+	default:
+		return zapcore.DebugLevel
+	}
+}
+
+func zapField(attr slog.Attr) zapcore.Field {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindBool:
+		return zap.Bool(attr.Key, value.Bool())
+	case slog.KindDuration:
+		return zap.Duration(attr.Key, value.Duration())
+	case slog.KindFloat64:
+		return zap.Float64(attr.Key, value.Float64())
+	case slog.KindInt64:
+		return zap.Int64(attr.Key, value.Int64())
+	case slog.KindString:
+		return zap.String(attr.Key, value.String())
+	case slog.KindTime:
+		return zap.Time(attr.Key, value.Time())
+	case slog.KindUint64:
+		return zap.Uint64(attr.Key, value.Uint64())
+	case slog.KindGroup:
+		return zap.Object(attr.Key, groupMarshaler(value.Group()))
+	default:
+		if err, ok := value.Any().(error); ok {
+			return zap.NamedError(attr.Key, err)
+		}
+		return zap.Any(attr.Key, value.Any())
+	}
+}
+
+type groupMarshaler []slog.Attr
+
+func (g groupMarshaler) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, attr := range g {
+		zapField(attr).AddTo(enc)
+	}
+	return nil
+}
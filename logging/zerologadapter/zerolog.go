@@ -0,0 +1,121 @@
+// Package zerologadapter lets a zerolog logger be used as the backend of a logging.Logger.
+package zerologadapter
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"strconv"
+
+	"github.com/chuxorg/chux-datastore/logging"
+	"github.com/rs/zerolog"
+)
+
+// Handler is a slog.Handler that writes records to a zerolog.Logger.
+type Handler struct {
+	logger zerolog.Logger
+	attrs  []slog.Attr
+	groups []string
+}
+
+// NewHandler returns a slog.Handler that writes to the given zerolog logger.
+// Example:
+//
+//	z := zerolog.New(os.Stderr).With().Timestamp().Logger()
+//	mongoDB := db.New(db.WithLogHandler(zerologadapter.NewHandler(z)))
+func NewHandler(logger zerolog.Logger) *Handler {
+	return &Handler{logger: logger}
+}
+
+// NewLogger returns a logging.Logger that writes to the given zerolog logger.
+func NewLogger(logger zerolog.Logger) *logging.Logger {
+	return logging.New(NewHandler(logger))
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	zl := zerologLevel(level)
+	return zl >= h.logger.GetLevel() && zl >= zerolog.GlobalLevel()
+}
+
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	event := h.logger.WithLevel(zerologLevel(record.Level))
+	if event == nil {
+		return nil
+	}
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		event = event.Str(zerolog.CallerFieldName, frame.File+":"+strconv.Itoa(frame.Line))
+	}
+	attrs := make([]slog.Attr, 0, len(h.attrs)+record.NumAttrs())
+	attrs = append(attrs, h.attrs...)
+	groupAttrs := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		groupAttrs = append(groupAttrs, attr)
+		return true
+	})
+	attrs = append(attrs, h.nest(groupAttrs)...)
+	event.Fields(fieldsMap(attrs)).Msg(record.Message)
+	return nil
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(append([]slog.Attr(nil), h.attrs...), h.nest(attrs)...)
+	return &c
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.groups = append(append([]string(nil), h.groups...), name)
+	return &c
+}
+
+// nest places attrs inside the open groups.
+func (h *Handler) nest(attrs []slog.Attr) []slog.Attr {
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		attrs = []slog.Attr{{Key: h.groups[i], Value: slog.GroupValue(attrs...)}}
+	}
+	return attrs
+}
+
+func zerologLevel(level slog.Level) zerolog.Level {
+	switch {
+	case level >= slog.LevelError:
+		return zerolog.ErrorLevel
+	case level >= slog.LevelWarn:
+		return zerolog.WarnLevel
+	case level >= slog.LevelInfo:
+		return zerolog.InfoLevel
+	default:
+		return zerolog.DebugLevel
+	}
+}
+
+func fieldsMap(attrs []slog.Attr) map[string]interface{} {
+	fields := make(map[string]interface{}, len(attrs))
+	for _, attr := range attrs {
+		value := attr.Value.Resolve()
+		switch value.Kind() {
+		case slog.KindGroup:
+			if existing, ok := fields[attr.Key].(map[string]interface{}); ok {
+				for k, v := range fieldsMap(value.Group()) {
+					existing[k] = v
+				}
+				continue
+			}
+			fields[attr.Key] = fieldsMap(value.Group())
+		case slog.KindAny:
+			if err, ok := value.Any().(error); ok {
+				fields[attr.Key] = err.Error()
+				continue
+			}
+			fields[attr.Key] = value.Any()
+		default:
+			fields[attr.Key] = value.Any()
+		}
+	}
+	return fields
+}
@@ -0,0 +1,270 @@
+// Package metrics is a small, dependency free metrics registry with counters, gauges and histograms
+// that can be exported in the Prometheus text exposition format.
+//
+// Example:
+//
+//	registry := metrics.NewRegistry()
+//	mongoDB := db.New(db.WithMetrics(registry))
+//	http.Handle("/metrics", registry)
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram buckets used for latencies.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry holds a set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family is a metric name with its help text, type, label names and one series per distinct set of label values.
+type family struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// series is a single time series. Counters and gauges use value; histograms use counts, sum and count.
+type series struct {
+	labelValues []string
+	value       atomicFloat
+	mu          sync.Mutex
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// register returns the family with the given name, creating it when needed. Registering the same
+// name twice with the same type and labels returns the existing family so that several components can
+// share a Registry.
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s is already registered as a %s with labels %v", name, f.typ, f.labels))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  append([]string(nil), labels...),
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series for the label values, creating it when needed.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s = &series{labelValues: append([]string(nil), labelValues...)}
+	if f.typ == histogramType {
+		s.counts = make([]uint64, len(f.buckets))
+	}
+	f.series[key] = s
+	return s
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// NewCounterVec registers a counter family.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, counterType, nil, labels)}
+}
+
+// WithLabelValues returns the counter for the given label values, in the order the labels were declared.
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return &Counter{s: v.f.get(labelValues)}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	s *series
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.s.value.add(1)
+}
+
+// Add adds delta to the counter. Negative values are ignored.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.s.value.add(delta)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return c.s.value.load()
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	f *family
+}
+
+// NewGaugeVec registers a gauge family.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, gaugeType, nil, labels)}
+}
+
+// WithLabelValues returns the gauge for the given label values, in the order the labels were declared.
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return &Gauge{s: v.f.get(labelValues)}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	s *series
+}
+
+// Set sets the gauge to value.
+func (g *Gauge) Set(value float64) {
+	g.s.value.store(value)
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.s.value.add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.s.value.add(-1)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.s.value.add(delta)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.s.value.load()
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	f *family
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper bounds.
+// DefaultBuckets is used when buckets is empty.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: r.register(name, help, histogramType, buckets, labels)}
+}
+
+// WithLabelValues returns the histogram for the given label values, in the order the labels were declared.
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return &Histogram{s: v.f.get(labelValues), buckets: v.f.buckets}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records value.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if i < len(h.s.counts) {
+		h.s.counts[i]++
+	}
+	h.s.sum += value
+	h.s.count++
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.sum
+}
+
+// atomicFloat is a float64 that can be updated concurrently.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (a *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&a.bits))
+}
+
+func (a *atomicFloat) store(value float64) {
+	atomic.StoreUint64(&a.bits, math.Float64bits(value))
+}
+
+func (a *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&a.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&a.bits, old, next) {
+			return
+		}
+	}
+}
@@ -0,0 +1,934 @@
+// Package mongofake is an in-memory MongoDB for hermetic unit tests. NewClient returns an IMongoClient that
+// db.WithClient puts in place of the driver, so the code under test runs against real find, insert, update
+// and delete semantics without a server:
+//
+//	mongoDB := db.New(
+//		db.WithClient(mongofake.NewClient()),
+//		db.WithDatabaseName("test"),
+//		db.WithCollectionName("orders"),
+//	)
+//
+// Filters support the comparison, logical, element and array query operators; updates support the field and
+// array update operators. Unique indexes are enforced and their violations are duplicate key errors, as
+// mongo.IsDuplicateKeyError reports them. Projections, positional updates, aggregation and change streams
+// are not implemented and fail with an error wrapping ErrUnsupported.
+package mongofake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Client is an in-memory MongoDB server and its client. It is safe for concurrent use.
+type Client struct {
+	mu        sync.Mutex
+	databases map[string]map[string]*collectionData
+}
+
+// collectionData holds the documents and the indexes of a collection.
+type collectionData struct {
+	docs    []bson.D
+	indexes []index
+}
+
+// index is an index created with createIndexes. The _id index is not stored, every collection has it.
+type index struct {
+	name   string
+	keys   bson.D
+	unique bool
+}
+
+// NewClient returns an empty Client.
+func NewClient() *Client {
+	return &Client{databases: map[string]map[string]*collectionData{}}
+}
+
+// Connect does nothing, the Client is always connected.
+func (c *Client) Connect(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Disconnect does nothing, the data stays until the Client is garbage collected.
+func (c *Client) Disconnect(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Ping always succeeds unless ctx is done.
+func (c *Client) Ping(ctx context.Context, rp *readpref.ReadPref) error {
+	return ctx.Err()
+}
+
+// Database returns a database. It exists once a collection of it is written to.
+func (c *Client) Database(name string, opts ...*options.DatabaseOptions) db.IMongoDatabase {
+	return &Database{client: c, name: name}
+}
+
+// collection returns the data of a collection, creating it when create is set, or nil. c.mu must be held.
+func (c *Client) collection(database, name string, create bool) *collectionData {
+	collections, ok := c.databases[database]
+	if !ok {
+		if !create {
+			return nil
+		}
+		collections = map[string]*collectionData{}
+		c.databases[database] = collections
+	}
+	data, ok := collections[name]
+	if !ok && create {
+		data = &collectionData{}
+		collections[name] = data
+	}
+	return data
+}
+
+// Database is a database of a Client.
+type Database struct {
+	client *Client
+	name   string
+}
+
+// Name returns the name of the database.
+func (d *Database) Name() string {
+	return d.name
+}
+
+// Collection returns a collection. It exists once it is written to.
+func (d *Database) Collection(name string, opts ...*options.CollectionOptions) db.IMongoCollection {
+	return &Collection{database: d, name: name}
+}
+
+// ListCollectionNames returns the sorted names of the collections matching filter, which is tested against
+// documents with a name and a type field.
+func (d *Database) ListCollectionNames(ctx context.Context, filter interface{}, opts ...*options.ListCollectionsOptions) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	d.client.mu.Lock()
+	defer d.client.mu.Unlock()
+	names := []string{}
+	for name := range d.client.databases[d.name] {
+		ok, err := matches(bson.D{{Key: "name", Value: name}, {Key: "type", Value: "collection"}}, query)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RunCommand runs the commands ping, buildInfo, hello, isMaster, dbStats, collStats, create, drop,
+// createIndexes and dropIndexes. Other commands fail with a CommandNotFound error.
+func (d *Database) RunCommand(ctx context.Context, runCommand interface{}, opts ...*options.RunCmdOptions) db.IMongoSingleResult {
+	if err := ctx.Err(); err != nil {
+		return &SingleResult{err: err}
+	}
+	command, err := toDocument(runCommand)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	if len(command) == 0 {
+		return &SingleResult{err: failedToParse("empty command")}
+	}
+	result, err := d.runCommand(command)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	raw, err := bson.Marshal(append(result, bson.E{Key: "ok", Value: 1.0}))
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	return &SingleResult{raw: raw}
+}
+
+func (d *Database) runCommand(command bson.D) (bson.D, error) {
+	name, _ := command[0].Value.(string)
+	switch command[0].Key {
+	case "ping":
+		return bson.D{}, nil
+	case "buildInfo", "buildinfo":
+		return bson.D{{Key: "version", Value: "7.0.0"}, {Key: "gitVersion", Value: "mongofake"}}, nil
+	case "hello", "isMaster", "ismaster":
+		return bson.D{
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "ismaster", Value: true},
+			{Key: "maxWireVersion", Value: int32(21)},
+		}, nil
+	case "dbStats":
+		d.client.mu.Lock()
+		defer d.client.mu.Unlock()
+		var objects, size, indexes int64
+		collections := d.client.databases[d.name]
+		for _, data := range collections {
+			objects += int64(len(data.docs))
+			size += data.size()
+			indexes += int64(len(data.indexes) + 1)
+		}
+		return bson.D{
+			{Key: "db", Value: d.name},
+			{Key: "collections", Value: int64(len(collections))},
+			{Key: "objects", Value: objects},
+			{Key: "dataSize", Value: size},
+			{Key: "indexes", Value: indexes},
+		}, nil
+	case "collStats":
+		d.client.mu.Lock()
+		defer d.client.mu.Unlock()
+		data := d.client.collection(d.name, name, false)
+		if data == nil {
+			return nil, commandError(codeNamespaceNotFound, "NamespaceNotFound", "Collection [%s.%s] not found.", d.name, name)
+		}
+		return bson.D{
+			{Key: "ns", Value: d.name + "." + name},
+			{Key: "count", Value: int64(len(data.docs))},
+			{Key: "size", Value: data.size()},
+			{Key: "nindexes", Value: int64(len(data.indexes) + 1)},
+		}, nil
+	case "create":
+		d.client.mu.Lock()
+		defer d.client.mu.Unlock()
+		if d.client.collection(d.name, name, false) != nil {
+			return nil, commandError(codeNamespaceExists, "NamespaceExists", "Collection %s.%s already exists.", d.name, name)
+		}
+		d.client.collection(d.name, name, true)
+		return bson.D{}, nil
+	case "drop":
+		d.client.mu.Lock()
+		defer d.client.mu.Unlock()
+		if d.client.collection(d.name, name, false) == nil {
+			return nil, commandError(codeNamespaceNotFound, "NamespaceNotFound", "ns not found")
+		}
+		delete(d.client.databases[d.name], name)
+		return bson.D{{Key: "ns", Value: d.name + "." + name}}, nil
+	case "createIndexes":
+		specs, _ := lookupValue(command, "indexes").(bson.A)
+		if len(specs) == 0 {
+			return nil, badValue("createIndexes needs a nonempty indexes array")
+		}
+		view := &IndexView{collection: &Collection{database: d, name: name}}
+		for _, spec := range specs {
+			s, ok := spec.(bson.D)
+			if !ok {
+				return nil, badValue("the indexes of createIndexes must be documents")
+			}
+			keys, _ := lookupValue(s, "key").(bson.D)
+			indexName, _ := lookupValue(s, "name").(string)
+			if _, err := view.createIndex(keys, indexName, truthy(lookupValue(s, "unique"))); err != nil {
+				return nil, err
+			}
+		}
+		return bson.D{}, nil
+	case "dropIndexes", "deleteIndexes":
+		d.client.mu.Lock()
+		defer d.client.mu.Unlock()
+		data := d.client.collection(d.name, name, false)
+		if data == nil {
+			return nil, commandError(codeNamespaceNotFound, "NamespaceNotFound", "ns not found %s.%s", d.name, name)
+		}
+		target := lookupValue(command, "index")
+		if target == "*" {
+			data.indexes = nil
+			return bson.D{}, nil
+		}
+		for i, idx := range data.indexes {
+			if idx.name == target || equal(idx.keys, target) {
+				data.indexes = append(data.indexes[:i:i], data.indexes[i+1:]...)
+				return bson.D{}, nil
+			}
+		}
+		return nil, commandError(codeIndexNotFound, "IndexNotFound", "index not found with name [%v]", target)
+	default:
+		return nil, commandError(codeCommandNotFound, "CommandNotFound", "no such command: '%s'", command[0].Key)
+	}
+}
+
+// size returns the size in bytes of the documents of the collection.
+func (c *collectionData) size() int64 {
+	var size int64
+	for _, doc := range c.docs {
+		data, _ := bson.Marshal(doc)
+		size += int64(len(data))
+	}
+	return size
+}
+
+// Collection is a collection of a Database.
+type Collection struct {
+	database *Database
+	name     string
+}
+
+// Name returns the name of the collection.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// Database returns the database of the collection.
+func (c *Collection) Database() db.IMongoDatabase {
+	return c.database
+}
+
+// Indexes returns the indexes of the collection.
+func (c *Collection) Indexes() db.IMongoIndexView {
+	return &IndexView{collection: c}
+}
+
+// Watch fails as it does on a standalone server, change streams need a replica set.
+func (c *Collection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (db.IMongoChangeStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %w", ErrUnsupported,
+		commandError(codeChangeStreamsNotFound, "Location40573", "The $changeStream stage is only supported on replica sets"))
+}
+
+// lock locks the client and returns the data of the collection, or nil when it does not exist and create
+// is false.
+func (c *Collection) lock(create bool) *collectionData {
+	c.database.client.mu.Lock()
+	return c.database.client.collection(c.database.name, c.name, create)
+}
+
+func (c *Collection) unlock() {
+	c.database.client.mu.Unlock()
+}
+
+// Find returns the documents matching filter, honouring the Sort, Skip and Limit options.
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (db.IMongoCursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeFindOptions(opts...)
+	if !isEmpty(o.Projection) {
+		return nil, unsupported("projections")
+	}
+	docs, err := c.find(filter, o.Sort, o.Skip, o.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return newCursor(docs), nil
+}
+
+// FindOne returns the first document matching filter, honouring the Sort and Skip options.
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) db.IMongoSingleResult {
+	if err := ctx.Err(); err != nil {
+		return &SingleResult{err: err}
+	}
+	o := options.MergeFindOneOptions(opts...)
+	if !isEmpty(o.Projection) {
+		return &SingleResult{err: unsupported("projections")}
+	}
+	one := int64(1)
+	docs, err := c.find(filter, o.Sort, o.Skip, &one)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	if len(docs) == 0 {
+		return &SingleResult{err: mongo.ErrNoDocuments}
+	}
+	return &SingleResult{raw: docs[0]}
+}
+
+// CountDocuments counts the documents matching filter, honouring the Skip and Limit options.
+func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	o := options.MergeCountOptions(opts...)
+	docs, err := c.find(filter, nil, o.Skip, o.Limit)
+	return int64(len(docs)), err
+}
+
+// find returns copies of the documents matching filter in sort order.
+func (c *Collection) find(filter interface{}, sortSpec interface{}, skip, limit *int64) ([]bson.Raw, error) {
+	query, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var order bson.D
+	if !isEmpty(sortSpec) {
+		if order, err = toDocument(sortSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	data := c.lock(false)
+	defer c.unlock()
+	var found []bson.D
+	if data != nil {
+		for _, doc := range data.docs {
+			ok, err := matches(doc, query)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				found = append(found, doc)
+			}
+		}
+	}
+	if len(order) > 0 {
+		sortDocuments(found, order)
+	}
+	if skip != nil && *skip > 0 {
+		if *skip >= int64(len(found)) {
+			found = nil
+		} else {
+			found = found[*skip:]
+		}
+	}
+	if limit != nil && *limit != 0 {
+		n := *limit
+		if n < 0 {
+			n = -n
+		}
+		if n < int64(len(found)) {
+			found = found[:n]
+		}
+	}
+	raws := make([]bson.Raw, 0, len(found))
+	for _, doc := range found {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	return raws, nil
+}
+
+// InsertOne inserts a document, giving it an ObjectID when it has no _id.
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	doc, err := toDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	data := c.lock(true)
+	defer c.unlock()
+	id, err := c.insert(data, doc)
+	if err != nil {
+		return nil, writeException(err)
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// InsertMany inserts documents in order. An ordered insert stops at the first document that fails, an
+// unordered one inserts every other document; the failures are returned as a mongo.BulkWriteException.
+func (c *Collection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(documents) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	docs := make([]bson.D, len(documents))
+	for i, document := range documents {
+		doc, err := toDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	o := options.MergeInsertManyOptions(opts...)
+	ordered := o.Ordered == nil || *o.Ordered
+
+	data := c.lock(true)
+	defer c.unlock()
+	result := &mongo.InsertManyResult{}
+	var exception mongo.BulkWriteException
+	for i, doc := range docs {
+		id, err := c.insert(data, doc)
+		if err != nil {
+			we, ok := writeError(err, i)
+			if !ok {
+				return result, err
+			}
+			exception.WriteErrors = append(exception.WriteErrors, mongo.BulkWriteError{WriteError: we, Request: mongo.NewInsertOneModel().SetDocument(documents[i])})
+			if ordered {
+				break
+			}
+			continue
+		}
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+	if len(exception.WriteErrors) > 0 {
+		return result, exception
+	}
+	return result, nil
+}
+
+// insert inserts doc into data and returns its _id. c.mu must be held.
+func (c *Collection) insert(data *collectionData, doc bson.D) (interface{}, error) {
+	id, ok := getPath(doc, []string{"_id"})
+	if !ok {
+		id = primitive.NewObjectID()
+	}
+	doc = withID(doc, id)
+	if err := c.checkUnique(data, doc, -1); err != nil {
+		return nil, err
+	}
+	data.docs = append(data.docs, doc)
+	return id, nil
+}
+
+// UpdateOne applies an update document to the first document matching filter. With the Upsert option it
+// inserts a document made of the equality fields of filter and the update when none matches.
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeUpdateOptions(opts...)
+	if o.ArrayFilters != nil && len(o.ArrayFilters.Filters) > 0 {
+		return nil, unsupported("array filters")
+	}
+	query, u, err := toFilterAndUpdate(filter, update)
+	if err != nil {
+		return nil, err
+	}
+	data := c.lock(true)
+	defer c.unlock()
+	result, err := c.update(data, query, u, false, o.Upsert != nil && *o.Upsert, false)
+	return result, writeException(err)
+}
+
+// ReplaceOne replaces the first document matching filter, keeping its _id. With the Upsert option it
+// inserts the replacement when none matches.
+func (c *Collection) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeReplaceOptions(opts...)
+	query, r, err := toFilterAndUpdate(filter, replacement)
+	if err != nil {
+		return nil, err
+	}
+	data := c.lock(true)
+	defer c.unlock()
+	result, err := c.update(data, query, r, true, o.Upsert != nil && *o.Upsert, false)
+	return result, writeException(err)
+}
+
+// update applies an update, or a replacement, to the first or every document matching filter, and upserts
+// when upsert is set and none matches. c.mu must be held.
+func (c *Collection) update(data *collectionData, filter, update bson.D, replace, upsert, multi bool) (*mongo.UpdateResult, error) {
+	result := &mongo.UpdateResult{}
+	for i, doc := range data.docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		result.MatchedCount++
+		var updated bson.D
+		if replace {
+			updated, err = replaceDocument(doc, update)
+		} else {
+			updated, err = applyUpdate(doc, update, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, _ := getPath(doc, []string{"_id"})
+		if newID, _ := getPath(updated, []string{"_id"}); !equal(id, newID) {
+			return nil, immutableField()
+		}
+		if err := c.checkUnique(data, updated, i); err != nil {
+			return nil, err
+		}
+		if !sameDocument(doc, updated) {
+			result.ModifiedCount++
+			data.docs[i] = updated
+		}
+		if !multi {
+			return result, nil
+		}
+	}
+	if result.MatchedCount > 0 || !upsert {
+		return result, nil
+	}
+
+	seed, err := upsertSeed(filter)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if replace {
+		doc = clone(update)
+		if id, ok := getPath(seed, []string{"_id"}); ok {
+			if _, ok := getPath(doc, []string{"_id"}); !ok {
+				doc = withID(doc, id)
+			}
+		}
+	} else {
+		if doc, err = applyUpdate(seed, update, true); err != nil {
+			return nil, err
+		}
+		if id, ok := getPath(seed, []string{"_id"}); ok {
+			if newID, _ := getPath(doc, []string{"_id"}); !equal(id, newID) {
+				return nil, immutableField()
+			}
+		}
+	}
+	id, err := c.insert(data, doc)
+	if err != nil {
+		return nil, err
+	}
+	result.UpsertedCount = 1
+	result.UpsertedID = id
+	return result, nil
+}
+
+// DeleteOne deletes the first document matching filter.
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.deleteMatching(ctx, filter, false)
+}
+
+// DeleteMany deletes every document matching filter.
+func (c *Collection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.deleteMatching(ctx, filter, true)
+}
+
+func (c *Collection) deleteMatching(ctx context.Context, filter interface{}, multi bool) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	data := c.lock(false)
+	defer c.unlock()
+	result := &mongo.DeleteResult{}
+	if data == nil {
+		return result, nil
+	}
+	result.DeletedCount, err = c.delete(data, query, multi)
+	return result, err
+}
+
+// delete deletes the first or every document matching filter and returns how many it deleted. c.mu must
+// be held.
+func (c *Collection) delete(data *collectionData, filter bson.D, multi bool) (int64, error) {
+	var deleted int64
+	kept := data.docs[:0:0]
+	for _, doc := range data.docs {
+		if deleted == 0 || multi {
+			ok, err := matches(doc, filter)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				deleted++
+				continue
+			}
+		}
+		kept = append(kept, doc)
+	}
+	data.docs = kept
+	return deleted, nil
+}
+
+// BulkWrite runs the InsertOne, UpdateOne, UpdateMany, ReplaceOne, DeleteOne and DeleteMany models in order.
+// An ordered write stops at the first model that fails, an unordered one runs every other model; the
+// failures are returned as a mongo.BulkWriteException.
+func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	o := options.MergeBulkWriteOptions(opts...)
+	ordered := o.Ordered == nil || *o.Ordered
+
+	data := c.lock(true)
+	defer c.unlock()
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{}}
+	var exception mongo.BulkWriteException
+	for i, model := range models {
+		err := c.writeModel(data, model, int64(i), result)
+		if err == nil {
+			continue
+		}
+		we, ok := writeError(err, i)
+		if !ok {
+			return result, err
+		}
+		exception.WriteErrors = append(exception.WriteErrors, mongo.BulkWriteError{WriteError: we, Request: model})
+		if ordered {
+			break
+		}
+	}
+	if len(exception.WriteErrors) > 0 {
+		return result, exception
+	}
+	return result, nil
+}
+
+// writeModel runs one model of a BulkWrite and adds its counts to result. c.mu must be held.
+func (c *Collection) writeModel(data *collectionData, model mongo.WriteModel, i int64, result *mongo.BulkWriteResult) error {
+	addUpdate := func(r *mongo.UpdateResult) {
+		result.MatchedCount += r.MatchedCount
+		result.ModifiedCount += r.ModifiedCount
+		result.UpsertedCount += r.UpsertedCount
+		if r.UpsertedID != nil {
+			result.UpsertedIDs[i] = r.UpsertedID
+		}
+	}
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		doc, err := toDocument(m.Document)
+		if err != nil {
+			return err
+		}
+		if _, err := c.insert(data, doc); err != nil {
+			return err
+		}
+		result.InsertedCount++
+	case *mongo.UpdateOneModel, *mongo.UpdateManyModel, *mongo.ReplaceOneModel:
+		var filter, update interface{}
+		var upsert *bool
+		var arrayFilters *options.ArrayFilters
+		replace, multi := false, false
+		switch m := m.(type) {
+		case *mongo.UpdateOneModel:
+			filter, update, upsert, arrayFilters = m.Filter, m.Update, m.Upsert, m.ArrayFilters
+		case *mongo.UpdateManyModel:
+			filter, update, upsert, arrayFilters, multi = m.Filter, m.Update, m.Upsert, m.ArrayFilters, true
+		case *mongo.ReplaceOneModel:
+			filter, update, upsert, replace = m.Filter, m.Replacement, m.Upsert, true
+		}
+		if arrayFilters != nil && len(arrayFilters.Filters) > 0 {
+			return unsupported("array filters")
+		}
+		query, u, err := toFilterAndUpdate(filter, update)
+		if err != nil {
+			return err
+		}
+		r, err := c.update(data, query, u, replace, upsert != nil && *upsert, multi)
+		if err != nil {
+			return err
+		}
+		addUpdate(r)
+	case *mongo.DeleteOneModel, *mongo.DeleteManyModel:
+		var filter interface{}
+		multi := false
+		switch m := m.(type) {
+		case *mongo.DeleteOneModel:
+			filter = m.Filter
+		case *mongo.DeleteManyModel:
+			filter, multi = m.Filter, true
+		}
+		query, err := toFilter(filter)
+		if err != nil {
+			return err
+		}
+		deleted, err := c.delete(data, query, multi)
+		if err != nil {
+			return err
+		}
+		result.DeletedCount += deleted
+	default:
+		return unsupported("the write model %T", model)
+	}
+	return nil
+}
+
+// checkUnique returns a duplicate key error when doc has the _id, or the key of a unique index, of another
+// document than the one at skip. c.mu must be held.
+func (c *Collection) checkUnique(data *collectionData, doc bson.D, skip int) error {
+	indexes := append([]index{{name: "_id_", keys: bson.D{{Key: "_id", Value: int32(1)}}, unique: true}}, data.indexes...)
+	for _, idx := range indexes {
+		if !idx.unique {
+			continue
+		}
+		key := indexKey(doc, idx.keys)
+		for i, other := range data.docs {
+			if i != skip && equal(key, indexKey(other, idx.keys)) {
+				return c.duplicateKey(idx, key)
+			}
+		}
+	}
+	return nil
+}
+
+// duplicateKey returns the error of a duplicate key, with the message of the server.
+func (c *Collection) duplicateKey(idx index, key bson.A) error {
+	fields := make([]string, len(idx.keys))
+	for i, e := range idx.keys {
+		value, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: key[i]}}, false, false)
+		if err != nil {
+			value = []byte(fmt.Sprintf(`{"v":%v}`, key[i]))
+		}
+		fields[i] = e.Key + ": " + strings.TrimSuffix(strings.TrimPrefix(string(value), `{"v":`), "}")
+	}
+	return commandError(codeDuplicateKey, "DuplicateKey", "E11000 duplicate key error collection: %s.%s index: %s dup key: { %s }",
+		c.database.name, c.name, idx.name, strings.Join(fields, ", "))
+}
+
+// indexKey returns the values of the fields of an index in doc, null for missing fields.
+func indexKey(doc bson.D, keys bson.D) bson.A {
+	key := make(bson.A, len(keys))
+	for i, e := range keys {
+		if values := lookup(doc, e.Key); len(values) > 0 {
+			key[i] = values[0]
+		}
+	}
+	return key
+}
+
+// sortDocuments sorts docs by a sort specification such as {"createdAt": -1}.
+func sortDocuments(docs []bson.D, order bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range order {
+			descending := false
+			if n, ok := toInt64(e.Value); ok && n < 0 {
+				descending = true
+			}
+			c := compare(sortValue(docs[i], e.Key, descending), sortValue(docs[j], e.Key, descending))
+			if c == 0 {
+				continue
+			}
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// sortValue returns the value doc is sorted by: the smallest value at path in ascending order and the
+// largest in descending order, taking arrays apart, or null when there is none.
+func sortValue(doc bson.D, path string, descending bool) interface{} {
+	values := lookup(doc, path)
+	var candidates []interface{}
+	for _, v := range values {
+		if a, ok := v.(bson.A); ok && len(a) > 0 {
+			candidates = append(candidates, a...)
+		} else {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	best := candidates[0]
+	for _, v := range candidates[1:] {
+		if c := compare(v, best); (descending && c > 0) || (!descending && c < 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+// toDocument returns a document, a struct, a map or raw BSON as a bson.D of bson.D and bson.A values.
+func toDocument(v interface{}) (bson.D, error) {
+	if v == nil {
+		return nil, mongo.ErrNilDocument
+	}
+	var data []byte
+	switch raw := v.(type) {
+	case bson.Raw:
+		data = raw
+	case []byte:
+		data = raw
+	default:
+		var err error
+		if data, err = bson.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	d := bson.D{}
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// toFilter returns a query filter as a bson.D.
+func toFilter(filter interface{}) (bson.D, error) {
+	query, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range query {
+		if e.Key == "$where" || e.Key == "$expr" || e.Key == "$text" {
+			return nil, unsupported("the query operator %s", e.Key)
+		}
+	}
+	return query, nil
+}
+
+// toFilterAndUpdate returns the filter and the update document, or replacement, of an update.
+func toFilterAndUpdate(filter, update interface{}) (bson.D, bson.D, error) {
+	query, err := toFilter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch update.(type) {
+	case bson.A, []interface{}, mongo.Pipeline:
+		return nil, nil, unsupported("update pipelines")
+	}
+	u, err := toDocument(update)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, u, nil
+}
+
+// isEmpty reports whether an optional document such as a projection is unset.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	d, err := toDocument(v)
+	return err == nil && len(d) == 0
+}
+
+// lookupValue returns the value of a top-level field of d, or nil.
+func lookupValue(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of doc.
+func clone(doc bson.D) bson.D {
+	d, err := toDocument(doc)
+	if err != nil {
+		return append(bson.D{}, doc...)
+	}
+	return d
+}
+
+// sameDocument reports whether two documents have the same BSON.
+func sameDocument(a, b bson.D) bool {
+	x, errX := bson.Marshal(a)
+	y, errY := bson.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
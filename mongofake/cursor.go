@@ -0,0 +1,214 @@
+package mongofake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Cursor iterates over the documents found by Find. The documents are copies taken when Find ran, later
+// writes do not change them.
+type Cursor struct {
+	docs    []bson.Raw
+	current bson.Raw
+	err     error
+}
+
+func newCursor(docs []bson.Raw) *Cursor {
+	return &Cursor{docs: docs}
+}
+
+// Next moves to the next document and reports whether there is one.
+func (c *Cursor) Next(ctx context.Context) bool {
+	if c.err != nil {
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		c.err = err
+		return false
+	}
+	if len(c.docs) == 0 {
+		c.current = nil
+		return false
+	}
+	c.current, c.docs = c.docs[0], c.docs[1:]
+	return true
+}
+
+// Decode unmarshals the current document into val.
+func (c *Cursor) Decode(val interface{}) error {
+	return bson.Unmarshal(c.current, val)
+}
+
+// Current returns the current document.
+func (c *Cursor) Current() bson.Raw {
+	return c.current
+}
+
+// Err returns the error that stopped Next.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the remaining documents.
+func (c *Cursor) Close(ctx context.Context) error {
+	c.docs = nil
+	return nil
+}
+
+// All unmarshals the remaining documents into results, a pointer to a slice, and closes the cursor.
+func (c *Cursor) All(ctx context.Context, results interface{}) error {
+	defer c.Close(ctx)
+	value := reflect.ValueOf(results)
+	if value.Kind() != reflect.Ptr {
+		return errors.New("results argument must be a pointer to a slice")
+	}
+	slice := value.Elem()
+	if slice.Kind() == reflect.Interface {
+		slice = slice.Elem()
+	}
+	if slice.Kind() != reflect.Slice {
+		return errors.New("results argument must be a pointer to a slice")
+	}
+	slice = slice.Slice(0, 0)
+	for c.Next(ctx) {
+		elem := reflect.New(slice.Type().Elem())
+		if err := c.Decode(elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	if c.err != nil {
+		return c.err
+	}
+	value.Elem().Set(slice)
+	return nil
+}
+
+// SingleResult is the result of FindOne and RunCommand.
+type SingleResult struct {
+	raw bson.Raw
+	err error
+}
+
+// Decode unmarshals the document into v, or returns the error of the operation, mongo.ErrNoDocuments when
+// FindOne found nothing.
+func (r *SingleResult) Decode(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return bson.Unmarshal(r.raw, v)
+}
+
+// DecodeBytes returns the document, or the error of the operation.
+func (r *SingleResult) DecodeBytes() (bson.Raw, error) {
+	return r.raw, r.err
+}
+
+// Err returns the error of the operation.
+func (r *SingleResult) Err() error {
+	return r.err
+}
+
+// IndexView creates and lists the indexes of a collection.
+type IndexView struct {
+	collection *Collection
+}
+
+// CreateOne creates an index with the Name and Unique options of the model and returns its name. Creating
+// an index that exists does nothing; a unique index fails when the collection has duplicates.
+func (v *IndexView) CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	keys, err := toDocument(model.Keys)
+	if err != nil {
+		return "", err
+	}
+	name, unique := "", false
+	if model.Options != nil {
+		if model.Options.Name != nil {
+			name = *model.Options.Name
+		}
+		unique = model.Options.Unique != nil && *model.Options.Unique
+	}
+	return v.createIndex(keys, name, unique)
+}
+
+func (v *IndexView) createIndex(keys bson.D, name string, unique bool) (string, error) {
+	if len(keys) == 0 {
+		return "", badValue("the index key pattern must not be empty")
+	}
+	if len(name) == 0 {
+		parts := make([]string, len(keys))
+		for i, e := range keys {
+			parts[i] = fmt.Sprintf("%s_%v", e.Key, e.Value)
+		}
+		name = strings.Join(parts, "_")
+	}
+
+	c := v.collection
+	data := c.lock(true)
+	defer c.unlock()
+	for _, idx := range data.indexes {
+		sameKeys := equal(idx.keys, keys)
+		switch {
+		case idx.name == name && sameKeys && idx.unique == unique:
+			return name, nil
+		case idx.name == name:
+			return "", commandError(codeIndexKeySpecsConflict, "IndexKeySpecsConflict", "an existing index has the same name as the requested index: %s", name)
+		case sameKeys:
+			return "", commandError(codeIndexOptionsConflict, "IndexOptionsConflict", "index already exists with a different name: %s", idx.name)
+		}
+	}
+	idx := index{name: name, keys: keys, unique: unique}
+	if unique {
+		for i, doc := range data.docs {
+			key := indexKey(doc, keys)
+			for _, other := range data.docs[i+1:] {
+				if equal(key, indexKey(other, keys)) {
+					return "", c.duplicateKey(idx, key)
+				}
+			}
+		}
+	}
+	data.indexes = append(data.indexes, idx)
+	return name, nil
+}
+
+// List returns the index specifications of the collection, the _id index first.
+func (v *IndexView) List(ctx context.Context, opts ...*options.ListIndexesOptions) (db.IMongoCursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c := v.collection
+	data := c.lock(false)
+	defer c.unlock()
+	if data == nil {
+		return nil, commandError(codeNamespaceNotFound, "NamespaceNotFound", "ns does not exist: %s.%s", c.database.name, c.name)
+	}
+	specs := []bson.D{{{Key: "v", Value: int32(2)}, {Key: "key", Value: bson.D{{Key: "_id", Value: int32(1)}}}, {Key: "name", Value: "_id_"}}}
+	for _, idx := range data.indexes {
+		spec := bson.D{{Key: "v", Value: int32(2)}, {Key: "key", Value: idx.keys}, {Key: "name", Value: idx.name}}
+		if idx.unique {
+			spec = append(spec, bson.E{Key: "unique", Value: true})
+		}
+		specs = append(specs, spec)
+	}
+	docs := make([]bson.Raw, len(specs))
+	for i, spec := range specs {
+		raw, err := bson.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = raw
+	}
+	return newCursor(docs), nil
+}
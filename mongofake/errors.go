@@ -0,0 +1,74 @@
+package mongofake
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Server error codes returned by the fake, the same as a MongoDB server returns for the same mistakes.
+const (
+	codeBadValue              = 2
+	codeFailedToParse         = 9
+	codeTypeMismatch          = 14
+	codeNamespaceNotFound     = 26
+	codeIndexNotFound         = 27
+	codePathNotViable         = 28
+	codeNamespaceExists       = 48
+	codeCommandNotFound       = 59
+	codeImmutableField        = 66
+	codeIndexOptionsConflict  = 85
+	codeIndexKeySpecsConflict = 86
+	codeDuplicateKey          = 11000
+	codeChangeStreamsNotFound = 40573
+)
+
+// ErrUnsupported is wrapped by the errors of the features of MongoDB the fake does not implement, such as
+// projections, positional updates and change streams on a replica set.
+var ErrUnsupported = fmt.Errorf("mongofake: not supported")
+
+func unsupported(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, fmt.Sprintf(format, args...))
+}
+
+func commandError(code int32, name, format string, args ...interface{}) error {
+	return mongo.CommandError{Code: code, Name: name, Message: fmt.Sprintf(format, args...)}
+}
+
+func badValue(format string, args ...interface{}) error {
+	return commandError(codeBadValue, "BadValue", format, args...)
+}
+
+func failedToParse(format string, args ...interface{}) error {
+	return commandError(codeFailedToParse, "FailedToParse", format, args...)
+}
+
+func typeMismatch(format string, args ...interface{}) error {
+	return commandError(codeTypeMismatch, "TypeMismatch", format, args...)
+}
+
+func pathNotViable(format string, args ...interface{}) error {
+	return commandError(codePathNotViable, "PathNotViable", format, args...)
+}
+
+func immutableField() error {
+	return commandError(codeImmutableField, "ImmutableField", "performing an update on the path '_id' would modify the immutable field '_id'")
+}
+
+// writeError returns a server error of a write as the mongo.WriteError the driver reports it with.
+// Errors that are not server errors are returned as they are.
+func writeError(err error, index int) (mongo.WriteError, bool) {
+	commandErr, ok := err.(mongo.CommandError)
+	if !ok {
+		return mongo.WriteError{}, false
+	}
+	return mongo.WriteError{Index: index, Code: int(commandErr.Code), Message: commandErr.Message}, true
+}
+
+// writeException returns the error of a single document write the way the driver returns it.
+func writeException(err error) error {
+	if we, ok := writeError(err, 0); ok {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{we}}
+	}
+	return err
+}
@@ -0,0 +1,491 @@
+package mongofake
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matches reports whether doc matches a query filter.
+func matches(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchElement matches one element of a filter: a logical operator or a condition on a field.
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, badValue("%s must be a nonempty array", e.Key)
+		}
+		for _, clause := range clauses {
+			filter, ok := clause.(bson.D)
+			if !ok {
+				return false, badValue("%s entries must be documents", e.Key)
+			}
+			ok, err := matches(doc, filter)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, badValue("unknown top level operator: %s", e.Key)
+	}
+	return matchCondition(lookup(doc, e.Key), e.Value)
+}
+
+// matchCondition matches the values found at a path against a condition: an operator document or a value
+// the field must equal.
+func matchCondition(values []interface{}, condition interface{}) (bool, error) {
+	if operators, ok := operatorDocument(condition); ok {
+		for _, operator := range operators {
+			ok, err := matchOperator(values, operator, operators)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if regex, ok := condition.(primitive.Regex); ok {
+		return matchRegex(values, regex)
+	}
+	return matchEqual(values, condition), nil
+}
+
+// operatorDocument returns condition as a document of query operators, such as {"$gt": 5}.
+func operatorDocument(condition interface{}) (bson.D, bool) {
+	d, ok := condition.(bson.D)
+	if !ok || len(d) == 0 || !strings.HasPrefix(d[0].Key, "$") {
+		return nil, false
+	}
+	return d, true
+}
+
+// matchOperator matches the values found at a path against one query operator.
+func matchOperator(values []interface{}, operator bson.E, operators bson.D) (bool, error) {
+	switch operator.Key {
+	case "$eq":
+		return matchEqual(values, operator.Value), nil
+	case "$ne":
+		return !matchEqual(values, operator.Value), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			c, ok := compareSameType(v, operator.Value)
+			if !ok {
+				continue
+			}
+			if (operator.Key == "$gt" && c > 0) || (operator.Key == "$gte" && c >= 0) ||
+				(operator.Key == "$lt" && c < 0) || (operator.Key == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := operator.Value.(bson.A)
+		if !ok {
+			return false, badValue("%s needs an array", operator.Key)
+		}
+		found := false
+		for _, item := range list {
+			if regex, ok := item.(primitive.Regex); ok {
+				if found, _ = matchRegex(values, regex); found {
+					break
+				}
+			} else if matchEqual(values, item) {
+				found = true
+				break
+			}
+		}
+		return found == (operator.Key == "$in"), nil
+	case "$exists":
+		return (len(values) > 0) == truthy(operator.Value), nil
+	case "$not":
+		if regex, ok := operator.Value.(primitive.Regex); ok {
+			found, err := matchRegex(values, regex)
+			return !found, err
+		}
+		if _, ok := operatorDocument(operator.Value); !ok {
+			return false, badValue("$not needs a regex or a document")
+		}
+		found, err := matchCondition(values, operator.Value)
+		return !found, err
+	case "$regex":
+		regex := primitive.Regex{}
+		switch pattern := operator.Value.(type) {
+		case string:
+			regex.Pattern = pattern
+		case primitive.Regex:
+			regex = pattern
+		default:
+			return false, badValue("$regex has to be a string")
+		}
+		for _, option := range operators {
+			if option.Key == "$options" {
+				regex.Options, _ = option.Value.(string)
+			}
+		}
+		return matchRegex(values, regex)
+	case "$options":
+		return true, nil
+	case "$size":
+		size, ok := toInt64(operator.Value)
+		if !ok {
+			return false, badValue("$size needs a number")
+		}
+		for _, v := range values {
+			if a, ok := v.(bson.A); ok && int64(len(a)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		list, ok := operator.Value.(bson.A)
+		if !ok {
+			return false, badValue("$all needs an array")
+		}
+		if len(list) == 0 {
+			return false, nil
+		}
+		for _, item := range list {
+			if !matchEqual(values, item) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$elemMatch":
+		condition, ok := operator.Value.(bson.D)
+		if !ok {
+			return false, badValue("$elemMatch needs an Object")
+		}
+		for _, v := range values {
+			a, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, item := range a {
+				var found bool
+				var err error
+				if _, isOperators := operatorDocument(condition); isOperators {
+					found, err = matchCondition([]interface{}{item}, condition)
+				} else if d, isDoc := item.(bson.D); isDoc {
+					found, err = matches(d, condition)
+				}
+				if err != nil {
+					return false, err
+				}
+				if found {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	default:
+		return false, badValue("unknown operator: %s", operator.Key)
+	}
+}
+
+// matchEqual reports whether one of the values, or an element of one of the array values, equals want.
+// A null matches a missing field.
+func matchEqual(values []interface{}, want interface{}) bool {
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	for _, v := range expand(values) {
+		if equal(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRegex reports whether one of the string values matches a regular expression.
+func matchRegex(values []interface{}, regex primitive.Regex) (bool, error) {
+	flags := ""
+	for _, option := range regex.Options {
+		switch option {
+		case 'i', 'm', 's':
+			flags += string(option)
+		}
+	}
+	pattern := regex.Pattern
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, badValue("invalid regular expression %q: %s", regex.Pattern, err)
+	}
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookup returns the values at a dotted path of doc. A path through an array of documents gives the value of
+// every document, and a number in the path selects an element of an array.
+func lookup(doc bson.D, path string) []interface{} {
+	return lookupParts(doc, strings.Split(path, "."))
+}
+
+func lookupParts(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case bson.D:
+		for _, e := range v {
+			if e.Key == parts[0] {
+				return lookupParts(e.Value, parts[1:])
+			}
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(v) {
+				return lookupParts(v[i], parts[1:])
+			}
+			return nil
+		}
+		var values []interface{}
+		for _, item := range v {
+			if d, ok := item.(bson.D); ok {
+				values = append(values, lookupParts(d, parts)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// expand returns the values followed by the elements of the values that are arrays, which is what a
+// condition on a field is tested against.
+func expand(values []interface{}) []interface{} {
+	expanded := append([]interface{}{}, values...)
+	for _, v := range values {
+		if a, ok := v.(bson.A); ok {
+			expanded = append(expanded, a...)
+		}
+	}
+	return expanded
+}
+
+// equal reports whether two values are equal, comparing numbers by value whatever their type.
+func equal(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case bson.D:
+		y, ok := b.(bson.D)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i].Key != y[i].Key || !equal(x[i].Value, y[i].Value) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		y, ok := b.(bson.A)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareSameType compares two values of the same type, or two numbers. It returns false when the values
+// cannot be compared, as a range query only matches values of the type of its bound.
+func compareSameType(a, b interface{}) (int, bool) {
+	if typeOrder(a) != typeOrder(b) {
+		return 0, false
+	}
+	switch a.(type) {
+	case bson.D, bson.A:
+		return 0, false
+	}
+	return compare(a, b), true
+}
+
+// compare orders any two values the way MongoDB sorts them: by type first, then by value.
+func compare(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return ta - tb
+	}
+	switch x := a.(type) {
+	case string:
+		return strings.Compare(x, b.(string))
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		default:
+			return 1
+		}
+	case primitive.DateTime:
+		return compareInt64(int64(x), int64(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		return compareInt64(int64(x.T)<<32|int64(x.I), int64(y.T)<<32|int64(y.I))
+	case bson.D:
+		y := b.(bson.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := compare(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	case bson.A:
+		y := b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	}
+	if x, ok := toInt64(a); ok {
+		if y, ok := toInt64(b); ok {
+			return compareInt64(x, y)
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		y, _ := toFloat(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// typeOrder returns the rank of the type of v in the BSON sort order.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil, primitive.Undefined, primitive.Null:
+		return 1
+	case int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	default:
+		return 12
+	}
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// toFloat returns a number as a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// toInt64 returns an integer, or a float64 without a fraction, as an int64.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// truthy reports whether a value is true the way MongoDB reads flags such as $exists: any value but false,
+// zero and null.
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
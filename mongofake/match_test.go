@@ -0,0 +1,122 @@
+package mongofake
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// match matches doc against filter after a round trip through BSON, as the collection does.
+func match(doc, filter bson.D) (bool, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return false, err
+	}
+	query, err := toFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return matches(d, query)
+}
+
+func TestMatches(t *testing.T) {
+	doc := bson.D{
+		{Key: "_id", Value: int32(1)},
+		{Key: "name", Value: "Jane"},
+		{Key: "age", Value: int32(34)},
+		{Key: "score", Value: 7.5},
+		{Key: "tags", Value: bson.A{"admin", "ops"}},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}, {Key: "zip", Value: "1000"}}},
+		{Key: "orders", Value: bson.A{
+			bson.D{{Key: "sku", Value: "a"}, {Key: "qty", Value: int32(2)}},
+			bson.D{{Key: "sku", Value: "b"}, {Key: "qty", Value: int32(5)}},
+		}},
+		{Key: "deleted", Value: nil},
+	}
+
+	tests := []struct {
+		name   string
+		filter bson.D
+		want   bool
+	}{
+		{name: "empty filter", filter: bson.D{}, want: true},
+		{name: "equal", filter: bson.D{{Key: "name", Value: "Jane"}}, want: true},
+		{name: "not equal", filter: bson.D{{Key: "name", Value: "John"}}, want: false},
+		{name: "numbers of different types", filter: bson.D{{Key: "age", Value: int64(34)}}, want: true},
+		{name: "number and string", filter: bson.D{{Key: "age", Value: "34"}}, want: false},
+		{name: "dotted path", filter: bson.D{{Key: "address.city", Value: "Lisbon"}}, want: true},
+		{name: "whole subdocument", filter: bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}, {Key: "zip", Value: "1000"}}}}, want: true},
+		{name: "subdocument field order", filter: bson.D{{Key: "address", Value: bson.D{{Key: "zip", Value: "1000"}, {Key: "city", Value: "Lisbon"}}}}, want: false},
+		{name: "array element", filter: bson.D{{Key: "tags", Value: "ops"}}, want: true},
+		{name: "array index", filter: bson.D{{Key: "tags.0", Value: "admin"}}, want: true},
+		{name: "path through an array", filter: bson.D{{Key: "orders.sku", Value: "b"}}, want: true},
+		{name: "null matches null", filter: bson.D{{Key: "deleted", Value: nil}}, want: true},
+		{name: "null matches a missing field", filter: bson.D{{Key: "missing", Value: nil}}, want: true},
+		{name: "$eq", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$eq", Value: "Jane"}}}}, want: true},
+		{name: "$ne", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$ne", Value: "Jane"}}}}, want: false},
+		{name: "$ne on an array", filter: bson.D{{Key: "tags", Value: bson.D{{Key: "$ne", Value: "ops"}}}}, want: false},
+		{name: "$gt", filter: bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 30}}}}, want: true},
+		{name: "$gte equal", filter: bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 34}}}}, want: true},
+		{name: "$lt", filter: bson.D{{Key: "score", Value: bson.D{{Key: "$lt", Value: 7}}}}, want: false},
+		{name: "$lte", filter: bson.D{{Key: "score", Value: bson.D{{Key: "$lte", Value: 7.5}}}}, want: true},
+		{name: "range", filter: bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 30}, {Key: "$lt", Value: 40}}}}, want: true},
+		{name: "$gt across types", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$gt", Value: 1}}}}, want: false},
+		{name: "$gt in an array", filter: bson.D{{Key: "orders.qty", Value: bson.D{{Key: "$gt", Value: 4}}}}, want: true},
+		{name: "$in", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: bson.A{"John", "Jane"}}}}}, want: true},
+		{name: "$in with a regex", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: bson.A{primitive.Regex{Pattern: "^J"}}}}}}, want: true},
+		{name: "$nin", filter: bson.D{{Key: "tags", Value: bson.D{{Key: "$nin", Value: bson.A{"ops"}}}}}, want: false},
+		{name: "$exists", filter: bson.D{{Key: "deleted", Value: bson.D{{Key: "$exists", Value: true}}}}, want: true},
+		{name: "$exists false", filter: bson.D{{Key: "missing", Value: bson.D{{Key: "$exists", Value: false}}}}, want: true},
+		{name: "$not", filter: bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 40}}}}}}, want: true},
+		{name: "$not regex", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: "^J"}}}}}, want: false},
+		{name: "regex value", filter: bson.D{{Key: "name", Value: primitive.Regex{Pattern: "^ja", Options: "i"}}}, want: true},
+		{name: "$regex with $options", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "NE$"}, {Key: "$options", Value: "i"}}}}, want: true},
+		{name: "$regex on a number", filter: bson.D{{Key: "age", Value: bson.D{{Key: "$regex", Value: "3"}}}}, want: false},
+		{name: "$size", filter: bson.D{{Key: "tags", Value: bson.D{{Key: "$size", Value: 2}}}}, want: true},
+		{name: "$all", filter: bson.D{{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{"ops", "admin"}}}}}, want: true},
+		{name: "$all missing one", filter: bson.D{{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{"ops", "dev"}}}}}, want: false},
+		{name: "$elemMatch on documents", filter: bson.D{{Key: "orders", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "sku", Value: "a"}, {Key: "qty", Value: bson.D{{Key: "$gt", Value: 3}}}}}}}}, want: false},
+		{name: "$elemMatch on values", filter: bson.D{{Key: "orders.qty", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gte", Value: 5}}}}}}, want: false},
+		{name: "$and", filter: bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "name", Value: "Jane"}}, bson.D{{Key: "age", Value: 34}}}}}, want: true},
+		{name: "$or", filter: bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "name", Value: "John"}}, bson.D{{Key: "age", Value: 34}}}}}, want: true},
+		{name: "$nor", filter: bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "name", Value: "John"}}, bson.D{{Key: "age", Value: 34}}}}}, want: false},
+		{name: "$comment", filter: bson.D{{Key: "$comment", Value: "audit"}, {Key: "name", Value: "Jane"}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := match(doc, tt.filter)
+			if err != nil {
+				t.Fatalf("matches() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("matches(%v) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesInvalidFilters(t *testing.T) {
+	doc := bson.D{{Key: "name", Value: "Jane"}}
+
+	tests := []struct {
+		name   string
+		filter bson.D
+	}{
+		{name: "unknown top level operator", filter: bson.D{{Key: "$unknown", Value: "true"}}},
+		{name: "unknown operator", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$near", Value: 1}}}}},
+		{name: "empty $or", filter: bson.D{{Key: "$or", Value: bson.A{}}}},
+		{name: "$and entry that is not a document", filter: bson.D{{Key: "$and", Value: bson.A{"name"}}}},
+		{name: "$in without an array", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: "Jane"}}}}},
+		{name: "$size without a number", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$size", Value: "2"}}}}},
+		{name: "invalid regex", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "("}}}}},
+		{name: "$not with a value", filter: bson.D{{Key: "name", Value: bson.D{{Key: "$not", Value: "Jane"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := match(doc, tt.filter); err == nil {
+				t.Errorf("matches(%v) succeeded, want an error", tt.filter)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package mongofake
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// applyUpdate returns doc changed by an update document of operators such as $set. insert reports whether
+// the document is being inserted by an upsert, which is when $setOnInsert applies.
+func applyUpdate(doc bson.D, update bson.D, insert bool) (bson.D, error) {
+	if len(update) == 0 {
+		return nil, failedToParse("update document must not be empty")
+	}
+	var value interface{} = clone(doc)
+	for _, operator := range update {
+		if !strings.HasPrefix(operator.Key, "$") {
+			return nil, failedToParse("the update operator %q must start with $, use a replacement to replace the document", operator.Key)
+		}
+		fields, ok := operator.Value.(bson.D)
+		if !ok {
+			return nil, failedToParse("modifiers for %s must be a document", operator.Key)
+		}
+		for _, field := range fields {
+			parts := strings.Split(field.Key, ".")
+			for _, part := range parts {
+				if strings.HasPrefix(part, "$") {
+					return nil, unsupported("the positional path %s", field.Key)
+				}
+			}
+			var err error
+			if value, err = applyOperator(value, operator.Key, parts, field.Value, insert); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value.(bson.D), nil
+}
+
+// applyOperator applies one update operator to the field at parts.
+func applyOperator(doc interface{}, operator string, parts []string, arg interface{}, insert bool) (interface{}, error) {
+	current, exists := getPath(doc, parts)
+	switch operator {
+	case "$set":
+		return setPath(doc, parts, arg)
+	case "$setOnInsert":
+		if !insert {
+			return doc, nil
+		}
+		return setPath(doc, parts, arg)
+	case "$unset":
+		return unsetPath(doc, parts), nil
+	case "$inc", "$mul":
+		if _, ok := toFloat(arg); !ok {
+			return nil, typeMismatch("cannot %s with non-numeric argument %v", operator[1:], arg)
+		}
+		if !exists {
+			if operator == "$mul" {
+				arg = multiply(arg, int32(0))
+			}
+			return setPath(doc, parts, arg)
+		}
+		if _, ok := toFloat(current); !ok {
+			return nil, typeMismatch("cannot apply %s to the non-numeric field %s", operator, strings.Join(parts, "."))
+		}
+		if operator == "$inc" {
+			return setPath(doc, parts, add(current, arg))
+		}
+		return setPath(doc, parts, multiply(current, arg))
+	case "$min", "$max":
+		if exists {
+			c := compare(arg, current)
+			if (operator == "$min" && c >= 0) || (operator == "$max" && c <= 0) {
+				return doc, nil
+			}
+		}
+		return setPath(doc, parts, arg)
+	case "$currentDate":
+		now := time.Now()
+		var value interface{} = primitive.NewDateTimeFromTime(now)
+		if spec, ok := arg.(bson.D); ok {
+			for _, e := range spec {
+				if e.Key == "$type" && e.Value == "timestamp" {
+					value = primitive.Timestamp{T: uint32(now.Unix())}
+				}
+			}
+		}
+		return setPath(doc, parts, value)
+	case "$push", "$addToSet":
+		var items bson.A
+		if each, ok := arg.(bson.D); ok && len(each) > 0 && each[0].Key == "$each" {
+			if len(each) > 1 {
+				return nil, unsupported("%s modifiers other than $each", operator)
+			}
+			if items, ok = each[0].Value.(bson.A); !ok {
+				return nil, badValue("the argument to $each in %s must be an array", operator)
+			}
+		} else {
+			items = bson.A{arg}
+		}
+		array, err := arrayAt(current, exists, operator, parts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if operator == "$addToSet" && contains(array, item) {
+				continue
+			}
+			array = append(array, item)
+		}
+		return setPath(doc, parts, array)
+	case "$pull":
+		if !exists {
+			return doc, nil
+		}
+		array, err := arrayAt(current, exists, operator, parts)
+		if err != nil {
+			return nil, err
+		}
+		kept := bson.A{}
+		for _, item := range array {
+			pull, err := pulls(item, arg)
+			if err != nil {
+				return nil, err
+			}
+			if !pull {
+				kept = append(kept, item)
+			}
+		}
+		return setPath(doc, parts, kept)
+	case "$pop":
+		if !exists {
+			return doc, nil
+		}
+		array, err := arrayAt(current, exists, operator, parts)
+		if err != nil {
+			return nil, err
+		}
+		if len(array) > 0 {
+			if n, _ := toInt64(arg); n < 0 {
+				array = array[1:]
+			} else {
+				array = array[:len(array)-1]
+			}
+		}
+		return setPath(doc, parts, array)
+	case "$rename":
+		to, ok := arg.(string)
+		if !ok || len(to) == 0 {
+			return nil, badValue("the $rename target of %s must be a nonempty string", strings.Join(parts, "."))
+		}
+		if !exists {
+			return doc, nil
+		}
+		return setPath(unsetPath(doc, parts), strings.Split(to, "."), current)
+	default:
+		return nil, failedToParse("unknown modifier: %s", operator)
+	}
+}
+
+// arrayAt returns the array an array operator changes, or an empty array when the field is missing.
+func arrayAt(current interface{}, exists bool, operator string, parts []string) (bson.A, error) {
+	if !exists {
+		return bson.A{}, nil
+	}
+	array, ok := current.(bson.A)
+	if !ok {
+		return nil, badValue("the field %s must be an array to apply %s", strings.Join(parts, "."), operator)
+	}
+	return append(bson.A{}, array...), nil
+}
+
+// contains reports whether array has an element equal to item.
+func contains(array bson.A, item interface{}) bool {
+	for _, v := range array {
+		if equal(v, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// pulls reports whether $pull removes item: item equals condition, matches a condition of operators, or is
+// a document matching a query.
+func pulls(item interface{}, condition interface{}) (bool, error) {
+	if _, ok := operatorDocument(condition); ok {
+		return matchCondition([]interface{}{item}, condition)
+	}
+	if query, ok := condition.(bson.D); ok {
+		if d, ok := item.(bson.D); ok {
+			return matches(d, query)
+		}
+		return false, nil
+	}
+	return equal(item, condition), nil
+}
+
+// add returns a + b in the wider of their number types.
+func add(a, b interface{}) interface{} {
+	return arithmetic(a, b, func(x, y int64) int64 { return x + y }, func(x, y float64) float64 { return x + y })
+}
+
+// multiply returns a * b in the wider of their number types.
+func multiply(a, b interface{}) interface{} {
+	return arithmetic(a, b, func(x, y int64) int64 { return x * y }, func(x, y float64) float64 { return x * y })
+}
+
+func arithmetic(a, b interface{}, ints func(x, y int64) int64, floats func(x, y float64) float64) interface{} {
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		return floats(x, y)
+	}
+	x, _ := toInt64(a)
+	y, _ := toInt64(b)
+	result := ints(x, y)
+	_, aInt32 := a.(int32)
+	_, bInt32 := b.(int32)
+	if aInt32 && bInt32 && int64(int32(result)) == result {
+		return int32(result)
+	}
+	return result
+}
+
+// getPath returns the value at the path parts of value, where a number selects an element of an array.
+func getPath(value interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return value, true
+	}
+	switch v := value.(type) {
+	case bson.D:
+		for _, e := range v {
+			if e.Key == parts[0] {
+				return getPath(e.Value, parts[1:])
+			}
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(v) {
+			return getPath(v[i], parts[1:])
+		}
+	}
+	return nil, false
+}
+
+// setPath returns value with the field at parts set to v, creating the documents on the way.
+func setPath(value interface{}, parts []string, v interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return v, nil
+	}
+	switch d := value.(type) {
+	case bson.D:
+		for i, e := range d {
+			if e.Key == parts[0] {
+				next, err := setPath(e.Value, parts[1:], v)
+				if err != nil {
+					return nil, err
+				}
+				d[i].Value = next
+				return d, nil
+			}
+		}
+		next, err := setPath(bson.D{}, parts[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		return append(d, bson.E{Key: parts[0], Value: next}), nil
+	case bson.A:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 {
+			return nil, pathNotViable("cannot create the field %q in an array", parts[0])
+		}
+		for len(d) <= i {
+			d = append(d, nil)
+		}
+		var current interface{} = d[i]
+		if current == nil && len(parts) > 1 {
+			current = bson.D{}
+		}
+		next, err := setPath(current, parts[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = next
+		return d, nil
+	default:
+		return nil, pathNotViable("cannot create the field %q in the element %v", parts[0], value)
+	}
+}
+
+// unsetPath returns value without the field at parts.
+func unsetPath(value interface{}, parts []string) interface{} {
+	switch d := value.(type) {
+	case bson.D:
+		for i, e := range d {
+			if e.Key != parts[0] {
+				continue
+			}
+			if len(parts) == 1 {
+				return append(d[:i:i], d[i+1:]...)
+			}
+			d[i].Value = unsetPath(e.Value, parts[1:])
+			return d
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(d) {
+			if len(parts) == 1 {
+				d[i] = nil
+			} else {
+				d[i] = unsetPath(d[i], parts[1:])
+			}
+		}
+	}
+	return value
+}
+
+// upsertSeed returns the document an upsert starts from: the fields a filter compares with equality.
+func upsertSeed(filter bson.D) (bson.D, error) {
+	var seed interface{} = bson.D{}
+	var collect func(filter bson.D) error
+	collect = func(filter bson.D) error {
+		for _, e := range filter {
+			if e.Key == "$and" {
+				clauses, _ := e.Value.(bson.A)
+				for _, clause := range clauses {
+					if d, ok := clause.(bson.D); ok {
+						if err := collect(d); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(e.Key, "$") {
+				continue
+			}
+			value := e.Value
+			if operators, ok := operatorDocument(value); ok {
+				if len(operators) != 1 || operators[0].Key != "$eq" {
+					continue
+				}
+				value = operators[0].Value
+			}
+			if _, ok := value.(primitive.Regex); ok {
+				continue
+			}
+			var err error
+			if seed, err = setPath(seed, strings.Split(e.Key, "."), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(filter); err != nil {
+		return nil, err
+	}
+	return seed.(bson.D), nil
+}
+
+// replaceDocument returns the replacement of doc, which keeps the _id of doc.
+func replaceDocument(doc bson.D, replacement bson.D) (bson.D, error) {
+	for _, e := range replacement {
+		if strings.HasPrefix(e.Key, "$") {
+			return nil, failedToParse("the replacement document must not contain update operators such as %s", e.Key)
+		}
+	}
+	id, _ := getPath(doc, []string{"_id"})
+	if newID, ok := getPath(replacement, []string{"_id"}); ok && !equal(id, newID) {
+		return nil, immutableField()
+	}
+	return withID(clone(replacement), id), nil
+}
+
+// withID returns doc with _id as its first field.
+func withID(doc bson.D, id interface{}) bson.D {
+	d := bson.D{{Key: "_id", Value: id}}
+	for _, e := range doc {
+		if e.Key != "_id" {
+			d = append(d, e)
+		}
+	}
+	return d
+}
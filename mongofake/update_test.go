@@ -0,0 +1,254 @@
+package mongofake
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// update applies changes to doc after a round trip through BSON, as the collection does.
+func update(doc, changes bson.D, insert bool) (bson.D, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toDocument(changes)
+	if err != nil {
+		return nil, err
+	}
+	return applyUpdate(d, u, insert)
+}
+
+func TestApplyUpdate(t *testing.T) {
+	doc := bson.D{
+		{Key: "_id", Value: int32(1)},
+		{Key: "name", Value: "Jane"},
+		{Key: "age", Value: int32(34)},
+		{Key: "tags", Value: bson.A{"admin", "ops"}},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}},
+	}
+
+	tests := []struct {
+		name   string
+		update bson.D
+		insert bool
+		want   bson.D
+	}{
+		{
+			name:   "$set",
+			update: bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "John"}, {Key: "email", Value: "john@example.com"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "John"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "email", Value: "john@example.com"}},
+		},
+		{
+			name:   "$set dotted path",
+			update: bson.D{{Key: "$set", Value: bson.D{{Key: "address.zip", Value: "1000"}, {Key: "meta.source", Value: "import"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}, {Key: "zip", Value: "1000"}}}, {Key: "meta", Value: bson.D{{Key: "source", Value: "import"}}}},
+		},
+		{
+			name:   "$set array element",
+			update: bson.D{{Key: "$set", Value: bson.D{{Key: "tags.1", Value: "dev"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "dev"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$setOnInsert on update",
+			update: bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "created", Value: true}}}},
+			want:   doc,
+		},
+		{
+			name:   "$setOnInsert on insert",
+			update: bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "created", Value: true}}}},
+			insert: true,
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "created", Value: true}},
+		},
+		{
+			name:   "$unset",
+			update: bson.D{{Key: "$unset", Value: bson.D{{Key: "tags", Value: ""}, {Key: "address.city", Value: ""}, {Key: "missing", Value: ""}}}},
+			want:   bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "address", Value: bson.D{}}},
+		},
+		{
+			name:   "$inc",
+			update: bson.D{{Key: "$inc", Value: bson.D{{Key: "age", Value: int32(1)}, {Key: "visits", Value: int32(1)}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(35)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "visits", Value: int32(1)}},
+		},
+		{
+			name:   "$inc by a double",
+			update: bson.D{{Key: "$inc", Value: bson.D{{Key: "age", Value: 0.5}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: 34.5}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$mul",
+			update: bson.D{{Key: "$mul", Value: bson.D{{Key: "age", Value: int64(2)}, {Key: "visits", Value: int32(3)}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int64(68)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "visits", Value: int32(0)}},
+		},
+		{
+			name:   "$min and $max",
+			update: bson.D{{Key: "$min", Value: bson.D{{Key: "age", Value: int32(30)}}}, {Key: "$max", Value: bson.D{{Key: "name", Value: "Adam"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(30)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$push",
+			update: bson.D{{Key: "$push", Value: bson.D{{Key: "tags", Value: "ops"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$push $each to a missing field",
+			update: bson.D{{Key: "$push", Value: bson.D{{Key: "scores", Value: bson.D{{Key: "$each", Value: bson.A{int32(1), int32(2)}}}}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "scores", Value: bson.A{int32(1), int32(2)}}},
+		},
+		{
+			name:   "$addToSet $each",
+			update: bson.D{{Key: "$addToSet", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "$each", Value: bson.A{"ops", "dev", "dev"}}}}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops", "dev"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$pull",
+			update: bson.D{{Key: "$pull", Value: bson.D{{Key: "tags", Value: "admin"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$pull with a condition",
+			update: bson.D{{Key: "$pull", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"admin", "ops"}}}}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$pop first",
+			update: bson.D{{Key: "$pop", Value: bson.D{{Key: "tags", Value: int32(-1)}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$pop last",
+			update: bson.D{{Key: "$pop", Value: bson.D{{Key: "tags", Value: int32(1)}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}},
+		},
+		{
+			name:   "$rename",
+			update: bson.D{{Key: "$rename", Value: bson.D{{Key: "name", Value: "profile.name"}}}},
+			want: bson.D{{Key: "_id", Value: int32(1)}, {Key: "age", Value: int32(34)}, {Key: "tags", Value: bson.A{"admin", "ops"}},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Lisbon"}}}, {Key: "profile", Value: bson.D{{Key: "name", Value: "Jane"}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := update(doc, tt.update, tt.insert)
+			if err != nil {
+				t.Fatalf("applyUpdate() error = %v", err)
+			}
+			want, err := toDocument(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("applyUpdate(%v) = %v, want %v", tt.update, got, want)
+			}
+		})
+	}
+}
+
+func TestApplyUpdateCurrentDate(t *testing.T) {
+	got, err := update(bson.D{{Key: "_id", Value: int32(1)}}, bson.D{{Key: "$currentDate", Value: bson.D{
+		{Key: "updated", Value: true},
+		{Key: "ts", Value: bson.D{{Key: "$type", Value: "timestamp"}}},
+	}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := getPath(got, []string{"updated"}); reflect.TypeOf(v) != reflect.TypeOf(primitive.DateTime(0)) {
+		t.Errorf("updated = %T, want a date", v)
+	}
+	if v, _ := getPath(got, []string{"ts"}); reflect.TypeOf(v) != reflect.TypeOf(primitive.Timestamp{}) {
+		t.Errorf("ts = %T, want a timestamp", v)
+	}
+}
+
+func TestApplyUpdateErrors(t *testing.T) {
+	doc := bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}, {Key: "tags", Value: bson.A{"admin"}}}
+
+	tests := []struct {
+		name   string
+		update bson.D
+		code   int32
+	}{
+		{name: "empty update", update: bson.D{}, code: codeFailedToParse},
+		{name: "replacement document", update: bson.D{{Key: "name", Value: "John"}}, code: codeFailedToParse},
+		{name: "unknown operator", update: bson.D{{Key: "$bogus", Value: bson.D{{Key: "name", Value: 1}}}}, code: codeFailedToParse},
+		{name: "$inc a string", update: bson.D{{Key: "$inc", Value: bson.D{{Key: "name", Value: int32(1)}}}}, code: codeTypeMismatch},
+		{name: "$inc by a string", update: bson.D{{Key: "$inc", Value: bson.D{{Key: "age", Value: "1"}}}}, code: codeTypeMismatch},
+		{name: "$push to a string", update: bson.D{{Key: "$push", Value: bson.D{{Key: "name", Value: "x"}}}}, code: codeBadValue},
+		{name: "$set through a string", update: bson.D{{Key: "$set", Value: bson.D{{Key: "name.first", Value: "x"}}}}, code: codePathNotViable},
+		{name: "$rename to nothing", update: bson.D{{Key: "$rename", Value: bson.D{{Key: "name", Value: ""}}}}, code: codeBadValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := update(doc, tt.update, false)
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("applyUpdate(%v) error = %v, want the code %d", tt.update, err, tt.code)
+			}
+		})
+	}
+}
+
+func TestUpsertSeed(t *testing.T) {
+	filter := bson.D{
+		{Key: "sku", Value: "a"},
+		{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(1)}}},
+		{Key: "status", Value: bson.D{{Key: "$eq", Value: "new"}}},
+		{Key: "name", Value: primitive.Regex{Pattern: "^a"}},
+		{Key: "$and", Value: bson.A{bson.D{{Key: "meta.source", Value: "import"}}}},
+		{Key: "$or", Value: bson.A{bson.D{{Key: "color", Value: "red"}}}},
+	}
+	got, err := upsertSeed(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "sku", Value: "a"}, {Key: "status", Value: "new"}, {Key: "meta", Value: bson.D{{Key: "source", Value: "import"}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("upsertSeed() = %v, want %v", got, want)
+	}
+}
+
+func TestReplaceDocument(t *testing.T) {
+	doc := bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Jane"}}
+
+	got, err := replaceDocument(doc, bson.D{{Key: "age", Value: int32(34)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.D{{Key: "_id", Value: int32(1)}, {Key: "age", Value: int32(34)}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("replaceDocument() = %v, want %v", got, want)
+	}
+
+	if _, err := replaceDocument(doc, bson.D{{Key: "_id", Value: int32(2)}}); errorCode(err) != codeImmutableField {
+		t.Errorf("replaceDocument() with another _id error = %v, want ImmutableField", err)
+	}
+	if _, err := replaceDocument(doc, bson.D{{Key: "$set", Value: bson.D{}}}); errorCode(err) != codeFailedToParse {
+		t.Errorf("replaceDocument() with an operator error = %v, want FailedToParse", err)
+	}
+}
+
+// errorCode returns the server error code of err, or 0 when it is not a server error.
+func errorCode(err error) int32 {
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) {
+		return commandErr.Code
+	}
+	return 0
+}
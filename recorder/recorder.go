@@ -0,0 +1,522 @@
+// Package recorder records the operations of a db.MongoDB to a cassette file and replays them without a
+// server. In ModeRecord every operation runs against MongoDB and is saved with its arguments and its result
+// or error; in ModeReplay the operations are answered from the cassette, in the order they were recorded,
+// and an operation that was not recorded fails with ErrUnmatched.
+//
+//	func TestShipOrder(t *testing.T) {
+//		// CHUX_DATASTORE_RECORD=1 go test ./... records the cassette, go test ./... replays it
+//		store := recorder.Start(t, mongoDB, "testdata/ship_order.cassette.json")
+//		ship(store, orderID)
+//	}
+//
+// Cassettes hold the documents as the code under test sees them, fields encrypted with WithFieldEncryption
+// are decrypted.
+package recorder
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"github.com/chuxorg/chux-datastore/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RecordEnv is the environment variable that makes Start record the cassette instead of replaying it, for
+// example CHUX_DATASTORE_RECORD=1 go test ./...
+const RecordEnv = "CHUX_DATASTORE_RECORD"
+
+// ErrUnmatched is wrapped by the ChuxDataStoreError returned in ModeReplay for an operation that is not in
+// the cassette. Use errors.Is to check for it.
+var ErrUnmatched = errors.NewChuxDataStoreError("no recorded interaction matches the request", 1300, nil)
+
+// Mode is whether a Recorder records or replays.
+type Mode int
+
+const (
+	// ModeReplay answers the operations from the cassette without using MongoDB.
+	ModeReplay Mode = iota
+	// ModeRecord runs the operations against MongoDB and records them. Stop writes the cassette.
+	ModeRecord
+)
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	if m == ModeRecord {
+		return "record"
+	}
+	return "replay"
+}
+
+// Interaction is a recorded operation: what was asked and what MongoDB answered.
+type Interaction struct {
+	Operation  string `bson:"operation"`
+	Database   string `bson:"database"`
+	Collection string `bson:"collection"`
+	Request    bson.D `bson:"request"`
+	Response   bson.D `bson:"response,omitempty"`
+	Error      *Error `bson:"error,omitempty"`
+}
+
+// Error is a recorded error. Code is the code of a ChuxDataStoreError, or 0 for any other error, and Cause
+// is the message of the error it wraps.
+type Error struct {
+	Message string `bson:"message"`
+	Code    int    `bson:"code,omitempty"`
+	Cause   string `bson:"cause,omitempty"`
+}
+
+// cassette is the content of a cassette file.
+type cassette struct {
+	Interactions []*Interaction `bson:"interactions"`
+}
+
+// tape holds the interactions of a Recorder. It is shared by the copies made by WithContext.
+type tape struct {
+	mu           sync.Mutex
+	path         string
+	mode         Mode
+	interactions []*Interaction
+	played       []bool
+}
+
+// Recorder is a db.IMongoDB that records or replays the operations of a db.MongoDB. It is safe for
+// concurrent use, but concurrent operations are recorded in the order they end, so a replay matches them
+// by their request rather than by their position.
+type Recorder struct {
+	mongoDB *db.MongoDB
+	tape    *tape
+}
+
+// Option configures a Recorder.
+type Option func(*tape)
+
+// WithMode sets whether the Recorder records or replays. The default is ModeReplay.
+func WithMode(mode Mode) Option {
+	return func(t *tape) {
+		t.mode = mode
+	}
+}
+
+// New returns a Recorder of the cassette file at path. In ModeReplay the cassette is read and mongoDB may
+// be nil, as it is not used; in ModeRecord the operations run against mongoDB and Stop writes the file.
+func New(mongoDB *db.MongoDB, path string, options ...Option) (*Recorder, error) {
+	t := &tape{path: path}
+	for _, option := range options {
+		option(t)
+	}
+	if t.mode == ModeRecord {
+		if mongoDB == nil {
+			return nil, fmt.Errorf("recorder: recording %s needs a MongoDB", path)
+		}
+		return &Recorder{mongoDB: mongoDB, tape: t}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("recorder: %w, set %s=1 to record it", err, RecordEnv)
+	}
+	var c cassette
+	if err := bson.UnmarshalExtJSON(data, true, &c); err != nil {
+		return nil, fmt.Errorf("recorder: %s: %w", path, err)
+	}
+	t.interactions = c.Interactions
+	t.played = make([]bool, len(c.Interactions))
+	return &Recorder{mongoDB: mongoDB, tape: t}, nil
+}
+
+// Start returns a Recorder for a test. It records the cassette when the RecordEnv environment variable is
+// set and replays it otherwise. The cassette is written when the test ends.
+func Start(t testing.TB, mongoDB *db.MongoDB, path string) *Recorder {
+	t.Helper()
+	mode := ModeReplay
+	if len(os.Getenv(RecordEnv)) > 0 {
+		mode = ModeRecord
+	}
+	r, err := New(mongoDB, path, WithMode(mode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Errorf("recorder: %s", err)
+		}
+	})
+	return r
+}
+
+// Mode returns whether the Recorder records or replays.
+func (r *Recorder) Mode() Mode {
+	return r.tape.mode
+}
+
+// WithContext returns a Recorder that runs the operations of MongoDB.WithContext(ctx) and shares the
+// cassette of r.
+func (r *Recorder) WithContext(ctx context.Context) *Recorder {
+	c := *r
+	if r.mongoDB != nil {
+		c.mongoDB = r.mongoDB.WithContext(ctx)
+	}
+	return &c
+}
+
+// Stop writes the cassette in ModeRecord, creating its directory. It does nothing in ModeReplay.
+func (r *Recorder) Stop() error {
+	t := r.tape
+	if t.mode != ModeRecord {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, err := bson.MarshalExtJSONIndent(cassette{Interactions: t.interactions}, true, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, append(data, '\n'), 0o644)
+}
+
+// Upsert records or replays MongoDB.Upsert. A replay sets the _id the document was given.
+func (r *Recorder) Upsert(doc db.IMongoDocument, filterFields ...string) error {
+	request, err := document("document", doc, "filterFields", filterFields)
+	if err != nil {
+		return err
+	}
+	response, err := r.play("Upsert", doc, request, func() (bson.D, error) {
+		err := r.mongoDB.Upsert(doc, filterFields...)
+		return bson.D{{Key: "id", Value: doc.GetID()}}, err
+	})
+	if id, ok := value(response, "id").(primitive.ObjectID); ok && r.tape.mode == ModeReplay {
+		doc.SetID(id)
+	}
+	return err
+}
+
+// GetByID records or replays MongoDB.GetByID.
+func (r *Recorder) GetByID(doc db.IMongoDocument, id string) (interface{}, error) {
+	response, err := r.play("GetByID", doc, bson.D{{Key: "id", Value: id}}, func() (bson.D, error) {
+		found, err := r.mongoDB.GetByID(doc, id)
+		if err != nil {
+			return nil, err
+		}
+		return document("document", found)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.tape.mode == ModeReplay {
+		if err := decode(response, "document", doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Query records or replays MongoDB.Query.
+func (r *Recorder) Query(doc db.IMongoDocument, queries ...interface{}) ([]db.IMongoDocument, error) {
+	var docs []db.IMongoDocument
+	response, err := r.play("Query", doc, bson.D{{Key: "queries", Value: bson.A(queries)}}, func() (bson.D, error) {
+		var err error
+		docs, err = r.mongoDB.Query(doc, queries...)
+		if err != nil {
+			return nil, err
+		}
+		return documents(docs)
+	})
+	if err != nil || r.tape.mode == ModeRecord {
+		return docs, err
+	}
+	return newDocuments(doc, response)
+}
+
+// GetAll records or replays MongoDB.GetAll.
+func (r *Recorder) GetAll(doc db.IMongoDocument) ([]db.IMongoDocument, error) {
+	var docs []db.IMongoDocument
+	response, err := r.play("GetAll", doc, bson.D{}, func() (bson.D, error) {
+		var err error
+		docs, err = r.mongoDB.GetAll(doc)
+		if err != nil {
+			return nil, err
+		}
+		return documents(docs)
+	})
+	if err != nil || r.tape.mode == ModeRecord {
+		return docs, err
+	}
+	return newDocuments(doc, response)
+}
+
+// Update records or replays MongoDB.Update.
+func (r *Recorder) Update(doc db.IMongoDocument, id string) error {
+	request, err := document("document", doc, "id", id)
+	if err != nil {
+		return err
+	}
+	_, err = r.play("Update", doc, request, func() (bson.D, error) {
+		return bson.D{}, r.mongoDB.Update(doc, id)
+	})
+	return err
+}
+
+// UpdateFields records or replays MongoDB.UpdateFields.
+func (r *Recorder) UpdateFields(doc db.IMongoDocument, id string, update *db.UpdateBuilder) (*db.UpdateResult, error) {
+	request := bson.D{{Key: "id", Value: id}}
+	if update != nil {
+		request = append(request, bson.E{Key: "update", Value: update.Document()})
+	}
+	result := &db.UpdateResult{}
+	response, err := r.play("UpdateFields", doc, request, func() (bson.D, error) {
+		res, err := r.mongoDB.UpdateFields(doc, id, update)
+		if err != nil {
+			return nil, err
+		}
+		result = res
+		return bson.D{{Key: "matched", Value: res.MatchedCount}, {Key: "modified", Value: res.ModifiedCount}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.tape.mode == ModeReplay {
+		result.MatchedCount, _ = value(response, "matched").(int64)
+		result.ModifiedCount, _ = value(response, "modified").(int64)
+	}
+	return result, nil
+}
+
+// Delete records or replays MongoDB.Delete.
+func (r *Recorder) Delete(doc db.IMongoDocument, id string) error {
+	_, err := r.play("Delete", doc, bson.D{{Key: "id", Value: id}}, func() (bson.D, error) {
+		return bson.D{}, r.mongoDB.Delete(doc, id)
+	})
+	return err
+}
+
+// DeleteAll records or replays MongoDB.DeleteAll.
+func (r *Recorder) DeleteAll(doc db.IMongoDocument) (int64, error) {
+	response, err := r.play("DeleteAll", doc, bson.D{}, func() (bson.D, error) {
+		deleted, err := r.mongoDB.DeleteAll(doc)
+		return bson.D{{Key: "deleted", Value: deleted}}, err
+	})
+	deleted, _ := value(response, "deleted").(int64)
+	return deleted, err
+}
+
+// CreateIndices records or replays MongoDB.CreateIndices.
+func (r *Recorder) CreateIndices(doc db.IMongoDocument, fieldNames ...string) (bool, error) {
+	response, err := r.play("CreateIndices", doc, bson.D{{Key: "fieldNames", Value: fieldNames}}, func() (bson.D, error) {
+		created, err := r.mongoDB.CreateIndices(doc, fieldNames...)
+		return bson.D{{Key: "created", Value: created}}, err
+	})
+	created, _ := value(response, "created").(bool)
+	return created, err
+}
+
+// play runs an operation. In ModeRecord it calls run and records the request with its response and error;
+// in ModeReplay it returns the response and the error of the first unplayed interaction with the same
+// operation, namespace and request.
+func (r *Recorder) play(operation string, doc db.IMongoDocument, request bson.D, run func() (bson.D, error)) (bson.D, error) {
+	// the request is stored as it is read back from the cassette, so that the replay compares like with like
+	request, err := normalize(request)
+	if err != nil {
+		return nil, fmt.Errorf("recorder: the %s request cannot be recorded: %w", operation, err)
+	}
+	i := &Interaction{
+		Operation:  operation,
+		Database:   doc.GetDatabaseName(),
+		Collection: doc.GetCollectionName(),
+		Request:    request,
+	}
+	t := r.tape
+
+	if t.mode == ModeRecord {
+		response, err := run()
+		if err != nil {
+			i.Error = recordError(err)
+		} else {
+			i.Response = response
+		}
+		t.mu.Lock()
+		t.interactions = append(t.interactions, i)
+		t.mu.Unlock()
+		return response, err
+	}
+
+	key := matchKey(i)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for n, recorded := range t.interactions {
+		if t.played[n] || matchKey(recorded) != key {
+			continue
+		}
+		t.played[n] = true
+		if recorded.Error != nil {
+			return recorded.Response, replayError(recorded.Error)
+		}
+		return recorded.Response, nil
+	}
+	msg := fmt.Sprintf("recorder: no recorded interaction matches %s of %s.%s with %s", operation, i.Database, i.Collection, extJSON(request))
+	return nil, errors.NewChuxDataStoreError(msg, 1300, ErrUnmatched)
+}
+
+// matchKey returns what identifies an interaction for a replay: its operation, its namespace and its
+// request with the fields of every document sorted, so that the random order of bson.M fields is ignored.
+func matchKey(i *Interaction) string {
+	return i.Operation + "|" + i.Database + "." + i.Collection + "|" + extJSON(sortedFields(i.Request))
+}
+
+// normalize returns request as it is after a round trip through a cassette file.
+func normalize(request bson.D) (bson.D, error) {
+	data, err := bson.MarshalExtJSON(request, true, false)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.UnmarshalExtJSON(data, true, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// sortedFields returns a copy of a value with the fields of every document sorted by name.
+func sortedFields(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: sortedFields(e.Value)}
+		}
+		sort.SliceStable(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+		return d
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, item := range v {
+			a[i] = sortedFields(item)
+		}
+		return a
+	}
+	return v
+}
+
+// extJSON returns v as canonical Extended JSON.
+func extJSON(v interface{}) string {
+	data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, true, false)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bytes.TrimSuffix(bytes.TrimPrefix(data, []byte(`{"v":`)), []byte("}")))
+}
+
+// sentinels are the errors a replay wraps again when they were the cause of a recorded error, so that
+// errors.Is works on replayed errors as it does on recorded ones.
+var sentinels = []error{
+	errors.ErrCircuitOpen,
+	errors.ErrTenantRequired,
+	errors.ErrTenantMismatch,
+	mongo.ErrNoDocuments,
+}
+
+// recordError returns the record of an error.
+func recordError(err error) *Error {
+	var chuxErr *errors.ChuxDataStoreError
+	if !stderrors.As(err, &chuxErr) {
+		return &Error{Message: err.Error()}
+	}
+	e := &Error{Message: chuxErr.Message, Code: chuxErr.Code()}
+	if chuxErr.Err != nil {
+		e.Cause = chuxErr.Err.Error()
+	}
+	return e
+}
+
+// replayError returns the error of a record, a ChuxDataStoreError unless the recorded error was not one.
+func replayError(e *Error) error {
+	if e.Code == 0 {
+		return stderrors.New(e.Message)
+	}
+	var cause error
+	if len(e.Cause) > 0 {
+		cause = stderrors.New(e.Cause)
+		for _, sentinel := range sentinels {
+			if sentinel.Error() == e.Cause {
+				cause = sentinel
+			}
+		}
+	}
+	return errors.NewChuxDataStoreError(e.Message, e.Code, cause)
+}
+
+// document returns a document of key and value pairs, marshalling the values that are documents.
+func document(pairs ...interface{}) (bson.D, error) {
+	d := bson.D{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v := pairs[i+1]
+		if doc, ok := v.(db.IMongoDocument); ok {
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			v = bson.Raw(raw)
+		}
+		d = append(d, bson.E{Key: pairs[i].(string), Value: v})
+	}
+	return d, nil
+}
+
+// documents returns the response of the operations that return documents.
+func documents(docs []db.IMongoDocument) (bson.D, error) {
+	raws := bson.A{}
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, bson.Raw(raw))
+	}
+	return bson.D{{Key: "documents", Value: raws}}, nil
+}
+
+// newDocuments decodes the documents of a response into new documents of the type of doc, as Query and
+// GetAll return them.
+func newDocuments(doc db.IMongoDocument, response bson.D) ([]db.IMongoDocument, error) {
+	raws, _ := value(response, "documents").(bson.A)
+	docs := make([]db.IMongoDocument, 0, len(raws))
+	for i := range raws {
+		newDoc := reflect.New(reflect.TypeOf(doc).Elem()).Interface().(db.IMongoDocument)
+		if err := decode(bson.D{{Key: "d", Value: raws[i]}}, "d", newDoc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, newDoc)
+	}
+	return docs, nil
+}
+
+// decode unmarshals the document at key of a response into v.
+func decode(response bson.D, key string, v interface{}) error {
+	data, err := bson.Marshal(bson.D{{Key: key, Value: value(response, key)}})
+	if err != nil {
+		return err
+	}
+	return bson.Raw(data).Lookup(key).Unmarshal(v)
+}
+
+// value returns the value of a field of a response, or nil.
+func value(response bson.D, key string) interface{} {
+	for _, e := range response {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package testfixtures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UpdateGoldenEnv is the environment variable that makes AssertGolden write the golden files instead of
+// comparing with them, for example CHUX_DATASTORE_UPDATE_GOLDEN=1 go test ./...
+const UpdateGoldenEnv = "CHUX_DATASTORE_UPDATE_GOLDEN"
+
+// GoldenOption configures Snapshot and AssertGolden.
+type GoldenOption func(*goldenOptions)
+
+type goldenOptions struct {
+	ignore []string
+}
+
+// IgnoreFields leaves fields out of the snapshot, such as times and ids set by the code under test.
+// Nested fields use dotted paths such as "audit.updatedAt".
+func IgnoreFields(fields ...string) GoldenOption {
+	return func(o *goldenOptions) {
+		o.ignore = append(o.ignore, fields...)
+	}
+}
+
+// Snapshot returns the documents of a collection as an indented relaxed Extended JSON array. The fields of
+// every document are sorted by name and the documents are sorted by their JSON, so the snapshot of the
+// same documents is always the same.
+func Snapshot(ctx context.Context, mongoDB *db.MongoDB, collection string, options ...GoldenOption) ([]byte, error) {
+	o := &goldenOptions{}
+	for _, option := range options {
+		option(o)
+	}
+
+	docs, err := mongoDB.WithContext(ctx).GetAll(db.NewDocument("", collection))
+	if err != nil {
+		return nil, err
+	}
+	rendered := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		d := doc.(*db.Document)
+		fields := bson.M{}
+		for name, value := range d.Fields {
+			fields[name] = value
+		}
+		fields["_id"] = d.ID
+		sorted := sortedDocument(fields)
+		for _, path := range o.ignore {
+			sorted = removePath(sorted, strings.Split(path, "."))
+		}
+		data, err := bson.MarshalExtJSON(sorted, false, false)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, string(data))
+	}
+	sort.Strings(rendered)
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte("["+strings.Join(rendered, ",")+"]"), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// AssertGolden fails the test when the documents of a collection differ from the golden file at path.
+// With the UpdateGoldenEnv environment variable set, it writes the golden file instead.
+func AssertGolden(t testing.TB, mongoDB *db.MongoDB, collection, path string, options ...GoldenOption) {
+	t.Helper()
+	got, err := Snapshot(context.Background(), mongoDB, collection, options...)
+	if err != nil {
+		t.Fatalf("testfixtures: could not read the collection %s: %s", collection, err)
+	}
+
+	if len(os.Getenv(UpdateGoldenEnv)) > 0 {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("testfixtures: %s", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("testfixtures: %s", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("testfixtures: %s, set %s=1 to create it", err, UpdateGoldenEnv)
+	}
+	if diff := diffLines(string(want), string(got)); len(diff) > 0 {
+		t.Errorf("testfixtures: the collection %s differs from %s, set %s=1 to update it\n%s", collection, path, UpdateGoldenEnv, diff)
+	}
+}
+
+// sortedDocument returns a copy of a document value with the fields of every document sorted by name.
+func sortedDocument(value interface{}) interface{} {
+	var fields bson.D
+	switch v := value.(type) {
+	case bson.M:
+		for name, item := range v {
+			fields = append(fields, bson.E{Key: name, Value: item})
+		}
+	case map[string]interface{}:
+		for name, item := range v {
+			fields = append(fields, bson.E{Key: name, Value: item})
+		}
+	case bson.D:
+		fields = append(fields, v...)
+	case bson.A:
+		sorted := make(bson.A, len(v))
+		for i, item := range v {
+			sorted[i] = sortedDocument(item)
+		}
+		return sorted
+	case []interface{}:
+		return sortedDocument(bson.A(v))
+	default:
+		return value
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	for i := range fields {
+		fields[i].Value = sortedDocument(fields[i].Value)
+	}
+	return fields
+}
+
+// removePath returns a document value without the field at path.
+func removePath(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		kept := make(bson.D, 0, len(v))
+		for _, e := range v {
+			if e.Key == path[0] {
+				if len(path) == 1 {
+					continue
+				}
+				e.Value = removePath(e.Value, path[1:])
+			}
+			kept = append(kept, e)
+		}
+		return kept
+	case bson.A:
+		kept := make(bson.A, len(v))
+		for i, item := range v {
+			kept[i] = removePath(item, path)
+		}
+		return kept
+	default:
+		return value
+	}
+}
+
+// diffLines returns the first line where want and got differ with the lines around it, or an empty string
+// when they are equal.
+func diffLines(want, got string) string {
+	if want == got {
+		return ""
+	}
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	line := 0
+	for line < len(wantLines) && line < len(gotLines) && wantLines[line] == gotLines[line] {
+		line++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "first difference at line %d:\n", line+1)
+	for i := max(0, line-3); i < line; i++ {
+		fmt.Fprintf(&b, "  %s\n", wantLines[i])
+	}
+	for i := line; i < len(wantLines) && i < line+5; i++ {
+		fmt.Fprintf(&b, "- %s\n", wantLines[i])
+	}
+	for i := line; i < len(gotLines) && i < line+5; i++ {
+		fmt.Fprintf(&b, "+ %s\n", gotLines[i])
+	}
+	return b.String()
+}
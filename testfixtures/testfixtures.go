@@ -0,0 +1,489 @@
+// Package testfixtures loads fixture files into MongoDB collections through db.MongoDB before a test and
+// compares collections with golden files after it.
+//
+// A fixture file is a YAML or JSON document that maps collection names to named documents:
+//
+//	customers:
+//	  alice:
+//	    name: Alice
+//	    createdAt: '{{ now }}'
+//	orders:
+//	  first:
+//	    customerId: '{{ ref "customers.alice" }}'
+//	    placedAt: '{{ ago "36h" }}'
+//	    total: 42.5
+//
+// Every fixture gets an ObjectID derived from its collection and name, so the same fixture has the same
+// _id in every run and other fixtures can refer to it. A fixture can set its own _id as a hex string or
+// with the id template. Strings can hold these templates:
+//
+//	{{ ref "customers.alice" }}   the _id of another fixture
+//	{{ id "any name" }}           an ObjectID derived from the name, the same in every run
+//	{{ now }}                     the time of the Loader, see WithNow
+//	{{ ago "36h" }}               the time of the Loader minus a duration, days are written as "2d"
+//	{{ fromNow "2d" }}            the time of the Loader plus a duration
+//	{{ time "2024-01-02" }}       a time in RFC 3339 or as a date
+//
+// A string that is only a template gets the value of the template, an ObjectID or a date. Templates inside
+// a longer string are replaced by their text, the hex of an ObjectID or a time in RFC 3339.
+//
+// Example:
+//
+//	func TestShipOrder(t *testing.T) {
+//		fixtures := testfixtures.Load(t, mongoDB, testfixtures.WithFiles("testdata/orders.yaml"))
+//		ship(fixtures.ID("orders.first"))
+//		testfixtures.AssertGolden(t, mongoDB, "orders", "testdata/orders.golden.json",
+//			testfixtures.IgnoreFields("shippedAt"))
+//	}
+package testfixtures
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chuxorg/chux-datastore/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+)
+
+// Loader truncates collections and loads fixture files into them.
+type Loader struct {
+	mongoDB  *db.MongoDB
+	paths    []string
+	truncate []string
+	now      time.Time
+	ids      map[string]primitive.ObjectID
+}
+
+// fixture is a named document of a fixture file.
+type fixture struct {
+	collection string
+	name       string
+	file       string
+	fields     map[string]interface{}
+	id         primitive.ObjectID
+}
+
+// New returns a Loader that loads fixtures into the collections of mongoDB.
+// Example:
+//
+//	loader := testfixtures.New(mongoDB,
+//		testfixtures.WithFiles("testdata/fixtures"),
+//		testfixtures.WithNow(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)),
+//	)
+//	if err := loader.Load(ctx); err != nil {
+//		return err
+//	}
+func New(mongoDB *db.MongoDB, options ...func(*Loader)) *Loader {
+
+	l := &Loader{
+		mongoDB: mongoDB,
+		now:     time.Now().UTC().Truncate(time.Millisecond),
+		ids:     map[string]primitive.ObjectID{},
+	}
+	for _, o := range options {
+		o(l)
+	}
+
+	return l
+}
+
+// WithFiles is a functional option that adds fixture files. A directory adds its .yaml, .yml and .json
+// files in name order.
+func WithFiles(paths ...string) func(*Loader) {
+
+	return func(s *Loader) {
+		s.paths = append(s.paths, paths...)
+	}
+}
+
+// WithTruncate is a functional option that empties collections that have no fixtures, such as the
+// collections the code under test writes to.
+func WithTruncate(collections ...string) func(*Loader) {
+
+	return func(s *Loader) {
+		s.truncate = append(s.truncate, collections...)
+	}
+}
+
+// WithNow is a functional option that sets the time used by the now, ago and fromNow templates. By default
+// it is the time New was called, so set it when the times are compared with golden files.
+func WithNow(now time.Time) func(*Loader) {
+
+	return func(s *Loader) {
+		s.now = now.UTC().Truncate(time.Millisecond)
+	}
+}
+
+// Load is a test helper that loads the fixtures of the options with a new Loader and fails the test when
+// they cannot be loaded.
+func Load(t testing.TB, mongoDB *db.MongoDB, options ...func(*Loader)) *Loader {
+	t.Helper()
+	l := New(mongoDB, options...)
+	if err := l.Load(context.Background()); err != nil {
+		t.Fatalf("testfixtures: %s", err)
+	}
+	return l
+}
+
+// Load reads the fixture files, empties every collection that has fixtures or is named by WithTruncate and
+// inserts the fixtures. Call it at the start of each test so that every test sees the same documents.
+func (l *Loader) Load(ctx context.Context) error {
+	fixtures, err := l.read()
+	if err != nil {
+		return err
+	}
+
+	byCollection := map[string][]*fixture{}
+	for _, f := range fixtures {
+		byCollection[f.collection] = append(byCollection[f.collection], f)
+	}
+	collections := append([]string{}, l.truncate...)
+	for collection := range byCollection {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	mongoDB := l.mongoDB.WithContext(ctx)
+	for i, collection := range collections {
+		if i > 0 && collection == collections[i-1] {
+			continue
+		}
+		doc := db.NewDocument("", collection)
+		if _, err := mongoDB.DeleteAll(doc); err != nil {
+			return fmt.Errorf("could not empty the collection %s: %w", collection, err)
+		}
+		if len(byCollection[collection]) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		for _, f := range byCollection[collection] {
+			data, err := bson.Marshal(f.document())
+			if err != nil {
+				return fmt.Errorf("%s: %s.%s: %w", f.file, f.collection, f.name, err)
+			}
+			buf.Write(data)
+		}
+		if _, err := mongoDB.Import(doc, &buf, db.FormatBSON, db.ImportInsert); err != nil {
+			return fmt.Errorf("could not load the fixtures of the collection %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// ID returns the _id of the fixture named "collection.name", or the zero ObjectID when there is no such
+// fixture. It is set by Load.
+func (l *Loader) ID(ref string) primitive.ObjectID {
+	return l.ids[ref]
+}
+
+// Now returns the time used by the now, ago and fromNow templates.
+func (l *Loader) Now() time.Time {
+	return l.now
+}
+
+// document returns the fixture as a document with its _id first and the other fields sorted by name.
+func (f *fixture) document() bson.D {
+	names := make([]string, 0, len(f.fields))
+	for name := range f.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	doc := bson.D{{Key: "_id", Value: f.id}}
+	for _, name := range names {
+		doc = append(doc, bson.E{Key: name, Value: f.fields[name]})
+	}
+	return doc
+}
+
+// read parses the fixture files, assigns the _id of every fixture and then expands the templates, so a
+// fixture can refer to any other fixture.
+func (l *Loader) read() ([]*fixture, error) {
+	files, err := fixtureFiles(l.paths)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*fixture
+	ids := map[string]primitive.ObjectID{}
+	for _, file := range files {
+		parsed, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range parsed {
+			ref := f.collection + "." + f.name
+			if _, ok := ids[ref]; ok {
+				return nil, fmt.Errorf("%s: %s is defined twice", file, ref)
+			}
+			f.id = deterministicID(ref)
+			ids[ref] = f.id
+			fixtures = append(fixtures, f)
+		}
+	}
+
+	// an _id set by a fixture cannot refer to other fixtures, their _id may not be known yet
+	l.ids = nil
+	for _, f := range fixtures {
+		value, ok := f.fields["_id"]
+		if !ok {
+			continue
+		}
+		delete(f.fields, "_id")
+		expanded, err := l.expand(value)
+		if err == nil {
+			f.id, err = toObjectID(expanded)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s.%s._id: %w", f.file, f.collection, f.name, err)
+		}
+		ids[f.collection+"."+f.name] = f.id
+	}
+	l.ids = ids
+	for _, f := range fixtures {
+		for name, value := range f.fields {
+			expanded, err := l.expand(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s.%s.%s: %w", f.file, f.collection, f.name, name, err)
+			}
+			f.fields[name] = expanded
+		}
+	}
+	return fixtures, nil
+}
+
+// fixtureFiles returns the files of paths, replacing a directory by its fixture files in name order.
+func fixtureFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// readFile parses a fixture file. JSON is read by the YAML parser, of which it is a subset.
+func readFile(file string) ([]*fixture, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var collections map[string]map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &collections); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	var fixtures []*fixture
+	for collection, docs := range collections {
+		for name, fields := range docs {
+			if fields == nil {
+				fields = map[string]interface{}{}
+			}
+			fixtures = append(fixtures, &fixture{collection: collection, name: name, file: file, fields: fields})
+		}
+	}
+	sort.Slice(fixtures, func(i, j int) bool {
+		if fixtures[i].collection != fixtures[j].collection {
+			return fixtures[i].collection < fixtures[j].collection
+		}
+		return fixtures[i].name < fixtures[j].name
+	})
+	return fixtures, nil
+}
+
+// template matches a template in a string. templateArgs splits its words, quoted or not.
+var (
+	template     = regexp.MustCompile(`\{\{\s*(.*?)\s*\}\}`)
+	templateArgs = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|\S+`)
+)
+
+// expand replaces the templates in the strings of a fixture value.
+func (l *Loader) expand(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return l.expandString(v)
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			x, err := l.expand(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			expanded[key] = x
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			x, err := l.expand(item)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %w", i, err)
+			}
+			expanded[i] = x
+		}
+		return expanded, nil
+	default:
+		return value, nil
+	}
+}
+
+// expandString returns the value of a string that is only a template, or the string with its templates
+// replaced by their text.
+func (l *Loader) expandString(s string) (interface{}, error) {
+	matches := template.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		return l.evaluate(s[matches[0][2]:matches[0][3]])
+	}
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		value, err := l.evaluate(s[match[2]:match[3]])
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(s[last:match[0]])
+		switch v := value.(type) {
+		case primitive.ObjectID:
+			b.WriteString(v.Hex())
+		case time.Time:
+			b.WriteString(v.Format(time.RFC3339Nano))
+		default:
+			fmt.Fprint(&b, v)
+		}
+		last = match[1]
+	}
+	b.WriteString(s[last:])
+	return b.String(), nil
+}
+
+// evaluate returns the value of the expression of a template, a function name followed by its arguments.
+func (l *Loader) evaluate(expression string) (interface{}, error) {
+	words := templateArgs.FindAllString(expression, -1)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty template")
+	}
+	args := make([]string, 0, len(words)-1)
+	for _, word := range words[1:] {
+		if strings.HasPrefix(word, `"`) {
+			unquoted, err := strconv.Unquote(word)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in {{ %s }}", word, expression)
+			}
+			word = unquoted
+		}
+		args = append(args, word)
+	}
+
+	name := words[0]
+	arity := map[string]int{"ref": 1, "id": 1, "now": 0, "ago": 1, "fromNow": 1, "time": 1}
+	n, ok := arity[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template function %q in {{ %s }}", name, expression)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d argument(s) in {{ %s }}", name, n, expression)
+	}
+	switch name {
+	case "ref":
+		if l.ids == nil {
+			return nil, fmt.Errorf("ref cannot be used in an _id")
+		}
+		id, ok := l.ids[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown fixture %q, refer to fixtures as \"collection.name\"", args[0])
+		}
+		return id, nil
+	case "id":
+		return deterministicID(args[0]), nil
+	case "now":
+		return l.now, nil
+	case "ago", "fromNow":
+		d, err := parseDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if name == "ago" {
+			d = -d
+		}
+		return l.now.Add(d), nil
+	default:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, args[0]); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid time %q, use RFC 3339 or 2006-01-02", args[0])
+	}
+}
+
+// parseDuration parses a Go duration that can also count days, such as "2d" or "1d12h".
+func parseDuration(s string) (time.Duration, error) {
+	var days int64
+	rest := s
+	if i := strings.Index(s, "d"); i > 0 {
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days, rest = n, s[i+1:]
+	}
+	d := time.Duration(0)
+	if len(rest) > 0 {
+		parsed, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = parsed
+	}
+	return time.Duration(days)*24*time.Hour + d, nil
+}
+
+// deterministicID returns an ObjectID made of the first 12 bytes of the SHA-256 of name.
+func deterministicID(name string) primitive.ObjectID {
+	sum := sha256.Sum256([]byte(name))
+	var id primitive.ObjectID
+	copy(id[:], sum[:len(id)])
+	return id
+}
+
+// toObjectID converts the _id of a fixture, an ObjectID or its hex, to an ObjectID.
+func toObjectID(value interface{}) (primitive.ObjectID, error) {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v, nil
+	case string:
+		return primitive.ObjectIDFromHex(v)
+	default:
+		return primitive.NilObjectID, fmt.Errorf("the _id must be an ObjectID, got %T", value)
+	}
+}
@@ -0,0 +1,26 @@
+// Package tracingtest provides an in-memory OpenTelemetry tracer provider for tests of code that
+// uses db.WithTracerProvider.
+//
+// Example:
+//
+//	provider, exporter := tracingtest.NewProvider()
+//	mongoDB := db.New(db.WithTracerProvider(provider))
+//	...
+//	spans := exporter.GetSpans()
+package tracingtest
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// NewProvider returns a tracer provider that samples every span and exports it synchronously to the
+// returned in-memory exporter, so spans can be inspected as soon as they end.
+func NewProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSyncer(exporter),
+	)
+	return provider, exporter
+}